@@ -0,0 +1,192 @@
+package admin
+
+//
+// an RPC service for operating a running Raft server. a server
+// registers an Admin next to its Raft (see cmd/raftnode), and tools
+// like cmd/raftctl talk to it through a Client.
+//
+// svc := rpc_mock.MakeService(admin.MakeAdmin(rf, snapshot))
+// ac := admin.MakeClient(end)
+// ac.Status() (raft.Status, error) -- term, role, indexes, replication progress
+// ac.Snapshot() (index, error) -- have the service snapshot now
+// ac.TransferLeadership(target) error -- on the leader
+// ac.AddServer(server)/ac.RemoveServer(server) (index, error) -- on the leader
+//
+// errors travel as strings, the Client turns the ones Raft defines
+// back into raft.ErrNotLeader etc., or into errors wrapping them, so
+// callers can compare them with errors.Is().
+//
+
+import (
+	"errors"
+	"fmt"
+	"raft"
+	"strings"
+)
+
+var (
+	ErrUnreachable = errors.New("admin: no reply from the server")
+	ErrNoSnapshot  = errors.New("admin: the service can't snapshot")
+)
+
+// errors a Client can return as themselves instead of a copy.
+var knownErrors = []error{
+	raft.ErrNotLeader,
+	raft.ErrNotMember,
+	raft.ErrTransferInProgress,
+	raft.ErrTransferFailed,
+	raft.ErrShutdown,
+	raft.ErrBadServers,
+	raft.ErrChangePending,
+	ErrNoSnapshot,
+}
+
+type StatusArgs struct{}
+
+type StatusReply struct {
+	Status raft.Status
+}
+
+type SnapshotArgs struct{}
+
+type SnapshotReply struct {
+	Index int
+	Err   string
+}
+
+type TransferArgs struct {
+	Target int
+}
+
+type TransferReply struct {
+	Err string
+}
+
+type MembershipArgs struct {
+	Server int
+	Remove bool // false adds Server
+}
+
+type MembershipReply struct {
+	Index int // where the ConfigChange entry will appear if it commits
+	Err   string
+}
+
+type Admin struct {
+	rf       *raft.Raft
+	snapshot func() int
+}
+
+//
+// serve rf. snapshot has the service snapshot everything it has
+// applied and returns the index the snapshot covers, nil if the
+// service can't.
+//
+func MakeAdmin(rf *raft.Raft, snapshot func() int) *Admin {
+	return &Admin{rf: rf, snapshot: snapshot}
+}
+
+func (a *Admin) Status(args StatusArgs, reply *StatusReply) {
+	reply.Status = a.rf.Status()
+}
+
+func (a *Admin) Snapshot(args SnapshotArgs, reply *SnapshotReply) {
+	if a.snapshot == nil {
+		reply.Err = ErrNoSnapshot.Error()
+		return
+	}
+	reply.Index = a.snapshot()
+}
+
+func (a *Admin) TransferLeadership(args TransferArgs, reply *TransferReply) {
+	reply.Err = errString(a.rf.TransferLeadership(args.Target))
+}
+
+func (a *Admin) ChangeMembership(args MembershipArgs, reply *MembershipReply) {
+	var index int
+	var err error
+	if args.Remove {
+		index, _, err = a.rf.RemoveServer(args.Server)
+	} else {
+		index, _, err = a.rf.AddServer(args.Server)
+	}
+	reply.Index = index
+	reply.Err = errString(err)
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func stringErr(s string) error {
+	if s == "" {
+		return nil
+	}
+	for _, err := range knownErrors {
+		if err.Error() == s {
+			return err
+		}
+		// fmt.Errorf("%w: ...", err)
+		if strings.HasPrefix(s, err.Error()+": ") {
+			return fmt.Errorf("%w%s", err, s[len(err.Error()):])
+		}
+	}
+	return errors.New(s)
+}
+
+// talks to the Admin of one server.
+type Client struct {
+	end raft.Transport
+}
+
+func MakeClient(end raft.Transport) *Client {
+	return &Client{end: end}
+}
+
+func (c *Client) Status() (raft.Status, error) {
+	reply := &StatusReply{}
+	if !c.end.Call("Admin.Status", StatusArgs{}, reply) {
+		return raft.Status{}, ErrUnreachable
+	}
+	return reply.Status, nil
+}
+
+func (c *Client) Snapshot() (int, error) {
+	reply := &SnapshotReply{}
+	if !c.end.Call("Admin.Snapshot", SnapshotArgs{}, reply) {
+		return -1, ErrUnreachable
+	}
+	return reply.Index, stringErr(reply.Err)
+}
+
+// returns once the leader has told target to start an election, see
+// raft.TransferLeadership().
+func (c *Client) TransferLeadership(target int) error {
+	reply := &TransferReply{}
+	if !c.end.Call("Admin.TransferLeadership", TransferArgs{Target: target}, reply) {
+		return ErrUnreachable
+	}
+	return stringErr(reply.Err)
+}
+
+func (c *Client) AddServer(server int) (int, error) {
+	return c.changeMembership(MembershipArgs{Server: server})
+}
+
+func (c *Client) RemoveServer(server int) (int, error) {
+	return c.changeMembership(MembershipArgs{Server: server, Remove: true})
+}
+
+func (c *Client) changeMembership(args MembershipArgs) (int, error) {
+	reply := &MembershipReply{}
+	if !c.end.Call("Admin.ChangeMembership", args, reply) {
+		return -1, ErrUnreachable
+	}
+	if err := stringErr(reply.Err); err != nil {
+		return -1, err
+	}
+	return reply.Index, nil
+}
@@ -0,0 +1,162 @@
+package admin
+
+import (
+	"errors"
+	"raft"
+	"raft/rpc_mock"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// n Rafts with an Admin each on a reliable Network, and a Client for each.
+func makeCluster(t *testing.T, n int) ([]*raft.Raft, []*Client) {
+	net := rpc_mock.MakeNetwork()
+	rafts := make([]*raft.Raft, n)
+	clients := make([]*Client, n)
+	for i := 0; i < n; i++ {
+		peers := make([]raft.Transport, n)
+		for j := 0; j < n; j++ {
+			name := strconv.Itoa(i) + "-" + strconv.Itoa(j)
+			end := net.MakeEnd(name)
+			net.Connect(name, j)
+			net.Enable(name, true)
+			peers[j] = end
+		}
+		applyCh := make(chan raft.ApplyMsg)
+		go func() {
+			for range applyCh {
+			}
+		}()
+		rf, err := raft.Make(peers, i, raft.MakePersister(), applyCh)
+		if err != nil {
+			t.Fatalf("Make(): %v", err)
+		}
+		// a new leader must commit an entry of its term before a membership change
+		rf.SetNoOp(true)
+		rafts[i] = rf
+
+		// only server 0 can snapshot
+		var snapshot func() int
+		if i == 0 {
+			snapshot = func() int { return 7 }
+		}
+		srv := rpc_mock.MakeServer()
+		srv.AddService(rpc_mock.MakeService(rf))
+		srv.AddService(rpc_mock.MakeService(MakeAdmin(rf, snapshot)))
+		net.AddServer(i, srv)
+
+		name := "admin-" + strconv.Itoa(i)
+		end := net.MakeEnd(name)
+		net.Connect(name, i)
+		net.Enable(name, true)
+		clients[i] = MakeClient(end)
+	}
+	return rafts, clients
+}
+
+// waits for a server to say it's the leader, the one with the highest term.
+func waitLeader(t *testing.T, clients []*Client) int {
+	for iters := 0; iters < 30; iters++ {
+		leader, term := -1, -1
+		for i, c := range clients {
+			status, err := c.Status()
+			if err != nil {
+				t.Fatalf("Status() of %v: %v", i, err)
+			}
+			if status.Role == "leader" && status.Term > term {
+				leader, term = i, status.Term
+			}
+		}
+		if leader != -1 {
+			return leader
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("no leader")
+	return -1
+}
+
+// waits until the leader has committed all of its Logs.
+func waitCommitted(t *testing.T, c *Client) {
+	for iters := 0; iters < 30; iters++ {
+		status, _ := c.Status()
+		if status.CommitIndex == status.LastLogIndex && status.LastLogTerm == status.Term {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("leader didn't commit its Logs")
+}
+
+func TestAdmin(t *testing.T) {
+	servers := 3
+	rafts, clients := makeCluster(t, servers)
+	defer func() {
+		for _, rf := range rafts {
+			rf.Kill()
+		}
+	}()
+
+	leader := waitLeader(t, clients)
+	waitCommitted(t, clients[leader])
+	status, _ := clients[leader].Status()
+	if status.Id != leader || len(status.Progress) != servers-1 || len(status.Config.Servers) != servers {
+		t.Fatalf("wrong leader status %+v", status)
+	}
+	follower := (leader + 1) % servers
+	if status, _ := clients[follower].Status(); status.Role != "follower" || status.Progress != nil {
+		t.Fatalf("wrong follower status %+v", status)
+	}
+
+	if index, err := clients[0].Snapshot(); err != nil || index != 7 {
+		t.Fatalf("Snapshot() on 0 returned %v %v", index, err)
+	}
+	if _, err := clients[1].Snapshot(); err != ErrNoSnapshot {
+		t.Fatalf("Snapshot() without a snapshot func returned %v, expected ErrNoSnapshot", err)
+	}
+
+	// membership changes only on the leader, and only real changes.
+	if _, err := clients[follower].RemoveServer(follower); err != raft.ErrNotLeader {
+		t.Fatalf("RemoveServer() on a follower returned %v, expected ErrNotLeader", err)
+	}
+	if _, err := clients[leader].AddServer(follower); !errors.Is(err, raft.ErrBadServers) {
+		t.Fatalf("AddServer() of a member returned %v, expected ErrBadServers", err)
+	}
+	if _, err := clients[leader].AddServer(-1); !errors.Is(err, raft.ErrBadServers) {
+		t.Fatalf("AddServer(-1) returned %v, expected ErrBadServers", err)
+	}
+	if _, err := clients[leader].RemoveServer(servers); err != raft.ErrNotMember {
+		t.Fatalf("RemoveServer() of a non-member returned %v, expected ErrNotMember", err)
+	}
+	if _, err := clients[leader].RemoveServer(follower); err != nil {
+		t.Fatalf("RemoveServer(): %v", err)
+	}
+	waitCommitted(t, clients[leader])
+	if _, err := clients[leader].AddServer(follower); err != nil {
+		t.Fatalf("AddServer(): %v", err)
+	}
+
+	// hand leadership over.
+	target := (leader + 2) % servers
+	if err := clients[follower].TransferLeadership(target); err != raft.ErrNotLeader {
+		t.Fatalf("TransferLeadership() on a follower returned %v, expected ErrNotLeader", err)
+	}
+	if err := clients[leader].TransferLeadership(target); err != nil {
+		t.Fatalf("TransferLeadership(): %v", err)
+	}
+	for iters := 0; ; iters++ {
+		if status, _ := clients[target].Status(); status.Role == "leader" {
+			break
+		}
+		if iters == 30 {
+			t.Fatalf("%v didn't take over", target)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	rafts[0].Kill()
+	if status, err := clients[0].Status(); err != nil || status.Role != "shutdown" {
+		t.Fatalf("Status() of a killed server returned %+v %v", status, err)
+	}
+}
@@ -0,0 +1,264 @@
+//
+// raftctl inspects and operates the nodes of a cluster started with
+// cmd/raftnode, through the admin.Admin service of each node.
+//
+//	raftctl -config cluster.json status [id ...]   term, role, indexes of the nodes, all by default
+//	raftctl -config cluster.json snapshot id       have node id snapshot now
+//	raftctl -config cluster.json transfer id       have the leader hand leadership to node id
+//	raftctl -config cluster.json add id            add node id to the configuration
+//	raftctl -config cluster.json remove id         remove node id from the configuration
+//
+// transfer, add and remove go to whichever node says it's the leader.
+// only nodes in the cluster file can be added, the others already
+// have connections to them. a node to add that has no state yet runs
+// with raftnode -join. -json prints status as JSON.
+//
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"raft"
+	"raft/admin"
+	"raft/rpc_mock"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: raftctl -config cluster.json status [id ...] | snapshot id | transfer id | add id | remove id\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	configPath := flag.String("config", "cluster.json", "the cluster file of cmd/raftnode")
+	timeout := flag.Duration("timeout", 5*time.Second, "how long to wait for a node to answer")
+	jsonOut := flag.Bool("json", false, "print status as JSON")
+	flag.Usage = usage
+	flag.Parse()
+
+	addrs, err := loadAddrs(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "raftctl: %v\n", err)
+		os.Exit(1)
+	}
+	ctl := makeCtl(addrs, *timeout)
+	defer ctl.close()
+
+	err = ctl.run(os.Stdout, flag.Args(), *jsonOut)
+	if err == errUsage {
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "raftctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("usage")
+
+// the nodes' addresses from the cluster file, indexed by id.
+func loadAddrs(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// 只需要nodes，其他字段是给raftnode的
+	var file struct {
+		Nodes []struct {
+			Id   int    `json:"id"`
+			Addr string `json:"addr"`
+		} `json:"nodes"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("cluster file: %w", err)
+	}
+	addrs := make([]string, len(file.Nodes))
+	for _, node := range file.Nodes {
+		if node.Id < 0 || node.Id >= len(addrs) || addrs[node.Id] != "" {
+			return nil, fmt.Errorf("cluster file: bad or duplicate node id %v", node.Id)
+		}
+		addrs[node.Id] = node.Addr
+	}
+	return addrs, nil
+}
+
+type ctl struct {
+	addrs   []string
+	conns   []*rpc_mock.TCPClient
+	clients []*admin.Client
+}
+
+func makeCtl(addrs []string, timeout time.Duration) *ctl {
+	c := &ctl{addrs: addrs}
+	for _, addr := range addrs {
+		conn := rpc_mock.MakeTCPClient(addr)
+		conn.SetTimeout(timeout)
+		c.conns = append(c.conns, conn)
+		c.clients = append(c.clients, admin.MakeClient(conn))
+	}
+	return c
+}
+
+func (c *ctl) close() {
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+}
+
+func (c *ctl) run(w io.Writer, args []string, jsonOut bool) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	if args[0] == "status" {
+		ids := make([]int, 0)
+		for _, arg := range args[1:] {
+			id, err := c.parseId(arg)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		if len(ids) == 0 {
+			for id := range c.addrs {
+				ids = append(ids, id)
+			}
+		}
+		return c.status(w, ids, jsonOut)
+	}
+
+	if len(args) != 2 {
+		return errUsage
+	}
+	id, err := c.parseId(args[1])
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "snapshot":
+		index, err := c.clients[id].Snapshot()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "node %v snapshot up to index %v\n", id, index)
+	case "transfer":
+		leader, err := c.leader()
+		if err != nil {
+			return err
+		}
+		if err := c.clients[leader].TransferLeadership(id); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "node %v handed leadership to node %v\n", leader, id)
+	case "add", "remove":
+		leader, err := c.leader()
+		if err != nil {
+			return err
+		}
+		var index int
+		if args[0] == "add" {
+			index, err = c.clients[leader].AddServer(id)
+		} else {
+			index, err = c.clients[leader].RemoveServer(id)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "node %v started the change at index %v\n", leader, index)
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+func (c *ctl) parseId(arg string) (int, error) {
+	id, err := strconv.Atoi(arg)
+	if err != nil || id < 0 || id >= len(c.addrs) {
+		return -1, fmt.Errorf("no node %q in the cluster file", arg)
+	}
+	return id, nil
+}
+
+// the node with the highest term among those that say they lead.
+func (c *ctl) leader() (int, error) {
+	leader, term := -1, -1
+	for id, client := range c.clients {
+		status, err := client.Status()
+		if err == nil && status.Role == "leader" && status.Term > term {
+			leader, term = id, status.Term
+		}
+	}
+	if leader == -1 {
+		return -1, errors.New("no node is leader")
+	}
+	return leader, nil
+}
+
+func (c *ctl) status(w io.Writer, ids []int, jsonOut bool) error {
+	statuses := make([]*raft.Status, len(ids))
+	for i, id := range ids {
+		if status, err := c.clients[id].Status(); err == nil {
+			statuses[i] = &status
+		}
+	}
+
+	if jsonOut {
+		// 连不上的node输出null
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(statuses)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "NODE\tADDR\tROLE\tTERM\tCOMMIT\tAPPLIED\tLAST LOG\tSNAPSHOT\tCONFIG\n")
+	for i, id := range ids {
+		status := statuses[i]
+		if status == nil {
+			fmt.Fprintf(tw, "%v\t%v\tunreachable\t\t\t\t\t\t\n", id, c.addrs[id])
+			continue
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v/%v\t%v/%v\t%v\n", id, c.addrs[id], status.Role,
+			status.Term, status.CommitIndex, status.LastApplied, status.LastLogIndex, status.LastLogTerm,
+			status.LastIncludedIndex, status.LastIncludedTerm, configString(status.Config))
+	}
+	tw.Flush()
+
+	for _, status := range statuses {
+		if status == nil || status.Progress == nil {
+			continue
+		}
+		fmt.Fprintf(w, "\nreplication from leader %v (term %v):\n", status.Id, status.Term)
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "PEER\tNEXT\tMATCH\tINFLIGHT\tPROBING\tLAST CONTACT\n")
+		peers := make([]int, 0, len(status.Progress))
+		for peer := range status.Progress {
+			peers = append(peers, peer)
+		}
+		sort.Ints(peers)
+		for _, peer := range peers {
+			p := status.Progress[peer]
+			contact := "never"
+			if !p.LastContact.IsZero() {
+				contact = time.Since(p.LastContact).Round(time.Millisecond).String() + " ago"
+			}
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n", peer, p.NextIndex, p.MatchIndex, p.Inflight, p.Probing, contact)
+		}
+		tw.Flush()
+	}
+	return nil
+}
+
+func configString(config raft.ConfigChange) string {
+	if len(config.OldServers) > 0 {
+		return fmt.Sprintf("%v => %v", config.OldServers, config.Servers)
+	}
+	return fmt.Sprint(config.Servers)
+}
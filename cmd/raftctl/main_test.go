@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"raft"
+	"raft/admin"
+	"raft/rpc_mock"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadAddrs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raftctl")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cluster.json")
+
+	ioutil.WriteFile(path, []byte(`{"nodes": [{"id": 1, "addr": "b:1"}, {"id": 0, "addr": "a:0"}], "data_dir": "x"}`), 0644)
+	addrs, err := loadAddrs(path)
+	if err != nil || len(addrs) != 2 || addrs[0] != "a:0" || addrs[1] != "b:1" {
+		t.Fatalf("loadAddrs() = %v %v", addrs, err)
+	}
+
+	ioutil.WriteFile(path, []byte(`{"nodes": [{"id": 0, "addr": "a:0"}, {"id": 0, "addr": "b:1"}]}`), 0644)
+	if _, err := loadAddrs(path); err == nil {
+		t.Fatalf("loadAddrs() accepted a duplicate id")
+	}
+}
+
+// n Rafts with an Admin each, served over TCP on localhost.
+func startCluster(t *testing.T, n int) ([]*raft.Raft, []string, func()) {
+	var cleanup []func()
+	srvs := make([]*rpc_mock.Server, n)
+	addrs := make([]string, n)
+	for i := 0; i < n; i++ {
+		srvs[i] = rpc_mock.MakeServer()
+		l, err := rpc_mock.Listen("localhost:0", srvs[i])
+		if err != nil {
+			t.Fatalf("Listen(): %v", err)
+		}
+		cleanup = append(cleanup, func() { l.Close() })
+		addrs[i] = l.Addr().String()
+	}
+
+	rafts := make([]*raft.Raft, n)
+	for i := 0; i < n; i++ {
+		peers := make([]raft.Transport, n)
+		for j := 0; j < n; j++ {
+			if j != i {
+				c := rpc_mock.MakeTCPClient(addrs[j])
+				cleanup = append(cleanup, func() { c.Close() })
+				peers[j] = c
+			}
+		}
+		applyCh := make(chan raft.ApplyMsg)
+		go func() {
+			for range applyCh {
+			}
+		}()
+		rf, err := raft.Make(peers, i, raft.MakePersister(), applyCh)
+		if err != nil {
+			t.Fatalf("Make(): %v", err)
+		}
+		rf.SetNoOp(true)
+		cleanup = append(cleanup, rf.Kill)
+		rafts[i] = rf
+		srvs[i].AddService(rpc_mock.MakeService(rf))
+		srvs[i].AddService(rpc_mock.MakeService(admin.MakeAdmin(rf, nil)))
+	}
+	return rafts, addrs, func() {
+		for i := len(cleanup) - 1; i >= 0; i-- {
+			cleanup[i]()
+		}
+	}
+}
+
+func TestRaftctl(t *testing.T) {
+	servers := 3
+	rafts, addrs, cleanup := startCluster(t, servers)
+	defer cleanup()
+	c := makeCtl(addrs, time.Second)
+	defer c.close()
+
+	var leader int
+	for iters := 0; ; iters++ {
+		var err error
+		if leader, err = c.leader(); err == nil {
+			break
+		}
+		if iters == 30 {
+			t.Fatalf("no leader")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	out := new(bytes.Buffer)
+	if err := c.run(out, []string{"status"}, false); err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if !strings.Contains(out.String(), "leader") || !strings.Contains(out.String(), "replication from leader") {
+		t.Fatalf("status doesn't show the leader:\n%v", out)
+	}
+
+	out.Reset()
+	if err := c.run(out, []string{"status", "0"}, true); err != nil {
+		t.Fatalf("status -json: %v", err)
+	}
+	var statuses []raft.Status
+	if err := json.Unmarshal(out.Bytes(), &statuses); err != nil || len(statuses) != 1 || statuses[0].Id != 0 {
+		t.Fatalf("status -json printed %v: %v", out, err)
+	}
+
+	if err := c.run(out, []string{"snapshot", "0"}, false); err != admin.ErrNoSnapshot {
+		t.Fatalf("snapshot returned %v, expected ErrNoSnapshot", err)
+	}
+	if err := c.run(out, []string{"add", "1"}, false); !errors.Is(err, raft.ErrBadServers) {
+		t.Fatalf("add of a member returned %v, expected ErrBadServers", err)
+	}
+	if err := c.run(out, []string{"transfer", "7"}, false); err == nil {
+		t.Fatalf("transfer to an unknown node succeeded")
+	}
+	if err := c.run(out, []string{"frobnicate", "1"}, false); err != errUsage {
+		t.Fatalf("unknown command returned %v, expected errUsage", err)
+	}
+
+	target := (leader + 1) % servers
+	if err := c.run(out, []string{"transfer", strconv.Itoa(target)}, false); err != nil {
+		t.Fatalf("transfer: %v", err)
+	}
+	for iters := 0; ; iters++ {
+		if _, isLeader := rafts[target].GetState(); isLeader {
+			break
+		}
+		if iters == 30 {
+			t.Fatalf("%v didn't take over", target)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// a killed Raft still answers, as shutdown.
+	rafts[leader].Kill()
+	out.Reset()
+	if err := c.run(out, []string{"status"}, false); err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if !strings.Contains(out.String(), "shutdown") {
+		t.Fatalf("status doesn't show the killed node:\n%v", out)
+	}
+}
@@ -0,0 +1,288 @@
+//
+// raftdump prints and checks the state a Raft server persisted in its
+// data directory, e.g. a node directory of cmd/raftnode, and can cut
+// damaged Logs back for disaster recovery. the server must be stopped.
+//
+//	raftdump dir                        hard state, snapshot, index ranges, term boundaries
+//	raftdump -entries dir               also every entry, -from and -to limit the range
+//	raftdump -json dir                  the same as JSON
+//	raftdump -truncate-after index dir  remove the entries after index
+//
+// the dump ends with the invariants the Logs break, if any, and raftdump
+// then exits with status 1. commands are decoded with raft.GobCodec,
+// kvraft's Op is registered, other types show as their size. a kvraft
+// snapshot is checked against the index Raft keeps for it.
+//
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"raft"
+	"raft/kvraft"
+	"text/tabwriter"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: raftdump [-json] [-entries] [-from index] [-to index] dir\n")
+	fmt.Fprintf(os.Stderr, "       raftdump -truncate-after index dir\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	jsonOut := flag.Bool("json", false, "print JSON")
+	entries := flag.Bool("entries", false, "print the entries")
+	from := flag.Int("from", 0, "print the entries from this index on")
+	to := flag.Int("to", -1, "print the entries up to this index, -1 for all")
+	truncateAfter := flag.Int("truncate-after", -1, "remove the entries after this index")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+	}
+	dir := flag.Arg(0)
+
+	if *truncateAfter >= 0 {
+		if err := truncate(os.Stdout, dir, *truncateAfter); err != nil {
+			fmt.Fprintf(os.Stderr, "raftdump: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	st, err := raft.ReadPersistedState(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "raftdump: %v\n", err)
+		os.Exit(1)
+	}
+	d := makeDump(st, *entries, *from, *to)
+	if *jsonOut {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(d)
+	} else {
+		err = d.print(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "raftdump: %v\n", err)
+		os.Exit(1)
+	}
+	if len(d.Problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+type termRange struct {
+	Term  int `json:"term"`
+	First int `json:"first"`
+	Last  int `json:"last"`
+}
+
+type entry struct {
+	Index   int    `json:"index"`
+	Term    int    `json:"term"`
+	Kind    string `json:"kind"` // command, noop, config or unknown
+	Command string `json:"command"`
+}
+
+type dump struct {
+	Format             string             `json:"format"`
+	CurrentTerm        int                `json:"current_term"`
+	VotedFor           int                `json:"voted_for"`
+	LastIncludedIndex  int                `json:"last_included_index"`
+	LastIncludedTerm   int                `json:"last_included_term"`
+	LastIncludedConfig *raft.ConfigChange `json:"last_included_config"`
+	SnapshotSize       int                `json:"snapshot_size"`
+	SnapshotIndex      int                `json:"snapshot_index"` // what the kvraft snapshot covers, -1 if it isn't one
+	FirstIndex         int                `json:"first_index"`    // > LastIndex if there are no entries
+	LastIndex          int                `json:"last_index"`
+	Terms              []termRange        `json:"terms"`
+	Configs            []entry            `json:"configs"` // the ConfigChange entries
+	Entries            []entry            `json:"entries,omitempty"`
+	Problems           []string           `json:"problems"`
+}
+
+// entries from from to to (-1 for the last) go into Entries if withEntries.
+func makeDump(st *raft.PersistedState, withEntries bool, from int, to int) *dump {
+	d := &dump{
+		Format:             st.Format,
+		CurrentTerm:        st.CurrentTerm,
+		VotedFor:           st.VotedFor,
+		LastIncludedIndex:  st.LastIncludedIndex,
+		LastIncludedTerm:   st.LastIncludedTerm,
+		LastIncludedConfig: st.LastIncludedConfig,
+		SnapshotSize:       len(st.Snapshot),
+		SnapshotIndex:      -1,
+		FirstIndex:         st.LastIncludedIndex + 1,
+		LastIndex:          st.LastIndex(),
+		Terms:              termRanges(st.Entries),
+		Configs:            make([]entry, 0),
+		Problems:           verify(st),
+	}
+	if len(st.Snapshot) > 0 {
+		if index, err := kvraft.SnapshotIndex(st.Snapshot); err == nil {
+			d.SnapshotIndex = index
+		}
+	}
+	if d.SnapshotIndex >= 0 && d.SnapshotIndex != st.LastIncludedIndex {
+		d.Problems = append(d.Problems, fmt.Sprintf("the snapshot covers up to %v, but Logs are compacted up to %v", d.SnapshotIndex, st.LastIncludedIndex))
+	}
+	for _, e := range st.Entries {
+		kind, command := describe(e.Command)
+		if kind == "config" {
+			d.Configs = append(d.Configs, entry{e.Index, e.Term, kind, command})
+		}
+		if withEntries && e.Index >= from && (to < 0 || e.Index <= to) {
+			d.Entries = append(d.Entries, entry{e.Index, e.Term, kind, command})
+		}
+	}
+	return d
+}
+
+// the runs of entries with the same term.
+func termRanges(entries []raft.LogEntry) []termRange {
+	ranges := make([]termRange, 0)
+	for _, e := range entries {
+		if n := len(ranges); n > 0 && ranges[n-1].Term == e.Term {
+			ranges[n-1].Last = e.Index
+			continue
+		}
+		ranges = append(ranges, termRange{Term: e.Term, First: e.Index, Last: e.Index})
+	}
+	return ranges
+}
+
+//
+// what Raft relies on: the entries follow the snapshot without gaps,
+// their terms never go down, and no term is newer than CurrentTerm.
+// the WAL's records skipping or repeating an index come first.
+//
+func verify(st *raft.PersistedState) []string {
+	problems := append(make([]string, 0), st.Problems...)
+	if st.LastIncludedIndex > 0 && len(st.Snapshot) == 0 {
+		problems = append(problems, fmt.Sprintf("Logs are compacted up to %v but there is no snapshot", st.LastIncludedIndex))
+	}
+	if st.LastIncludedTerm > st.CurrentTerm {
+		problems = append(problems, fmt.Sprintf("snapshot term %v is after the current term %v", st.LastIncludedTerm, st.CurrentTerm))
+	}
+	index, term := st.LastIncludedIndex, st.LastIncludedTerm
+	for _, e := range st.Entries {
+		if e.Index != index+1 {
+			problems = append(problems, fmt.Sprintf("entry %v follows entry %v", e.Index, index))
+		}
+		if e.Term < term {
+			problems = append(problems, fmt.Sprintf("entry %v has term %v, before term %v of entry %v", e.Index, e.Term, term, index))
+		}
+		if e.Term > st.CurrentTerm {
+			problems = append(problems, fmt.Sprintf("entry %v has term %v, after the current term %v", e.Index, e.Term, st.CurrentTerm))
+		}
+		index, term = e.Index, e.Term
+	}
+	return problems
+}
+
+func describe(command interface{}) (string, string) {
+	switch c := command.(type) {
+	case raft.NoOp:
+		return "noop", ""
+	case raft.ConfigChange:
+		return "config", configString(c)
+	case []byte:
+		if cmd, err := (raft.GobCodec{}).Unmarshal(c); err == nil {
+			return "command", fmt.Sprintf("%+v", cmd)
+		}
+		return "unknown", fmt.Sprintf("%v bytes", len(c))
+	}
+	return "unknown", fmt.Sprintf("%T", command)
+}
+
+func configString(config raft.ConfigChange) string {
+	if len(config.OldServers) > 0 {
+		return fmt.Sprintf("%v => %v", config.OldServers, config.Servers)
+	}
+	return fmt.Sprint(config.Servers)
+}
+
+func (d *dump) print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "format\t%v\n", d.Format)
+	fmt.Fprintf(tw, "term\t%v\n", d.CurrentTerm)
+	if d.VotedFor == raft.VoteNull {
+		fmt.Fprintf(tw, "voted for\tnobody\n")
+	} else {
+		fmt.Fprintf(tw, "voted for\t%v\n", d.VotedFor)
+	}
+	fmt.Fprintf(tw, "snapshot\tup to %v, term %v, %v bytes\n", d.LastIncludedIndex, d.LastIncludedTerm, d.SnapshotSize)
+	if d.SnapshotIndex >= 0 {
+		fmt.Fprintf(tw, "snapshot data\tkvraft, up to %v\n", d.SnapshotIndex)
+	} else if d.SnapshotSize > 0 {
+		fmt.Fprintf(tw, "snapshot data\tnot a kvraft snapshot\n")
+	}
+	if d.LastIncludedConfig != nil {
+		fmt.Fprintf(tw, "snapshot config\t%v\n", configString(*d.LastIncludedConfig))
+	}
+	if d.FirstIndex > d.LastIndex {
+		fmt.Fprintf(tw, "entries\tnone\n")
+	} else {
+		fmt.Fprintf(tw, "entries\t%v to %v\n", d.FirstIndex, d.LastIndex)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(d.Terms) > 0 {
+		fmt.Fprintf(w, "\nterms:\n")
+		tw = tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "TERM\tFIRST\tLAST\tENTRIES\n")
+		for _, r := range d.Terms {
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", r.Term, r.First, r.Last, r.Last-r.First+1)
+		}
+		tw.Flush()
+	}
+	if len(d.Configs) > 0 {
+		fmt.Fprintf(w, "\nconfiguration changes:\n")
+		printEntries(w, d.Configs)
+	}
+	if len(d.Entries) > 0 {
+		fmt.Fprintf(w, "\nentries:\n")
+		printEntries(w, d.Entries)
+	}
+
+	if len(d.Problems) == 0 {
+		fmt.Fprintf(w, "\nLogs OK\n")
+		return nil
+	}
+	fmt.Fprintf(w, "\n%v problems:\n", len(d.Problems))
+	for _, p := range d.Problems {
+		fmt.Fprintf(w, "  %v\n", p)
+	}
+	return nil
+}
+
+func printEntries(w io.Writer, entries []entry) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "INDEX\tTERM\tKIND\tCOMMAND\n")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", e.Index, e.Term, e.Kind, e.Command)
+	}
+	tw.Flush()
+}
+
+func truncate(w io.Writer, dir string, index int) error {
+	st, err := raft.ReadPersistedState(dir)
+	if err != nil {
+		return err
+	}
+	if index >= st.LastIndex() {
+		return fmt.Errorf("nothing after index %v, the last entry is %v", index, st.LastIndex())
+	}
+	if err := raft.TruncatePersistedState(dir, index); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "removed entries %v to %v\n", index+1, st.LastIndex())
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"raft"
+	"raft/kvraft"
+	"strings"
+	"testing"
+)
+
+// a WAL with a snapshot up to 2, then entries 3 to 8 in terms 2 and 4.
+func makeWAL(t *testing.T) string {
+	dir := t.TempDir()
+	wp, err := raft.MakeWALPersister(dir)
+	if err != nil {
+		t.Fatalf("MakeWALPersister(): %v", err)
+	}
+	defer wp.Close()
+	wp.SaveHardState(4, 0)
+	put, err := raft.GobCodec{}.Marshal(kvraft.Op{Type: kvraft.OpPut, Key: "k", Value: "v"})
+	if err != nil {
+		t.Fatalf("Marshal(): %v", err)
+	}
+	wp.AppendLogs([]raft.LogEntry{
+		{Term: 1, Index: 1, Command: put},
+		{Term: 2, Index: 2, Command: put},
+		{Term: 2, Index: 3, Command: put},
+		{Term: 2, Index: 4, Command: raft.ConfigChange{Servers: []int{0, 1, 2, 3}, OldServers: []int{0, 1, 2}}},
+		{Term: 4, Index: 5, Command: raft.NoOp{}},
+		{Term: 4, Index: 6, Command: put},
+		{Term: 4, Index: 7, Command: []byte("junk")},
+		{Term: 4, Index: 8, Command: put},
+	})
+	wp.CompactLogs(2, 2, raft.ConfigChange{Servers: []int{0, 1, 2}})
+	wp.SaveSnapshot(kvSnapshot(2))
+	return dir
+}
+
+// what a KVServer snapshots after applying index: lastApplied comes first.
+func kvSnapshot(index int) []byte {
+	w := new(bytes.Buffer)
+	e := gob.NewEncoder(w)
+	e.Encode(index)
+	e.Encode(map[string]string{"k": "v"})
+	return w.Bytes()
+}
+
+func TestDump(t *testing.T) {
+	dir := makeWAL(t)
+	st, err := raft.ReadPersistedState(dir)
+	if err != nil {
+		t.Fatalf("ReadPersistedState(): %v", err)
+	}
+	d := makeDump(st, true, 5, 7)
+	if d.FirstIndex != 3 || d.LastIndex != 8 || d.SnapshotIndex != 2 || len(d.Problems) != 0 {
+		t.Fatalf("dump %+v", d)
+	}
+	if len(d.Terms) != 2 || d.Terms[0] != (termRange{2, 3, 4}) || d.Terms[1] != (termRange{4, 5, 8}) {
+		t.Fatalf("terms %v", d.Terms)
+	}
+	if len(d.Configs) != 1 || d.Configs[0].Index != 4 || d.Configs[0].Command != "[0 1 2] => [0 1 2 3]" {
+		t.Fatalf("configs %v", d.Configs)
+	}
+	kinds := make([]string, 0)
+	for _, e := range d.Entries {
+		kinds = append(kinds, e.Kind)
+	}
+	if strings.Join(kinds, " ") != "noop command unknown" || !strings.Contains(d.Entries[1].Command, "Key:k") {
+		t.Fatalf("entries %v", d.Entries)
+	}
+
+	out := new(bytes.Buffer)
+	if err := d.print(out); err != nil {
+		t.Fatalf("print(): %v", err)
+	}
+	// tabwriter的padding不算
+	text := strings.Join(strings.Fields(out.String()), " ")
+	for _, s := range []string{"entries 3 to 8", "voted for 0", "snapshot config [0 1 2]", "snapshot data kvraft, up to 2", "4 5 8 4", "Logs OK"} {
+		if !strings.Contains(text, s) {
+			t.Fatalf("output doesn't contain %q:\n%v", s, out)
+		}
+	}
+
+	out.Reset()
+	json.NewEncoder(out).Encode(d)
+	var back dump
+	if err := json.Unmarshal(out.Bytes(), &back); err != nil || back.LastIndex != 8 || len(back.Entries) != 3 {
+		t.Fatalf("JSON %v: %v", out, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	st := &raft.PersistedState{
+		Format: raft.FormatFile,
+		LogState: raft.LogState{
+			CurrentTerm:       3,
+			LastIncludedIndex: 2,
+			LastIncludedTerm:  2,
+			Entries: []raft.LogEntry{
+				{Term: 2, Index: 3},
+				{Term: 1, Index: 4}, // term goes down
+				{Term: 2, Index: 6}, // gap
+				{Term: 5, Index: 7}, // after CurrentTerm
+			},
+		},
+	}
+	problems := verify(st)
+	if len(problems) != 4 {
+		t.Fatalf("problems %v, expected 4", problems)
+	}
+	for i, s := range []string{"no snapshot", "entry 4 has term 1", "entry 6 follows entry 4", "entry 7 has term 5"} {
+		if !strings.Contains(problems[i], s) {
+			t.Fatalf("problem %q, expected %q", problems[i], s)
+		}
+	}
+}
+
+func TestSnapshotIndex(t *testing.T) {
+	st, err := raft.ReadPersistedState(makeWAL(t))
+	if err != nil {
+		t.Fatalf("ReadPersistedState(): %v", err)
+	}
+	st.Snapshot = kvSnapshot(5)
+	d := makeDump(st, false, 0, -1)
+	if d.SnapshotIndex != 5 || len(d.Problems) != 1 || !strings.Contains(d.Problems[0], "snapshot covers up to 5") {
+		t.Fatalf("snapshot index %v, problems %v", d.SnapshotIndex, d.Problems)
+	}
+
+	// a service other than kvraft, nothing to check.
+	st.Snapshot = []byte("snapshot")
+	if d := makeDump(st, false, 0, -1); d.SnapshotIndex != -1 || len(d.Problems) != 0 {
+		t.Fatalf("snapshot index %v, problems %v", d.SnapshotIndex, d.Problems)
+	}
+}
+
+// records that skip or repeat an index across segments are problems to
+// report, not a reason to give up on the dump.
+func TestSegmentProblems(t *testing.T) {
+	dir := t.TempDir()
+	wp, err := raft.MakeWALPersister(dir)
+	if err != nil {
+		t.Fatalf("MakeWALPersister(): %v", err)
+	}
+	// every record goes into a segment of its own.
+	wp.SetSegmentSize(1)
+	wp.SaveHardState(1, 0)
+	for i := 1; i <= 4; i++ {
+		wp.AppendLogs([]raft.LogEntry{{Term: 1, Index: i}})
+	}
+	wp.Close()
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if len(segments) != 5 {
+		t.Fatalf("segments %v, expected 5", segments)
+	}
+
+	// entry 3 once more, after entry 4.
+	data, _ := ioutil.ReadFile(segments[3])
+	again := strings.Replace(segments[4], "4.log", "5.log", 1)
+	ioutil.WriteFile(again, data, 0644)
+	if _, err := raft.MakeWALPersister(dir); err == nil {
+		t.Fatalf("MakeWALPersister() accepted index 3 twice")
+	}
+	st, err := raft.ReadPersistedState(dir)
+	if err != nil {
+		t.Fatalf("ReadPersistedState(): %v", err)
+	}
+	d := makeDump(st, false, 0, -1)
+	if d.LastIndex != 4 || len(d.Problems) != 1 || !strings.Contains(d.Problems[0], filepath.Base(again)+" appends index 3 twice") {
+		t.Fatalf("last index %v, problems %v", d.LastIndex, d.Problems)
+	}
+
+	// entry 2 is gone, the ones after it are left out.
+	os.Remove(segments[2])
+	if st, err = raft.ReadPersistedState(dir); err != nil {
+		t.Fatalf("ReadPersistedState(): %v", err)
+	}
+	d = makeDump(st, false, 0, -1)
+	if d.LastIndex != 1 || len(d.Problems) != 1 || !strings.Contains(d.Problems[0], filepath.Base(segments[3])+" is missing entries 2 to 2") {
+		t.Fatalf("last index %v, problems %v", d.LastIndex, d.Problems)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	dir := makeWAL(t)
+	out := new(bytes.Buffer)
+	if err := truncate(out, dir, 1); err == nil {
+		t.Fatalf("truncated into the snapshot")
+	}
+	if err := truncate(out, dir, 8); err == nil {
+		t.Fatalf("truncate after the last entry succeeded")
+	}
+	if err := truncate(out, dir, 5); err != nil {
+		t.Fatalf("truncate(): %v", err)
+	}
+	if !strings.Contains(out.String(), "removed entries 6 to 8") {
+		t.Fatalf("output %q", out)
+	}
+	st, err := raft.ReadPersistedState(dir)
+	if err != nil || st.LastIndex() != 5 || len(verify(st)) != 0 {
+		t.Fatalf("after truncate: %v %v", st, err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"raft"
+	"strconv"
+	"time"
+)
+
+//
+// the cluster file, the same for every node. e.g.
+//
+//	{
+//	  "nodes": [
+//	    {"id": 0, "addr": "localhost:7000"},
+//	    {"id": 1, "addr": "localhost:7001"},
+//	    {"id": 2, "addr": "localhost:7002"}
+//	  ],
+//	  "data_dir": "/tmp/raftnode",
+//	  "storage": "wal",
+//	  "max_raft_state": 1048576,
+//	  "rpc_timeout": "500ms",
+//	  "election_timeout_min": "300ms",
+//	  "election_timeout_max": "400ms",
+//	  "heartbeat_interval": "50ms",
+//	  "pre_vote": true,
+//	  "check_quorum": true
+//	}
+//
+type ClusterConfig struct {
+	Nodes   []NodeConfig `json:"nodes"`
+	DataDir string       `json:"data_dir"` // node i keeps its state in DataDir/i
+	// "wal" (the default) or "file", see raft.WALPersister and raft.FilePersister.
+	Storage string `json:"storage"`
+	// ask Raft for a snapshot once its state grows this big, 0 or -1 means never.
+	MaxRaftState int `json:"max_raft_state"`
+	// how long a node waits for another one to answer an RPC, default 500ms.
+	RPCTimeout Duration `json:"rpc_timeout"`
+	// Raft's timing, see raft.Config, raft.DefaultConfig() for what isn't
+	// set. election_timeout_max defaults to a third above election_timeout_min.
+	ElectionTimeoutMin Duration `json:"election_timeout_min"`
+	ElectionTimeoutMax Duration `json:"election_timeout_max"`
+	HeartbeatInterval  Duration `json:"heartbeat_interval"`
+	PreVote            bool     `json:"pre_vote"`
+	CheckQuorum        bool     `json:"check_quorum"`
+}
+
+type NodeConfig struct {
+	Id   int    `json:"id"`   // the node's index into Raft's peers[]
+	Addr string `json:"addr"` // host:port it listens on
+}
+
+const (
+	StorageWAL  = "wal"
+	StorageFile = "file"
+
+	defaultRPCTimeout = 500 * time.Millisecond
+)
+
+// a time.Duration written as "500ms" in the cluster file.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"500ms\": %s", data)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func loadConfig(path string) (*ClusterConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+func parseConfig(data []byte) (*ClusterConfig, error) {
+	cfg := &ClusterConfig{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("cluster file: %w", err)
+	}
+	if cfg.Storage == "" {
+		cfg.Storage = StorageWAL
+	}
+	if cfg.RPCTimeout == 0 {
+		cfg.RPCTimeout = Duration(defaultRPCTimeout)
+	}
+	if cfg.MaxRaftState == 0 {
+		cfg.MaxRaftState = -1
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("cluster file: %w", err)
+	}
+	return cfg, nil
+}
+
+func (cfg *ClusterConfig) validate() error {
+	if len(cfg.Nodes) == 0 {
+		return errors.New("no nodes")
+	}
+	// Raft用id做peers[]的下标
+	seen := make(map[int]bool)
+	for _, node := range cfg.Nodes {
+		if node.Id < 0 || node.Id >= len(cfg.Nodes) {
+			return fmt.Errorf("node id %v out of range, ids must be 0..%v", node.Id, len(cfg.Nodes)-1)
+		}
+		if seen[node.Id] {
+			return fmt.Errorf("duplicate node id %v", node.Id)
+		}
+		seen[node.Id] = true
+		if node.Addr == "" {
+			return fmt.Errorf("node %v has no addr", node.Id)
+		}
+	}
+	if cfg.DataDir == "" {
+		return errors.New("no data_dir")
+	}
+	if cfg.Storage != StorageWAL && cfg.Storage != StorageFile {
+		return fmt.Errorf("unknown storage %q, expected %q or %q", cfg.Storage, StorageWAL, StorageFile)
+	}
+	if cfg.RPCTimeout < 0 {
+		return fmt.Errorf("negative rpc_timeout %v", time.Duration(cfg.RPCTimeout))
+	}
+	return cfg.raftConfig().Validate()
+}
+
+// the raft.Config of every node.
+func (cfg *ClusterConfig) raftConfig() raft.Config {
+	conf := raft.DefaultConfig()
+	if cfg.ElectionTimeoutMin != 0 {
+		conf.ElectionTimeoutMin = time.Duration(cfg.ElectionTimeoutMin)
+		conf.ElectionTimeoutMax = conf.ElectionTimeoutMin * 4 / 3
+	}
+	if cfg.ElectionTimeoutMax != 0 {
+		conf.ElectionTimeoutMax = time.Duration(cfg.ElectionTimeoutMax)
+	}
+	if cfg.HeartbeatInterval != 0 {
+		conf.HeartbeatInterval = time.Duration(cfg.HeartbeatInterval)
+	}
+	conf.PreVote = cfg.PreVote
+	conf.CheckQuorum = cfg.CheckQuorum
+	return conf
+}
+
+// the nodes' addresses, indexed by id.
+func (cfg *ClusterConfig) addrs() []string {
+	addrs := make([]string, len(cfg.Nodes))
+	for _, node := range cfg.Nodes {
+		addrs[node.Id] = node.Addr
+	}
+	return addrs
+}
+
+func (cfg *ClusterConfig) nodeDir(id int) string {
+	return filepath.Join(cfg.DataDir, strconv.Itoa(id))
+}
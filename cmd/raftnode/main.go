@@ -0,0 +1,144 @@
+//
+// raftnode runs one server of the replicated key/value service
+// (package kvraft) as its own process. the nodes find each other
+// through a cluster file, see ClusterConfig, and talk over TCP.
+//
+//	raftnode -config cluster.json -id 0         run node 0 until SIGINT/SIGTERM
+//	raftnode -config cluster.json -id 3 -join   run node 3, which joins through raftctl add 3
+//	raftnode -config cluster.json get key       print the value of key
+//	raftnode -config cluster.json put key value
+//	raftnode -config cluster.json append key value
+//
+// a three node cluster on one machine is three raftnode processes
+// with the same cluster file and ids 0, 1 and 2.
+//
+// a node that starts without state is a member of a configuration of
+// all the nodes in the cluster file, unless it starts with -join: then
+// it has none, and doesn't start elections until the leader has
+// replicated the configuration that raftctl add puts it in. use it for
+// a node that isn't in the cluster's configuration, e.g. one that was
+// removed with raftctl remove and lost its data directory. -join makes
+// no difference to a node that already has state.
+//
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"raft"
+	"raft/kvraft"
+	"raft/rpc_mock"
+	"syscall"
+	"time"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: raftnode -config cluster.json -id n [-join]\n")
+	fmt.Fprintf(os.Stderr, "       raftnode -config cluster.json get key | put key value | append key value\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	configPath := flag.String("config", "cluster.json", "the cluster file")
+	id := flag.Int("id", -1, "run the node with this id")
+	join := flag.Bool("join", false, "start with an empty configuration, to join through raftctl add")
+	timeout := flag.Duration("timeout", 10*time.Second, "give up on a get, put or append after this long")
+	flag.Usage = usage
+	flag.Parse()
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "raftnode: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *id >= 0 {
+		if flag.NArg() != 0 {
+			usage()
+		}
+		if err := serve(cfg, *id, *join); err != nil {
+			fmt.Fprintf(os.Stderr, "raftnode: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	value, err := clientCommand(cfg, flag.Args(), *timeout)
+	if err == errUsage {
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "raftnode: %v\n", err)
+		os.Exit(1)
+	}
+	if value != nil {
+		fmt.Println(*value)
+	}
+}
+
+func serve(cfg *ClusterConfig, id int, joining bool) error {
+	n, err := startNode(cfg, id, joining)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("raftnode %v listening on %v, data in %v\n", id, n.listener.Addr(), cfg.nodeDir(id))
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+	n.stop()
+	return nil
+}
+
+var errUsage = errors.New("usage")
+
+//
+// run a get, put or append with a Clerk that talks to all nodes.
+// returns the value for a get, nil otherwise.
+//
+func clientCommand(cfg *ClusterConfig, args []string, timeout time.Duration) (*string, error) {
+	if len(args) == 0 {
+		return nil, errUsage
+	}
+	switch {
+	case args[0] == "get" && len(args) == 2:
+	case (args[0] == "put" || args[0] == "append") && len(args) == 3:
+	default:
+		return nil, errUsage
+	}
+
+	ends := make([]raft.Transport, 0, len(cfg.Nodes))
+	for _, addr := range cfg.addrs() {
+		c := rpc_mock.MakeTCPClient(addr)
+		c.SetTimeout(time.Duration(cfg.RPCTimeout))
+		defer c.Close()
+		ends = append(ends, c)
+	}
+	ck := kvraft.MakeClerk(ends)
+
+	// Clerk会一直重试，集群不可用时靠timeout退出
+	result := make(chan *string, 1)
+	go func() {
+		switch args[0] {
+		case "get":
+			value := ck.Get(args[1])
+			result <- &value
+		case "put":
+			ck.Put(args[1], args[2])
+			result <- nil
+		case "append":
+			ck.Append(args[1], args[2])
+			result <- nil
+		}
+	}()
+	select {
+	case value := <-result:
+		return value, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("%v: no answer from the cluster within %v", args[0], timeout)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"raft"
+	"raft/admin"
+	"raft/kvraft"
+	"raft/rpc_mock"
+	"time"
+)
+
+//
+// one server of the cluster: a KVServer and its Raft, reachable by
+// the other nodes and by clients at its addr. cmd/raftctl operates
+// it through the admin.Admin service on the same addr.
+//
+type node struct {
+	id       int
+	kv       *kvraft.KVServer
+	listener *rpc_mock.TCPListener
+	peers    []*rpc_mock.TCPClient
+}
+
+//
+// start node id. a joining node starts with an empty configuration
+// instead of all the nodes in cfg, see raft.MakeJoining().
+//
+func startNode(cfg *ClusterConfig, id int, joining bool) (*node, error) {
+	if id < 0 || id >= len(cfg.Nodes) {
+		return nil, fmt.Errorf("no node %v in the cluster file", id)
+	}
+	addrs := cfg.addrs()
+
+	var persister raft.Persister
+	var err error
+	if cfg.Storage == StorageFile {
+		persister, err = raft.MakeFilePersister(cfg.nodeDir(id))
+	} else {
+		persister, err = raft.MakeWALPersister(cfg.nodeDir(id))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open storage: %w", err)
+	}
+
+	n := &node{id: id}
+	ends := make([]raft.Transport, len(addrs))
+	for i, addr := range addrs {
+		if i == id {
+			continue
+		}
+		c := rpc_mock.MakeTCPClient(addr)
+		c.SetTimeout(time.Duration(cfg.RPCTimeout))
+		n.peers = append(n.peers, c)
+		ends[i] = c
+	}
+
+	if joining {
+		n.kv, err = kvraft.StartJoiningKVServerWithConfig(ends, id, persister, cfg.MaxRaftState, cfg.raftConfig())
+	} else {
+		n.kv, err = kvraft.StartKVServerWithConfig(ends, id, persister, cfg.MaxRaftState, cfg.raftConfig())
+	}
+	if err != nil {
+		n.closePeers()
+		return nil, err
+	}
+
+	srv := rpc_mock.MakeServer()
+	srv.AddService(rpc_mock.MakeService(n.kv))
+	srv.AddService(rpc_mock.MakeService(n.kv.Raft()))
+	srv.AddService(rpc_mock.MakeService(admin.MakeAdmin(n.kv.Raft(), n.kv.Snapshot)))
+	n.listener, err = rpc_mock.Listen(addrs[id], srv)
+	if err != nil {
+		n.kv.Kill()
+		n.closePeers()
+		return nil, err
+	}
+	return n, nil
+}
+
+// stop serving and shut the KVServer and its Raft down.
+func (n *node) stop() {
+	n.listener.Close()
+	n.kv.Kill()
+	n.closePeers()
+}
+
+func (n *node) closePeers() {
+	for _, c := range n.peers {
+		c.Close()
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := parseConfig([]byte(`{
+		"nodes": [{"id": 1, "addr": "localhost:7001"}, {"id": 0, "addr": "localhost:7000"}],
+		"data_dir": "/tmp/raftnode",
+		"rpc_timeout": "200ms",
+		"election_timeout_min": "600ms",
+		"heartbeat_interval": "100ms",
+		"pre_vote": true
+	}`))
+	if err != nil {
+		t.Fatalf("parseConfig(): %v", err)
+	}
+	if addrs := cfg.addrs(); addrs[0] != "localhost:7000" || addrs[1] != "localhost:7001" {
+		t.Fatalf("addrs() = %v", addrs)
+	}
+	if cfg.Storage != StorageWAL || cfg.MaxRaftState != -1 || time.Duration(cfg.RPCTimeout) != 200*time.Millisecond || !cfg.PreVote {
+		t.Fatalf("wrong config %+v", cfg)
+	}
+	conf := cfg.raftConfig()
+	if conf.ElectionTimeoutMin != 600*time.Millisecond || conf.ElectionTimeoutMax != 800*time.Millisecond ||
+		conf.HeartbeatInterval != 100*time.Millisecond || !conf.PreVote || conf.CheckQuorum {
+		t.Fatalf("wrong raft.Config %+v", conf)
+	}
+
+	bad := map[string]string{
+		`{"nodes": [], "data_dir": "d"}`:                                                      "no nodes",
+		`{"nodes": [{"id": 1, "addr": "a"}], "data_dir": "d"}`:                                "out of range",
+		`{"nodes": [{"id": 0, "addr": "a"}, {"id": 0, "addr": "b"}], "data_dir": "d"}`:        "duplicate",
+		`{"nodes": [{"id": 0}], "data_dir": "d"}`:                                             "no addr",
+		`{"nodes": [{"id": 0, "addr": "a"}]}`:                                                 "no data_dir",
+		`{"nodes": [{"id": 0, "addr": "a"}], "data_dir": "d", "storage": "tape"}`:             "unknown storage",
+		`{"nodes": [{"id": 0, "addr": "a"}], "data_dir": "d", "rpc_timeout": 5}`:              "duration",
+		`{"nodes": [{"id": 0, "addr": "a"}], "data_dir": "d", "rpc_timeout": "soon"}`:         "duration",
+		`{"nodes": [{"id": 0, "addr": "a"}], "data_dir": "d", "heartbeat_interval": "200ms"}`: "HeartbeatInterval",
+	}
+	for data, msg := range bad {
+		if _, err := parseConfig([]byte(data)); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("parseConfig(%v) returned %v, expected an error about %q", data, err, msg)
+		}
+	}
+}
+
+// a cluster file for n nodes on free localhost ports.
+func makeTestConfig(t *testing.T, n int) *ClusterConfig {
+	dir, err := ioutil.TempDir("", "raftnode")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	cfg := &ClusterConfig{
+		DataDir:      dir,
+		Storage:      StorageWAL,
+		MaxRaftState: 1000,
+		RPCTimeout:   Duration(defaultRPCTimeout),
+	}
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("Listen(): %v", err)
+		}
+		cfg.Nodes = append(cfg.Nodes, NodeConfig{Id: i, Addr: l.Addr().String()})
+		l.Close()
+	}
+	return cfg
+}
+
+func startNodes(t *testing.T, cfg *ClusterConfig) []*node {
+	nodes := make([]*node, len(cfg.Nodes))
+	for i := range nodes {
+		n, err := startNode(cfg, i, false)
+		if err != nil {
+			t.Fatalf("startNode(%v): %v", i, err)
+		}
+		nodes[i] = n
+	}
+	return nodes
+}
+
+func TestCluster(t *testing.T) {
+	cfg := makeTestConfig(t, 3)
+	defer os.RemoveAll(cfg.DataDir)
+	nodes := startNodes(t, cfg)
+
+	for i := 0; i < 20; i++ {
+		if _, err := clientCommand(cfg, []string{"append", "k", fmt.Sprintf("x%v ", i)}, 10*time.Second); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	expected := ""
+	for i := 0; i < 20; i++ {
+		expected += fmt.Sprintf("x%v ", i)
+	}
+
+	// a node goes down, the others keep serving.
+	nodes[0].stop()
+	if _, err := clientCommand(cfg, []string{"put", "a", "b"}, 10*time.Second); err != nil {
+		t.Fatalf("put with node 0 down: %v", err)
+	}
+
+	// everything survives restarting the whole cluster.
+	for _, n := range nodes[1:] {
+		n.stop()
+	}
+	nodes = startNodes(t, cfg)
+	defer func() {
+		for _, n := range nodes {
+			n.stop()
+		}
+	}()
+	if value, err := clientCommand(cfg, []string{"get", "k"}, 10*time.Second); err != nil || *value != expected {
+		t.Fatalf("get k after restart: %v %v, expected %q", value, err, expected)
+	}
+	if value, err := clientCommand(cfg, []string{"get", "a"}, 10*time.Second); err != nil || *value != "b" {
+		t.Fatalf("get a after restart: %v %v, expected \"b\"", value, err)
+	}
+
+	if _, err := clientCommand(cfg, []string{"get"}, time.Second); err != errUsage {
+		t.Fatalf("get without a key returned %v, expected errUsage", err)
+	}
+}
+
+// the node that says it leads, waiting for one if there is none yet.
+func waitLeader(t *testing.T, nodes []*node) *node {
+	for i := 0; i < 50; i++ {
+		for _, n := range nodes {
+			if n != nil && n.kv.Raft().Status().Role == "leader" {
+				return n
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("no leader")
+	return nil
+}
+
+// wait until f is true, for up to 10 seconds.
+func waitFor(t *testing.T, what string, f func() bool) {
+	for i := 0; i < 100; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %v", what)
+}
+
+// a node that lost its data comes back with -join, and is a voting
+// member again once it's added.
+func TestJoin(t *testing.T) {
+	cfg := makeTestConfig(t, 3)
+	defer os.RemoveAll(cfg.DataDir)
+	nodes := startNodes(t, cfg)
+	defer func() {
+		for _, n := range nodes {
+			if n != nil {
+				n.stop()
+			}
+		}
+	}()
+
+	if _, err := clientCommand(cfg, []string{"put", "a", "1"}, 10*time.Second); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	leader := waitLeader(t, nodes)
+	id := (leader.id + 1) % len(nodes)
+	index, _, err := leader.kv.Raft().RemoveServer(id)
+	if err != nil {
+		t.Fatalf("RemoveServer(%v): %v", id, err)
+	}
+	waitFor(t, "the removal to commit", func() bool {
+		return leader.kv.Raft().Status().CommitIndex >= index
+	})
+	nodes[id].stop()
+	nodes[id] = nil
+	os.RemoveAll(cfg.nodeDir(id))
+
+	n, err := startNode(cfg, id, true)
+	if err != nil {
+		t.Fatalf("startNode(%v) joining: %v", id, err)
+	}
+	nodes[id] = n
+	if status := n.kv.Raft().Status(); len(status.Config.Servers) != 0 {
+		t.Fatalf("joining node starts with configuration %v", status.Config.Servers)
+	}
+	if _, err := clientCommand(cfg, []string{"put", "b", "2"}, 10*time.Second); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if _, _, err := leader.kv.Raft().AddServer(id); err != nil {
+		t.Fatalf("AddServer(%v): %v", id, err)
+	}
+	waitFor(t, "the joining node to catch up", func() bool {
+		status := n.kv.Raft().Status()
+		return len(status.Config.Servers) == 3 && status.LastApplied >= leader.kv.Raft().Status().CommitIndex
+	})
+
+	// the old leader goes down, the others need the joined node's vote.
+	leader.stop()
+	nodes[leader.id] = nil
+	if value, err := clientCommand(cfg, []string{"get", "b"}, 10*time.Second); err != nil || *value != "2" {
+		t.Fatalf("get b without the old leader: %v %v, expected \"2\"", value, err)
+	}
+}
@@ -0,0 +1,89 @@
+package raft
+
+//
+// how Raft turns the commands passed to Start() into the bytes it
+// keeps in its Logs, persists, and sends to other servers, and back
+// into the Command of an ApplyMsg. every server of a cluster must use
+// the same Codec, also across restarts. see SetCodec().
+//
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+type Codec interface {
+	Marshal(command interface{}) ([]byte, error)
+	Unmarshal(data []byte) (interface{}, error)
+}
+
+//
+// the default. every command type other than Go's basic
+// types must be registered with gob.Register().
+//
+type GobCodec struct{}
+
+func (GobCodec) Marshal(command interface{}) ([]byte, error) {
+	w := new(bytes.Buffer)
+	// 传指针，gob才会把具体类型也编码进去
+	if err := gob.NewEncoder(w).Encode(&command); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte) (interface{}, error) {
+	var command interface{}
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&command); err != nil {
+		return nil, err
+	}
+	return command, nil
+}
+
+//
+// commands are JSON. if New is set, it returns a pointer to a new
+// value of the command type, which Unmarshal decodes into and returns
+// the value it points to. otherwise commands come back as what
+// encoding/json makes of an interface{}, e.g. numbers are float64.
+//
+type JSONCodec struct {
+	New func() interface{}
+}
+
+func (c JSONCodec) Marshal(command interface{}) ([]byte, error) {
+	return json.Marshal(command)
+}
+
+func (c JSONCodec) Unmarshal(data []byte) (interface{}, error) {
+	if c.New == nil {
+		var command interface{}
+		err := json.Unmarshal(data, &command)
+		return command, err
+	}
+	ptr := c.New()
+	if err := json.Unmarshal(data, ptr); err != nil {
+		return nil, err
+	}
+	return reflect.ValueOf(ptr).Elem().Interface(), nil
+}
+
+//
+// commands are opaque []byte payloads, stored as they are.
+//
+type RawCodec struct{}
+
+func (RawCodec) Marshal(command interface{}) ([]byte, error) {
+	data, ok := command.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("RawCodec: command is %T, not []byte", command)
+	}
+	// caller可能之后会修改data
+	return append([]byte(nil), data...), nil
+}
+
+func (RawCodec) Unmarshal(data []byte) (interface{}, error) {
+	return data, nil
+}
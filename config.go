@@ -9,12 +9,16 @@ package raft
 //
 
 import (
+	"bytes"
 	crand "crypto/rand"
 	"encoding/base64"
+	"encoding/gob"
 	"fmt"
 	"log"
+	"path/filepath"
 	"raft/rpc_mock"
 	"runtime"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -30,21 +34,49 @@ func randString(n int) string {
 
 type config struct {
 	mu        sync.Mutex
-	t         *testing.T
+	t         testing.TB
 	net       *rpc_mock.Network
 	n         int
 	done      int32 // tell internal threads to die
 	rafts     []*Raft
 	applyErr  []string // from apply channel readers
 	connected []bool   // whether each server is on the net
-	saved     []*Persister
+	saved     []Persister
 	endnames  [][]string    // the port file names each sends to
 	logs      []map[int]int // copy of each server's committed entries
+	joining   []bool        // whether each server was added at runtime with addServer
+	snapshotInterval int // ask Raft to snapshot every snapshotInterval entries, 0 means never
+	persistDir       string        // if set, server i persists to files in persistDir/i
+	wal              bool          // with persistDir, use a WALPersister instead of a FilePersister
+	applyDelay       time.Duration // how long the applyCh readers take for each message
+	raftConfig       Config        // what servers are made with, setPreVote() etc. change it
 }
 
+// what cfg.logs records for a committed ConfigChange entry,
+// commands submitted by the tests are never negative.
+const configChangeCmd = -1
+
+// what cfg.logs records for a committed no-op entry.
+const noOpCmd = -2
+
 var numCpuOnce sync.Once
 
-func makeConfig(t *testing.T, n int, unreliable bool) *config {
+func makeConfig(t testing.TB, n int, unreliable bool) *config {
+	return makeConfigDir(t, n, unreliable, "", false)
+}
+
+// like makeConfig, but each server keeps its state in a FilePersister
+// under dir, and a restarted server reads it back from disk.
+func makeFileConfig(t testing.TB, n int, unreliable bool, dir string) *config {
+	return makeConfigDir(t, n, unreliable, dir, false)
+}
+
+// like makeFileConfig, but with a WALPersister.
+func makeWALConfig(t testing.TB, n int, unreliable bool, dir string) *config {
+	return makeConfigDir(t, n, unreliable, dir, true)
+}
+
+func makeConfigDir(t testing.TB, n int, unreliable bool, persistDir string, wal bool) *config {
 	numCpuOnce.Do(func() {
 		if runtime.NumCPU() < 2 {
 			fmt.Printf("warning: only one CPU, which may conceal locking bugs\n")
@@ -58,9 +90,13 @@ func makeConfig(t *testing.T, n int, unreliable bool) *config {
 	cfg.applyErr = make([]string, cfg.n)
 	cfg.rafts = make([]*Raft, cfg.n)
 	cfg.connected = make([]bool, cfg.n)
-	cfg.saved = make([]*Persister, cfg.n)
+	cfg.saved = make([]Persister, cfg.n)
 	cfg.endnames = make([][]string, cfg.n)
 	cfg.logs = make([]map[int]int, cfg.n)
+	cfg.joining = make([]bool, cfg.n)
+	cfg.persistDir = persistDir
+	cfg.wal = wal
+	cfg.raftConfig = DefaultConfig()
 
 	cfg.setUnreliable(unreliable)
 
@@ -88,14 +124,8 @@ func (cfg *config) crash1(i int) {
 	cfg.mu.Lock()
 	defer cfg.mu.Unlock()
 
-	// a fresh persister, in case old instance
-	// continues to update the Persister.
-	// but copy old persister's content so that we always
-	// pass Make() the last persisted state.
-	if cfg.saved[i] != nil {
-		cfg.saved[i] = cfg.saved[i].Copy()
-	}
-
+	// Kill() returns once the old instance has stopped, it can't
+	// update the Persister afterwards.
 	rf := cfg.rafts[i]
 	if rf != nil {
 		cfg.mu.Unlock()
@@ -103,11 +133,40 @@ func (cfg *config) crash1(i int) {
 		cfg.mu.Lock()
 		cfg.rafts[i] = nil
 	}
+}
+
+// the snapshot the tester hands to Raft is just the
+// committed values of server i up to and including index.
+func (cfg *config) makeSnapshot(i int, index int) []byte {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
 
-	if cfg.saved[i] != nil {
-		raftLog := cfg.saved[i].ReadRaftState()
-		cfg.saved[i] = &Persister{}
-		cfg.saved[i].SaveRaftState(raftLog)
+	xlog := make([]int, index+1)
+	for j := 1; j <= index; j++ {
+		xlog[j] = cfg.logs[i][j]
+	}
+	w := new(bytes.Buffer)
+	e := gob.NewEncoder(w)
+	e.Encode(index)
+	e.Encode(xlog)
+	return w.Bytes()
+}
+
+// restore server i's committed values from a snapshot.
+// caller must hold cfg.mu.
+func (cfg *config) ingestSnapshot(i int, snapshot []byte) {
+	if snapshot == nil || len(snapshot) < 1 {
+		return
+	}
+	var index int
+	var xlog []int
+	r := bytes.NewBuffer(snapshot)
+	d := gob.NewDecoder(r)
+	if d.Decode(&index) != nil || d.Decode(&xlog) != nil {
+		log.Fatalf("snapshot decode error\n")
+	}
+	for j := 1; j <= index; j++ {
+		cfg.logs[i][j] = xlog[j]
 	}
 }
 
@@ -129,7 +188,7 @@ func (cfg *config) start1(i int) {
 	}
 
 	// a fresh set of ClientEnds.
-	ends := make([]*rpc_mock.ClientEnd, cfg.n)
+	ends := make([]Transport, cfg.n)
 	for j := 0; j < cfg.n; j++ {
 		ends[j] = cfg.net.MakeEnd(cfg.endnames[i][j])
 		cfg.net.Connect(cfg.endnames[i][j], j)
@@ -141,11 +200,25 @@ func (cfg *config) start1(i int) {
 	// new instance's persisted state.
 	// but copy old persister's content so that we always
 	// pass Make() the last persisted state.
-	if cfg.saved[i] != nil {
+	if cfg.persistDir != "" {
+		dir := filepath.Join(cfg.persistDir, strconv.Itoa(i))
+		var ps Persister
+		var err error
+		if cfg.wal {
+			ps, err = MakeWALPersister(dir)
+		} else {
+			ps, err = MakeFilePersister(dir)
+		}
+		if err != nil {
+			cfg.t.Fatalf("make persister in %v: %v", dir, err)
+		}
+		cfg.saved[i] = ps
+	} else if cfg.saved[i] != nil {
 		cfg.saved[i] = cfg.saved[i].Copy()
 	} else {
 		cfg.saved[i] = MakePersister()
 	}
+	cfg.ingestSnapshot(i, cfg.saved[i].ReadSnapshot())
 
 	cfg.mu.Unlock()
 
@@ -154,8 +227,27 @@ func (cfg *config) start1(i int) {
 	go func() {
 		for m := range applyCh {
 			errMsg := ""
+			cfg.mu.Lock()
+			applyDelay := cfg.applyDelay
+			cfg.mu.Unlock()
+			if applyDelay > 0 {
+				// a slow service
+				time.Sleep(applyDelay)
+			}
 			if m.UseSnapshot {
-				// ignore the snapshot
+				// the leader installed a snapshot, replace everything
+				// this server has applied up to m.Index.
+				cfg.mu.Lock()
+				cfg.ingestSnapshot(i, m.Snapshot)
+				cfg.mu.Unlock()
+			} else if _, ok := (m.Command).(ConfigChange); ok {
+				cfg.mu.Lock()
+				cfg.logs[i][m.Index] = configChangeCmd
+				cfg.mu.Unlock()
+			} else if m.NoOp {
+				cfg.mu.Lock()
+				cfg.logs[i][m.Index] = noOpCmd
+				cfg.mu.Unlock()
 			} else if v, ok := (m.Command).(int); ok {
 				cfg.mu.Lock()
 				for j := 0; j < len(cfg.logs); j++ {
@@ -168,11 +260,21 @@ func (cfg *config) start1(i int) {
 				_, prevOk := cfg.logs[i][m.Index-1]
 				// fmt.Printf("i:%v index:%v v:%v\n", i, m.Index, v)
 				cfg.logs[i][m.Index] = v
+				snapshotInterval := cfg.snapshotInterval
+				rf := cfg.rafts[i]
 				cfg.mu.Unlock()
 
 				if m.Index > 1 && prevOk == false {
 					errMsg = fmt.Sprintf("server %v apply out of order %v", i, m.Index)
 				}
+
+				if errMsg == "" && rf != nil && snapshotInterval > 0 &&
+					m.Index%snapshotInterval == 0 && m.Index > snapshotInterval {
+					// keep the last snapshotInterval entries in the Logs, so that
+					// a follower that is slightly behind can still catch up.
+					index := m.Index - snapshotInterval
+					rf.Snapshot(index, cfg.makeSnapshot(i, index))
+				}
 			} else {
 				errMsg = fmt.Sprintf("committed command %v is not an int", m.Command)
 			}
@@ -186,7 +288,19 @@ func (cfg *config) start1(i int) {
 		}
 	}()
 
-	rf := Make(ends, i, cfg.saved[i], applyCh)
+	cfg.mu.Lock()
+	conf := cfg.raftConfig
+	cfg.mu.Unlock()
+	var rf *Raft
+	var err error
+	if cfg.joining[i] {
+		rf, err = MakeJoiningWithConfig(ends, i, cfg.saved[i], applyCh, conf)
+	} else {
+		rf, err = MakeWithConfig(ends, i, cfg.saved[i], applyCh, conf)
+	}
+	if err != nil {
+		cfg.t.Fatalf("start server %v: %v", i, err)
+	}
 
 	cfg.mu.Lock()
 	cfg.rafts[i] = rf
@@ -198,6 +312,115 @@ func (cfg *config) start1(i int) {
 	cfg.net.AddServer(i, srv)
 }
 
+// start a brand-new server with the next unused id and attach it
+// to the net. it is not part of the cluster until addMember().
+func (cfg *config) addServer() int {
+	cfg.mu.Lock()
+	i := cfg.n
+	cfg.n++
+	cfg.applyErr = append(cfg.applyErr, "")
+	cfg.rafts = append(cfg.rafts, nil)
+	cfg.connected = append(cfg.connected, false)
+	cfg.saved = append(cfg.saved, nil)
+	cfg.endnames = append(cfg.endnames, nil)
+	cfg.logs = append(cfg.logs, map[int]int{})
+	cfg.joining = append(cfg.joining, true)
+
+	// existing servers need an end point to talk to the new one.
+	for j := 0; j < i; j++ {
+		if cfg.endnames[j] == nil {
+			continue
+		}
+		endname := randString(20)
+		cfg.endnames[j] = append(cfg.endnames[j], endname)
+		end := cfg.net.MakeEnd(endname)
+		cfg.net.Connect(endname, i)
+		if cfg.rafts[j] != nil {
+			cfg.rafts[j].ConnectPeer(i, end)
+		}
+	}
+	cfg.mu.Unlock()
+
+	cfg.start1(i)
+	cfg.connect(i)
+	return i
+}
+
+func (cfg *config) addMember(server int) {
+	cfg.changeConfig(func(rf *Raft) (int, int, error) {
+		return rf.AddServer(server)
+	})
+}
+
+func (cfg *config) removeMember(server int) {
+	cfg.changeConfig(func(rf *Raft) (int, int, error) {
+		return rf.RemoveServer(server)
+	})
+}
+
+// move the cluster to servers through joint consensus, and
+// wait until the C_new that follows C_old,new has committed too.
+func (cfg *config) changeServers(servers []int) {
+	index := cfg.changeConfig(func(rf *Raft) (int, int, error) {
+		return rf.ChangeServers(servers)
+	})
+
+	t0 := time.Now()
+	for time.Since(t0).Seconds() < 10 {
+		cfg.mu.Lock()
+		for i := 0; i < cfg.n; i++ {
+			for j, cmd := range cfg.logs[i] {
+				if j > index && cmd == configChangeCmd {
+					cfg.mu.Unlock()
+					return
+				}
+			}
+		}
+		cfg.mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+	}
+	cfg.t.Fatalf("changeServers(%v) C_new never committed", servers)
+}
+
+// like one(), but commits a ConfigChange started by start,
+// which is tried on every server. returns the index.
+func (cfg *config) changeConfig(start func(rf *Raft) (int, int, error)) int {
+	t0 := time.Now()
+	for time.Since(t0).Seconds() < 10 {
+		index := -1
+		for si := 0; si < cfg.n; si++ {
+			var rf *Raft
+			cfg.mu.Lock()
+			if cfg.connected[si] {
+				rf = cfg.rafts[si]
+			}
+			cfg.mu.Unlock()
+			if rf != nil {
+				index1, _, err := start(rf)
+				if err == nil {
+					index = index1
+					break
+				}
+			}
+		}
+
+		if index != -1 {
+			t1 := time.Now()
+			for time.Since(t1).Seconds() < 2 {
+				nd, cmd := cfg.nCommitted(index)
+				if nd > 0 && cmd == configChangeCmd {
+					return index
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		} else {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	cfg.t.Fatalf("changeConfig failed to reach agreement")
+	return -1
+}
+
 func (cfg *config) cleanup() {
 	for i := 0; i < len(cfg.rafts); i++ {
 		if cfg.rafts[i] != nil {
@@ -261,6 +484,103 @@ func (cfg *config) setUnreliable(flag bool) {
 	cfg.net.Reliable(!flag)
 }
 
+func (cfg *config) setSnapshotInterval(n int) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	cfg.snapshotInterval = n
+}
+
+// applies to servers started later, restart the running ones. replaces
+// the settings of earlier calls to setPreVote() etc. as well.
+func (cfg *config) setRaftConfig(conf Config) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	cfg.raftConfig = conf
+}
+
+// applies to running servers and to servers started later.
+func (cfg *config) setPreVote(flag bool) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	cfg.raftConfig.PreVote = flag
+	for i := 0; i < cfg.n; i++ {
+		if cfg.rafts[i] != nil {
+			cfg.rafts[i].SetPreVote(flag)
+		}
+	}
+}
+
+// applies to running servers and to servers started later.
+func (cfg *config) setCheckQuorum(flag bool) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	cfg.raftConfig.CheckQuorum = flag
+	for i := 0; i < cfg.n; i++ {
+		if cfg.rafts[i] != nil {
+			cfg.rafts[i].SetCheckQuorum(flag)
+		}
+	}
+}
+
+// applies to running servers and to servers started later.
+func (cfg *config) setLeaseRead(flag bool, drift time.Duration) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	cfg.raftConfig.LeaseRead = flag
+	cfg.raftConfig.LeaseDrift = drift
+	for i := 0; i < cfg.n; i++ {
+		if cfg.rafts[i] != nil {
+			cfg.rafts[i].SetLeaseRead(flag, drift)
+		}
+	}
+}
+
+// call before any command is started. applies to
+// running servers and to servers started later.
+func (cfg *config) setCodec(codec Codec) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	cfg.raftConfig.Codec = codec
+	for i := 0; i < cfg.n; i++ {
+		if cfg.rafts[i] != nil {
+			cfg.rafts[i].SetCodec(codec)
+		}
+	}
+}
+
+// applies to running servers and to servers started later.
+func (cfg *config) setNoOp(flag bool) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	cfg.raftConfig.NoOp = flag
+	for i := 0; i < cfg.n; i++ {
+		if cfg.rafts[i] != nil {
+			cfg.rafts[i].SetNoOp(flag)
+		}
+	}
+}
+
+// applies to running servers and to servers started later.
+func (cfg *config) setReplication(maxInflight int, maxEntries int, maxBytes int) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	cfg.raftConfig.MaxInflight = maxInflight
+	cfg.raftConfig.MaxBatchEntries = maxEntries
+	cfg.raftConfig.MaxBatchBytes = maxBytes
+	for i := 0; i < cfg.n; i++ {
+		if cfg.rafts[i] != nil {
+			cfg.rafts[i].SetReplication(maxInflight, maxEntries, maxBytes)
+		}
+	}
+}
+
+// applies to running servers and to servers started later.
+func (cfg *config) setApplyDelay(delay time.Duration) {
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	cfg.applyDelay = delay
+}
+
 func (cfg *config) setLongReordering(flag bool) {
 	cfg.net.LongReordering(flag)
 }
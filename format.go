@@ -0,0 +1,126 @@
+package raft
+
+//
+// the on-disk format of Raft state.
+//
+// a state blob (what persist() hands to SaveRaftState(), and the
+// WAL's hard state file) is
+//   magic "RAFT" | version uint32 | crc32 uint32 | payload
+// a WAL segment starts with
+//   magic "RAFT" | version uint32
+// followed by records
+//   length uint32 | crc32 uint32 | payload
+// integers are big endian, crc32 is Castagnoli over the payload.
+//
+// state written before the header was added is read as version 0: a
+// state blob is just the payload, a segment is just records of
+//   length uint32 | payload
+// neither has a checksum. new state is always written in the current
+// version, the WAL starts a new segment instead of appending to a
+// version 0 one.
+//
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+const (
+	formatMagic   = "RAFT"
+	formatVersion = 1
+	headerSize    = 8 // magic + version
+	recordHeader  = 8 // length + crc32
+)
+
+var ErrCorrupt = errors.New("raft: corrupt persisted state")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func appendHeader(buf []byte) []byte {
+	buf = append(buf, formatMagic...)
+	return binary.BigEndian.AppendUint32(buf, formatVersion)
+}
+
+// false for version 0 data.
+func hasHeader(data []byte) bool {
+	return len(data) >= len(formatMagic) && string(data[:len(formatMagic)]) == formatMagic
+}
+
+func checkHeader(data []byte) error {
+	if len(data) < headerSize || string(data[:4]) != formatMagic {
+		return fmt.Errorf("%w: bad magic", ErrCorrupt)
+	}
+	if v := binary.BigEndian.Uint32(data[4:]); v != formatVersion {
+		return fmt.Errorf("%w: unsupported format version %v, expected %v", ErrCorrupt, v, formatVersion)
+	}
+	return nil
+}
+
+func encodeState(payload []byte) []byte {
+	buf := make([]byte, 0, headerSize+4+len(payload))
+	buf = appendHeader(buf)
+	buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(payload, crcTable))
+	return append(buf, payload...)
+}
+
+func decodeState(data []byte) ([]byte, error) {
+	if !hasHeader(data) {
+		// version 0，没有checksum，解码失败才知道坏了
+		return data, nil
+	}
+	if err := checkHeader(data); err != nil {
+		return nil, err
+	}
+	if len(data) < headerSize+4 {
+		return nil, fmt.Errorf("%w: state is cut short", ErrCorrupt)
+	}
+	crc := binary.BigEndian.Uint32(data[headerSize:])
+	payload := data[headerSize+4:]
+	if crc32.Checksum(payload, crcTable) != crc {
+		return nil, fmt.Errorf("%w: state checksum mismatch", ErrCorrupt)
+	}
+	return payload, nil
+}
+
+func encodeRecord(payload []byte) []byte {
+	buf := make([]byte, 0, recordHeader+len(payload))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+	buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(payload, crcTable))
+	return append(buf, payload...)
+}
+
+//
+// decode the record at the start of data. torn is true if it can be
+// the last record a crash interrupted: it runs past the end of data,
+// or it fails the checksum and nothing follows it.
+//
+func decodeRecord(data []byte) (payload []byte, n int, torn bool, err error) {
+	if len(data) < recordHeader {
+		return nil, 0, true, fmt.Errorf("%w: record header is cut short", ErrCorrupt)
+	}
+	size := int(binary.BigEndian.Uint32(data))
+	crc := binary.BigEndian.Uint32(data[4:])
+	if len(data)-recordHeader < size {
+		return nil, 0, true, fmt.Errorf("%w: record is cut short", ErrCorrupt)
+	}
+	payload = data[recordHeader : recordHeader+size]
+	if crc32.Checksum(payload, crcTable) != crc {
+		torn = len(data) == recordHeader+size
+		return nil, 0, torn, fmt.Errorf("%w: record checksum mismatch", ErrCorrupt)
+	}
+	return payload, recordHeader + size, false, nil
+}
+
+// decodeRecord() for a version 0 segment, which has no checksums.
+func decodeLegacyRecord(data []byte) (payload []byte, n int, err error) {
+	if len(data) < 4 {
+		return nil, 0, fmt.Errorf("%w: record header is cut short", ErrCorrupt)
+	}
+	size := int(binary.BigEndian.Uint32(data))
+	if len(data)-4 < size {
+		return nil, 0, fmt.Errorf("%w: record is cut short", ErrCorrupt)
+	}
+	return data[4 : 4+size], 4 + size, nil
+}
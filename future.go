@@ -0,0 +1,163 @@
+package raft
+
+//
+// Propose() is Start() for services that want to know how their
+// command ended up without matching index and term on applyCh
+// themselves. it returns a Future that resolves once the entry at
+// the command's index has been sent on applyCh: with the ApplyMsg if
+// it's the command, with ErrLeadershipLost if another leader's entry
+// took its place.
+//
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	ErrLeadershipLost = errors.New("raft: leadership lost, entry was overwritten")
+	// a snapshot from the leader covered the entry before it was applied
+	// here, the command may or may not be part of the snapshot.
+	ErrCompacted = errors.New("raft: entry was compacted into a snapshot")
+)
+
+type Future struct {
+	index int
+	term  int
+	done  chan struct{}
+	msg   ApplyMsg
+	err   error
+}
+
+// the index the command was appended at.
+func (f *Future) Index() int {
+	return f.index
+}
+
+// the term the command was appended in.
+func (f *Future) Term() int {
+	return f.term
+}
+
+// closed once the Future is resolved.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+//
+// wait until the Future is resolved. returns the ApplyMsg of the
+// command once it has been sent on applyCh, ErrLeadershipLost,
+// ErrCompacted, or the error of the ctx passed to Propose().
+//
+func (f *Future) Result() (ApplyMsg, error) {
+	<-f.done
+	return f.msg, f.err
+}
+
+// called once, by whoever removed f from rf.futures.
+func (f *Future) resolve(msg ApplyMsg, err error) {
+	f.msg = msg
+	f.err = err
+	close(f.done)
+}
+
+//
+// like Start(), but returns a Future for the command, or
+// ErrNotLeader if this server can't take it, or an error wrapping
+// ErrBadCommand if the Codec can't encode it. if ctx is done before
+// the entry is applied, the Future resolves with ctx.Err(); the
+// command may still commit later. Kill() resolves pending Futures
+// with ErrShutdown.
+//
+func (rf *Raft) Propose(ctx context.Context, command interface{}) (*Future, error) {
+	rf.mutex.Lock()
+	if rf.killed() {
+		rf.mutex.Unlock()
+		return nil, ErrShutdown
+	}
+	index, term, err := rf.appendCommand(command)
+	if err != nil {
+		rf.mutex.Unlock()
+		return nil, err
+	}
+	f := &Future{
+		index: index,
+		term:  term,
+		done:  make(chan struct{}),
+	}
+	rf.futures[index] = append(rf.futures[index], f)
+	rf.mutex.Unlock()
+
+	if ctx.Done() != nil {
+		// Kill()等这个goroutine退出之后才resolve剩下的futures
+		rf.goFunc(func() {
+			select {
+			case <-f.done:
+			case <-rf.ctx.Done():
+			case <-ctx.Done():
+				rf.mutex.Lock()
+				removed := rf.removeFuture(f)
+				rf.mutex.Unlock()
+				if removed {
+					f.resolve(ApplyMsg{}, ctx.Err())
+				}
+			}
+		})
+	}
+	return f, nil
+}
+
+// caller must hold rf.mutex.
+func (rf *Raft) removeFuture(f *Future) bool {
+	futures := rf.futures[f.index]
+	for i, other := range futures {
+		if other == f {
+			futures = append(futures[:i], futures[i+1:]...)
+			if len(futures) == 0 {
+				delete(rf.futures, f.index)
+			} else {
+				rf.futures[f.index] = futures
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// msg was sent on applyCh for an entry of term. caller must hold rf.mutex.
+func (rf *Raft) resolveFutures(msg ApplyMsg, term int) {
+	futures, ok := rf.futures[msg.Index]
+	if !ok {
+		return
+	}
+	delete(rf.futures, msg.Index)
+	for _, f := range futures {
+		if f.term == term {
+			f.resolve(msg, nil)
+		} else {
+			// 同一个index上commit的是别的leader的entry
+			f.resolve(ApplyMsg{}, ErrLeadershipLost)
+		}
+	}
+}
+
+//
+// a snapshot up to lastIncludedIndex was installed instead of applying
+// the entries. caller must hold rf.mutex.
+//
+func (rf *Raft) resolveCompacted(lastIncludedIndex int, lastIncludedTerm int) {
+	for index, futures := range rf.futures {
+		if index > lastIncludedIndex {
+			continue
+		}
+		delete(rf.futures, index)
+		for _, f := range futures {
+			if f.term > lastIncludedTerm {
+				// snapshot里entries的term都不超过lastIncludedTerm
+				f.resolve(ApplyMsg{}, ErrLeadershipLost)
+			} else {
+				f.resolve(ApplyMsg{}, ErrCompacted)
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package raft
+
+//
+// offline access to what a FilePersister or WALPersister left in a
+// directory, for tools like cmd/raftdump. the server using the
+// directory must not be running.
+//
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	FormatFile = "file" // FilePersister
+	FormatWAL  = "wal"  // WALPersister
+)
+
+var ErrNoState = errors.New("raft: no persisted state")
+
+type PersistedState struct {
+	Format string
+	LogState
+	Snapshot []byte   // as the service passed it to Snapshot(), nil if none
+	Problems []string // gaps and overlaps between the WAL's records
+}
+
+// the index of the last entry, LastIncludedIndex if there are none.
+func (ps *PersistedState) LastIndex() int {
+	return ps.LastIncludedIndex + len(ps.Entries)
+}
+
+//
+// read the state in dir without changing anything, unlike
+// MakeWALPersister(), which drops a torn record at the end of
+// the WAL. such a record is skipped here as well. where
+// MakeWALPersister() fails because the WAL's records skip or repeat
+// an index, this goes on and adds it to Problems, see replay().
+//
+func ReadPersistedState(dir string) (*PersistedState, error) {
+	format, err := detectFormat(dir)
+	if err != nil {
+		return nil, err
+	}
+	ps := &PersistedState{Format: format}
+	if format == FormatWAL {
+		if ps.LogState, ps.Problems, err = readWAL(dir); err != nil {
+			return nil, err
+		}
+	} else {
+		data, err := readFileIfExists(filepath.Join(dir, raftStateFile))
+		if err != nil {
+			return nil, err
+		}
+		st, err := decodeRaftState(data)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", raftStateFile, err)
+		}
+		config := st.LastIncludedConfig
+		ps.LogState = LogState{
+			CurrentTerm:        st.CurrentTerm,
+			VotedFor:           st.VotedFor,
+			LastIncludedIndex:  st.LastIncludedIndex,
+			LastIncludedTerm:   st.LastIncludedTerm,
+			LastIncludedConfig: &config,
+			Entries:            st.Logs[1:],
+		}
+	}
+	if ps.Snapshot, err = readFileIfExists(filepath.Join(dir, snapshotFile)); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+func detectFormat(dir string) (string, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return "", err
+	}
+	names, err := segmentNames(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(names) > 0 || exists(filepath.Join(dir, hardStateFile)) {
+		return FormatWAL, nil
+	}
+	if exists(filepath.Join(dir, raftStateFile)) {
+		return FormatFile, nil
+	}
+	return "", fmt.Errorf("%v: %w", dir, ErrNoState)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// recover() without the writes.
+func readWAL(dir string) (LogState, []string, error) {
+	wp := &WALPersister{}
+	wp.state.VotedFor = VoteNull
+	hs, err := readFileIfExists(filepath.Join(dir, hardStateFile))
+	if err != nil {
+		return LogState{}, nil, err
+	}
+	if hs != nil {
+		if wp.state.CurrentTerm, wp.state.VotedFor, err = decodeHardState(hs); err != nil {
+			return LogState{}, nil, err
+		}
+	}
+	names, err := segmentNames(dir)
+	if err != nil {
+		return LogState{}, nil, err
+	}
+	var records []walRecord
+	for i, name := range names {
+		seq, err := segmentSeq(name)
+		if err != nil {
+			return LogState{}, nil, err
+		}
+		recs, _, err := readSegment(name, &walSegment{seq: seq}, i == len(names)-1)
+		if err != nil {
+			return LogState{}, nil, err
+		}
+		records = append(records, recs...)
+	}
+	problems := make([]string, 0)
+	if err := wp.replay(records, &problems); err != nil {
+		return LogState{}, nil, err
+	}
+	return wp.state, problems, nil
+}
+
+//
+// remove the entries after index from the Logs in dir, to get a
+// server whose Logs are damaged past index going again. the server
+// fetches the entries from the leader once it's back, as long as
+// they were committed on a majority without it. index can't be
+// before the snapshot. the server must not be running.
+//
+func TruncatePersistedState(dir string, index int) error {
+	ps, err := ReadPersistedState(dir)
+	if err != nil {
+		return err
+	}
+	if index < ps.LastIncludedIndex {
+		return fmt.Errorf("index %v is in the snapshot, which goes up to %v", index, ps.LastIncludedIndex)
+	}
+	if index >= ps.LastIndex() {
+		return nil
+	}
+
+	if ps.Format == FormatWAL {
+		wp, err := MakeWALPersister(dir)
+		if err != nil {
+			return err
+		}
+		wp.TruncateLogs(index)
+		return wp.Close()
+	}
+
+	fp, err := MakeFilePersister(dir)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	st, err := decodeRaftState(fp.ReadRaftState())
+	if err != nil {
+		return err
+	}
+	st.Logs = st.Logs[:index-st.LastIncludedIndex+1]
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	return fp.writeFile(raftStateFile, encodeRaftState(st))
+}
@@ -0,0 +1,85 @@
+package kvraft
+
+import (
+	crand "crypto/rand"
+	"math/big"
+	"raft"
+	"time"
+)
+
+//
+// a Clerk sends one request at a time, calls on the same
+// Clerk must not overlap.
+//
+type Clerk struct {
+	servers  []raft.Transport
+	leader   int // the server that answered last, tried first
+	clientId int64
+	seq      int64 // Seq of the last PutAppend
+}
+
+func nrand() int64 {
+	max := big.NewInt(int64(1) << 62)
+	bigx, _ := crand.Int(crand.Reader, max)
+	return bigx.Int64()
+}
+
+func MakeClerk(servers []raft.Transport) *Clerk {
+	ck := &Clerk{}
+	ck.servers = servers
+	ck.clientId = nrand()
+	return ck
+}
+
+// pause after every server was tried, so that an election can finish.
+const retryInterval = 100 * time.Millisecond
+
+//
+// fetch the current value for a key.
+// returns "" if the key does not exist.
+// keeps trying forever in the face of all other errors.
+//
+func (ck *Clerk) Get(key string) string {
+	args := GetArgs{Key: key}
+	for {
+		for i := 0; i < len(ck.servers); i++ {
+			server := (ck.leader + i) % len(ck.servers)
+			reply := &GetReply{}
+			ok := ck.servers[server].Call("KVServer.Get", args, reply)
+			if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
+				ck.leader = server
+				return reply.Value
+			}
+		}
+		time.Sleep(retryInterval)
+	}
+}
+
+//
+// shared by Put and Append.
+// keeps trying forever in the face of all errors.
+//
+func (ck *Clerk) PutAppend(key string, value string, op string) {
+	ck.seq++
+	args := PutAppendArgs{Key: key, Value: value, Op: op, ClientId: ck.clientId, Seq: ck.seq}
+	for {
+		for i := 0; i < len(ck.servers); i++ {
+			server := (ck.leader + i) % len(ck.servers)
+			reply := &PutAppendReply{}
+			ok := ck.servers[server].Call("KVServer.PutAppend", args, reply)
+			if ok && reply.Err == OK {
+				ck.leader = server
+				return
+			}
+		}
+		time.Sleep(retryInterval)
+	}
+}
+
+func (ck *Clerk) Put(key string, value string) {
+	ck.PutAppend(key, value, OpPut)
+}
+
+func (ck *Clerk) Append(key string, value string) {
+	ck.PutAppend(key, value, OpAppend)
+}
@@ -0,0 +1,43 @@
+package kvraft
+
+//
+// RPC definitions shared by the Clerk and the KVServer.
+//
+
+const (
+	OK             = "OK"
+	ErrNoKey       = "ErrNoKey"
+	ErrWrongLeader = "ErrWrongLeader"
+	ErrTimeout     = "ErrTimeout"
+)
+
+type Err string
+
+const (
+	OpPut    = "Put"
+	OpAppend = "Append"
+)
+
+// Put or Append
+type PutAppendArgs struct {
+	Key   string
+	Value string
+	Op    string // "Put" or "Append"
+	// a Clerk numbers its requests 1, 2, ... under its ClientId, a
+	// retry keeps the number so the servers can detect duplicates.
+	ClientId int64
+	Seq      int64
+}
+
+type PutAppendReply struct {
+	Err Err
+}
+
+type GetArgs struct {
+	Key string
+}
+
+type GetReply struct {
+	Err   Err
+	Value string
+}
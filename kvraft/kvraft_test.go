@@ -0,0 +1,526 @@
+package kvraft
+
+//
+// k/v service tests.
+//
+
+import "testing"
+import "strconv"
+import "time"
+import "math/rand"
+import "sync"
+
+// The tester generously allows solutions to complete elections in one second
+// (much more than the paper's range of timeouts).
+const electionTimeout = 1 * time.Second
+
+// get/put/append that keep counts
+func Get(cfg *config, ck *Clerk, key string) string {
+	v := ck.Get(key)
+	cfg.op()
+	return v
+}
+
+func Put(cfg *config, ck *Clerk, key string, value string) {
+	ck.Put(key, value)
+	cfg.op()
+}
+
+func Append(cfg *config, ck *Clerk, key string, value string) {
+	ck.Append(key, value)
+	cfg.op()
+}
+
+func check(cfg *config, t *testing.T, ck *Clerk, key string, value string) {
+	v := Get(cfg, ck, key)
+	if v != value {
+		t.Fatalf("Get(%v): expected:\n%v\nreceived:\n%v", key, value, v)
+	}
+}
+
+// run fn(i) for i in [0, n) concurrently, wait for all of them.
+func spawnClientsAndWait(t *testing.T, cfg *config, n int, fn func(me int, ck *Clerk, t *testing.T)) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(me int) {
+			defer wg.Done()
+			ck := cfg.makeClient(cfg.All())
+			defer cfg.deleteClient(ck)
+			fn(me, ck, t)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestBasic3A(t *testing.T) {
+	const nservers = 3
+	cfg := makeConfig(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: one client (3A)")
+
+	check(cfg, t, ck, "a", "")
+	Put(cfg, ck, "a", "x")
+	check(cfg, t, ck, "a", "x")
+	Append(cfg, ck, "a", "y")
+	check(cfg, t, ck, "a", "xy")
+	Put(cfg, ck, "a", "z")
+	Append(cfg, ck, "b", "1")
+	Append(cfg, ck, "b", "2")
+	check(cfg, t, ck, "a", "z")
+	check(cfg, t, ck, "b", "12")
+
+	cfg.end()
+}
+
+func TestConcurrent3A(t *testing.T) {
+	const nservers = 5
+	const nclients = 5
+	cfg := makeConfig(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: many clients (3A)")
+
+	spawnClientsAndWait(t, cfg, nclients, func(me int, ck *Clerk, t *testing.T) {
+		key := strconv.Itoa(me)
+		last := ""
+		Put(cfg, ck, key, last)
+		for j := 0; j < 20; j++ {
+			nv := "x " + strconv.Itoa(me) + " " + strconv.Itoa(j) + " y"
+			Append(cfg, ck, key, nv)
+			last += nv
+			if (rand.Int() % 1000) < 300 {
+				check(cfg, t, ck, key, last)
+			}
+		}
+		check(cfg, t, ck, key, last)
+	})
+
+	cfg.end()
+}
+
+// Puts are idempotent, so a retried Put can't make a difference
+// even without duplicate detection.
+func TestUnreliable3A(t *testing.T) {
+	const nservers = 5
+	const nclients = 5
+	cfg := makeConfig(t, nservers, true, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: unreliable net, many clients (3A)")
+
+	spawnClientsAndWait(t, cfg, nclients, func(me int, ck *Clerk, t *testing.T) {
+		key := strconv.Itoa(me)
+		for j := 0; j < 10; j++ {
+			v := strconv.Itoa(me) + "-" + strconv.Itoa(j)
+			Put(cfg, ck, key, v)
+			check(cfg, t, ck, key, v)
+		}
+	})
+
+	cfg.end()
+}
+
+// check that ops are committed fast enough, better than 1 per heartbeat interval
+func TestSpeed3A(t *testing.T) {
+	const nservers = 3
+	const numOps = 500
+	cfg := makeConfig(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: ops complete fast enough (3A)")
+
+	// wait until first op completes, so we know a leader is elected
+	// and KV servers are ready to process client requests
+	ck.Get("x")
+
+	start := time.Now()
+	for i := 0; i < numOps; i++ {
+		ck.Append("x", "x 0 "+strconv.Itoa(i)+" y")
+	}
+	dur := time.Since(start)
+
+	v := ck.Get("x")
+	checkClntAppends(t, 0, v, numOps)
+
+	// heartbeat interval should be ~ 50 milliseconds; require at least 3 ops per
+	const heartbeatInterval = 50 * time.Millisecond
+	const opsPerInterval = 3
+	const timePerOp = heartbeatInterval / opsPerInterval
+	if dur > numOps*timePerOp {
+		t.Fatalf("Operations completed too slowly %v/op > %v/op\n", dur/numOps, timePerOp)
+	}
+
+	cfg.end()
+}
+
+// check that for a specific client all known appends are present in a value,
+// and in order
+func checkClntAppends(t *testing.T, clnt int, v string, count int) {
+	lastoff := -1
+	for j := 0; j < count; j++ {
+		wanted := "x " + strconv.Itoa(clnt) + " " + strconv.Itoa(j) + " y"
+		off := indexOf(v, wanted)
+		if off < 0 {
+			t.Fatalf("%v missing element %v in Append result %v", clnt, wanted, v)
+		}
+		off1 := indexOf(v[off+1:], wanted)
+		if off1 >= 0 {
+			t.Fatalf("duplicate element %v in Append result", wanted)
+		}
+		if off <= lastoff {
+			t.Fatalf("wrong order for element %v in Append result", wanted)
+		}
+		lastoff = off
+	}
+}
+
+func indexOf(s string, sub string) int {
+	for i := 0; i+len(sub) <= len(s); i++ {
+		if s[i:i+len(sub)] == sub {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestOnePartition3A(t *testing.T) {
+	const nservers = 5
+	cfg := makeConfig(t, nservers, false, -1)
+	defer cfg.cleanup()
+	ck := cfg.makeClient(cfg.All())
+
+	Put(cfg, ck, "1", "13")
+
+	cfg.begin("Test: progress in majority (3A)")
+
+	p1, p2 := cfg.makePartition()
+	cfg.partition(p1, p2)
+
+	ckp1 := cfg.makeClient(p1)  // connect ckp1 to p1
+	ckp2a := cfg.makeClient(p2) // connect ckp2a to p2
+	ckp2b := cfg.makeClient(p2) // connect ckp2b to p2
+
+	Put(cfg, ckp1, "1", "14")
+	check(cfg, t, ckp1, "1", "14")
+
+	cfg.end()
+
+	done0 := make(chan bool)
+	done1 := make(chan bool)
+
+	cfg.begin("Test: no progress in minority (3A)")
+	go func() {
+		Put(cfg, ckp2a, "1", "15")
+		done0 <- true
+	}()
+	go func() {
+		Get(cfg, ckp2b, "1") // different clerk in p2
+		done1 <- true
+	}()
+
+	select {
+	case <-done0:
+		t.Fatalf("Put in minority completed")
+	case <-done1:
+		t.Fatalf("Get in minority completed")
+	case <-time.After(time.Second):
+	}
+
+	check(cfg, t, ckp1, "1", "14")
+	Put(cfg, ckp1, "1", "16")
+	check(cfg, t, ckp1, "1", "16")
+
+	cfg.end()
+
+	cfg.begin("Test: completion after heal (3A)")
+
+	cfg.ConnectAll()
+	cfg.ConnectClient(ckp2a, cfg.All())
+	cfg.ConnectClient(ckp2b, cfg.All())
+
+	time.Sleep(electionTimeout)
+
+	select {
+	case <-done0:
+	case <-time.After(30 * 100 * time.Millisecond):
+		t.Fatalf("Put did not complete")
+	}
+
+	select {
+	case <-done1:
+	case <-time.After(30 * 100 * time.Millisecond):
+		t.Fatalf("Get did not complete")
+	default:
+	}
+
+	check(cfg, t, ck, "1", "15")
+
+	cfg.end()
+}
+
+func TestPersistConcurrent3A(t *testing.T) {
+	const nservers = 5
+	const nclients = 5
+	cfg := makeConfig(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: restarts, many clients (3A)")
+
+	for iters := 0; iters < 3; iters++ {
+		spawnClientsAndWait(t, cfg, nclients, func(me int, ck *Clerk, t *testing.T) {
+			key := strconv.Itoa(me)
+			for j := 0; j < 5; j++ {
+				Append(cfg, ck, key, "x "+strconv.Itoa(me)+" "+strconv.Itoa(iters*5+j)+" y")
+			}
+		})
+
+		// crash and restart all servers.
+		for i := 0; i < nservers; i++ {
+			cfg.ShutdownServer(i)
+		}
+		// wait for a while for servers to shutdown, since
+		// shutdown isn't a real crash and isn't instantaneous
+		time.Sleep(electionTimeout)
+		for i := 0; i < nservers; i++ {
+			cfg.StartServer(i)
+		}
+		cfg.ConnectAll()
+	}
+
+	ck := cfg.makeClient(cfg.All())
+	for i := 0; i < nclients; i++ {
+		checkClntAppends(t, i, Get(cfg, ck, strconv.Itoa(i)), 15)
+	}
+
+	cfg.end()
+}
+
+func TestSnapshotSize3B(t *testing.T) {
+	const nservers = 3
+	const maxraftstate = 1000
+	const maxsnapshotstate = 500
+	cfg := makeConfig(t, nservers, false, maxraftstate)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: snapshot size is reasonable (3B)")
+
+	for i := 0; i < 200; i++ {
+		Put(cfg, ck, "x", "0")
+		check(cfg, t, ck, "x", "0")
+		Put(cfg, ck, "x", "1")
+		check(cfg, t, ck, "x", "1")
+	}
+
+	// check that servers have thrown away most of their log entries
+	sz := cfg.LogSize()
+	if sz > 8*maxraftstate {
+		t.Fatalf("logs were not trimmed (%v > 8*%v)", sz, maxraftstate)
+	}
+
+	// check that the snapshots are not unreasonably large
+	for i := 0; i < nservers; i++ {
+		if ssz := cfg.saved[i].SnapshotSize(); ssz > maxsnapshotstate {
+			t.Fatalf("snapshot too large (%v > %v)", ssz, maxsnapshotstate)
+		}
+	}
+
+	cfg.end()
+}
+
+func TestSnapshotRecover3B(t *testing.T) {
+	const nservers = 3
+	const maxraftstate = 1000
+	cfg := makeConfig(t, nservers, false, maxraftstate)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: InstallSnapshot and restarts with snapshots (3B)")
+
+	Put(cfg, ck, "a", "A")
+	check(cfg, t, ck, "a", "A")
+
+	// a bunch of puts into the majority partition.
+	p1, p2 := cfg.makePartition()
+	cfg.partition(p1, p2)
+	ck1 := cfg.makeClient(p1)
+	for i := 0; i < 50; i++ {
+		Put(cfg, ck1, strconv.Itoa(i), strconv.Itoa(i))
+	}
+	time.Sleep(electionTimeout)
+	Put(cfg, ck1, "b", "B")
+
+	// check that the majority partition has thrown away
+	// most of its log entries.
+	if sz := cfg.LogSize(); sz > 8*maxraftstate {
+		t.Fatalf("logs were not trimmed (%v > 8*%v)", sz, maxraftstate)
+	}
+
+	// now make the minority server catch up through InstallSnapshot.
+	cfg.ConnectAll()
+	Put(cfg, ck, "c", "C")
+	Put(cfg, ck, "d", "D")
+	check(cfg, t, ck, "c", "C")
+	check(cfg, t, ck, "b", "B")
+	for i := 0; i < 50; i++ {
+		check(cfg, t, ck, strconv.Itoa(i), strconv.Itoa(i))
+	}
+
+	// restart everyone, they recover from their snapshots.
+	for i := 0; i < nservers; i++ {
+		cfg.ShutdownServer(i)
+	}
+	time.Sleep(electionTimeout)
+	for i := 0; i < nservers; i++ {
+		cfg.StartServer(i)
+	}
+	cfg.ConnectAll()
+	check(cfg, t, ck, "a", "A")
+	check(cfg, t, ck, "d", "D")
+	for i := 0; i < 50; i++ {
+		check(cfg, t, ck, strconv.Itoa(i), strconv.Itoa(i))
+	}
+
+	cfg.end()
+}
+
+func TestUnreliableAppend3A(t *testing.T) {
+	const nservers = 5
+	const nclients = 5
+	cfg := makeConfig(t, nservers, true, -1)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: unreliable net, many clients appending (3A)")
+
+	spawnClientsAndWait(t, cfg, nclients, func(me int, ck *Clerk, t *testing.T) {
+		key := strconv.Itoa(me)
+		for j := 0; j < 10; j++ {
+			Append(cfg, ck, key, "x "+strconv.Itoa(me)+" "+strconv.Itoa(j)+" y")
+		}
+	})
+
+	ck := cfg.makeClient(cfg.All())
+	for i := 0; i < nclients; i++ {
+		checkClntAppends(t, i, Get(cfg, ck, strconv.Itoa(i)), 10)
+	}
+
+	cfg.end()
+}
+
+// the same request sent twice is applied once.
+func TestDuplicate3A(t *testing.T) {
+	const nservers = 3
+	cfg := makeConfig(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: duplicate requests are applied once (3A)")
+
+	Put(cfg, ck, "a", "x")
+
+	args := PutAppendArgs{Key: "a", Value: "y", Op: OpAppend, ClientId: nrand(), Seq: 1}
+	for n := 0; n < 2; n++ {
+		done := false
+		for iters := 0; iters < 50 && !done; iters++ {
+			for _, end := range ck.servers {
+				reply := &PutAppendReply{}
+				if end.Call("KVServer.PutAppend", args, reply) && reply.Err == OK {
+					done = true
+					break
+				}
+			}
+			time.Sleep(retryInterval)
+		}
+		if !done {
+			t.Fatalf("Append was not applied")
+		}
+	}
+
+	check(cfg, t, ck, "a", "xy")
+
+	cfg.end()
+}
+
+// the sessions survive snapshots and restarts.
+func TestSnapshotUnreliableRecover3B(t *testing.T) {
+	const nservers = 5
+	const nclients = 5
+	const maxraftstate = 1000
+	cfg := makeConfig(t, nservers, true, maxraftstate)
+	defer cfg.cleanup()
+
+	cfg.begin("Test: unreliable net, restarts, snapshots, many clients (3B)")
+
+	for iters := 0; iters < 3; iters++ {
+		spawnClientsAndWait(t, cfg, nclients, func(me int, ck *Clerk, t *testing.T) {
+			key := strconv.Itoa(me)
+			for j := 0; j < 5; j++ {
+				Append(cfg, ck, key, "x "+strconv.Itoa(me)+" "+strconv.Itoa(iters*5+j)+" y")
+			}
+		})
+
+		for i := 0; i < nservers; i++ {
+			cfg.ShutdownServer(i)
+		}
+		time.Sleep(electionTimeout)
+		for i := 0; i < nservers; i++ {
+			cfg.StartServer(i)
+		}
+		cfg.ConnectAll()
+	}
+
+	ck := cfg.makeClient(cfg.All())
+	for i := 0; i < nclients; i++ {
+		checkClntAppends(t, i, Get(cfg, ck, strconv.Itoa(i)), 15)
+	}
+
+	if sz := cfg.LogSize(); sz > 8*maxraftstate {
+		t.Fatalf("logs were not trimmed (%v > 8*%v)", sz, maxraftstate)
+	}
+
+	cfg.end()
+}
+
+// Kill() waits for the server's applier, which must not stay blocked
+// on applyCh after Raft has stopped.
+func TestKillStopsApplier3A(t *testing.T) {
+	const nservers = 3
+	cfg := makeConfig(t, nservers, false, -1)
+	defer cfg.cleanup()
+
+	ck := cfg.makeClient(cfg.All())
+
+	cfg.begin("Test: Kill() stops the applier (3A)")
+
+	Put(cfg, ck, "a", "x")
+
+	for i := 0; i < nservers; i++ {
+		done := make(chan bool)
+		go func() {
+			cfg.ShutdownServer(i)
+			done <- true
+		}()
+		select {
+		case <-done:
+		case <-time.After(electionTimeout):
+			t.Fatalf("Kill() of server %v didn't return", i)
+		}
+	}
+
+	for i := 0; i < nservers; i++ {
+		cfg.StartServer(i)
+	}
+	cfg.ConnectAll()
+	check(cfg, t, ck, "a", "x")
+
+	cfg.end()
+}
@@ -0,0 +1,335 @@
+package kvraft
+
+//
+// a replicated key/value service on top of Raft.
+//
+// Put and Append are Raft Logs entries: the server that gets the RPC
+// Propose()s an Op and replies once Raft has applied it. if a different
+// Op is applied at its index, the server lost leadership and the Clerk
+// must try another one.
+// Get doesn't write the Logs, it waits for Raft's ReadIndex() and
+// reads once everything up to the read index is applied.
+//
+// a Clerk retries a Put or Append that may already be in the Logs, so
+// every server keeps a session per Clerk with the Seq of the last Op
+// it applied, and applies an Op only if its Seq is newer. the sessions
+// are part of the replicated state and go into snapshots.
+//
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	log "github.com/sirupsen/logrus"
+	"raft"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how long an RPC waits for its Op to be applied before giving up.
+const applyTimeout = 500 * time.Millisecond
+
+type Op struct {
+	Type     string // OpPut or OpAppend
+	Key      string
+	Value    string
+	ClientId int64
+	Seq      int64
+}
+
+// the last Op applied for a Clerk.
+type session struct {
+	Seq int64
+	Err Err
+}
+
+func init() {
+	gob.Register(Op{})
+}
+
+type KVServer struct {
+	mu      sync.Mutex
+	me      int
+	rf      *raft.Raft
+	applyCh chan raft.ApplyMsg
+	dead    int32         // set by Kill()
+	done    chan struct{} // closed when applier() returns
+
+	maxraftstate int // snapshot if the Raft state grows this big, -1 means never
+	persister    raft.Persister
+
+	data        map[string]string
+	lastApplied int
+	sessions    map[int64]session // ClientId => last applied Op
+}
+
+func (kv *KVServer) Get(args GetArgs, reply *GetReply) {
+	ctx, cancel := context.WithTimeout(context.Background(), applyTimeout)
+	defer cancel()
+	index, err := kv.rf.ReadIndex(ctx)
+	if err != nil {
+		reply.Err = ErrWrongLeader
+		return
+	}
+
+	// Raft已经把index之前的entries都发到applyCh了，但applier不一定处理完
+	for {
+		kv.mu.Lock()
+		if kv.lastApplied >= index {
+			value, ok := kv.data[args.Key]
+			kv.mu.Unlock()
+			if ok {
+				reply.Err = OK
+				reply.Value = value
+			} else {
+				reply.Err = ErrNoKey
+			}
+			return
+		}
+		kv.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			reply.Err = ErrTimeout
+			return
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func (kv *KVServer) PutAppend(args PutAppendArgs, reply *PutAppendReply) {
+	kv.mu.Lock()
+	if s, ok := kv.sessions[args.ClientId]; ok && args.Seq <= s.Seq {
+		// 已经apply过了，不用再写一次Logs
+		kv.mu.Unlock()
+		reply.Err = s.Err
+		return
+	}
+	kv.mu.Unlock()
+
+	op := Op{
+		Type:     args.Op,
+		Key:      args.Key,
+		Value:    args.Value,
+		ClientId: args.ClientId,
+		Seq:      args.Seq,
+	}
+	reply.Err = kv.startOp(op)
+}
+
+// propose op and wait until it's applied.
+func (kv *KVServer) startOp(op Op) Err {
+	ctx, cancel := context.WithTimeout(context.Background(), applyTimeout)
+	defer cancel()
+	f, err := kv.rf.Propose(ctx, op)
+	if err != nil {
+		return ErrWrongLeader
+	}
+	if _, err := f.Result(); err != nil {
+		if err == context.DeadlineExceeded {
+			return ErrTimeout
+		}
+		// ErrLeadershipLost或ErrCompacted，Clerk重试时由sessions去重
+		return ErrWrongLeader
+	}
+	return OK
+}
+
+func (kv *KVServer) applier() {
+	defer close(kv.done)
+	for {
+		var msg raft.ApplyMsg
+		select {
+		case msg = <-kv.applyCh:
+		case <-kv.rf.Done():
+			// applyCh不会close，Raft的applier退出之后不会再发送
+			return
+		}
+		// Kill()之后已经取出的msg也不再apply
+		if kv.killed() {
+			continue
+		}
+		kv.mu.Lock()
+		if msg.UseSnapshot {
+			kv.readSnapshot(msg.Snapshot)
+			kv.mu.Unlock()
+			continue
+		}
+		if msg.Index <= kv.lastApplied {
+			kv.mu.Unlock()
+			continue
+		}
+		kv.lastApplied = msg.Index
+
+		// no-op和ConfigChange不用处理
+		if op, ok := msg.Command.(Op); ok {
+			kv.applyOp(op)
+		}
+
+		if kv.maxraftstate != -1 && kv.persister.RaftStateSize() >= kv.maxraftstate {
+			kv.rf.Snapshot(msg.Index, kv.encodeSnapshot())
+		}
+		kv.mu.Unlock()
+	}
+}
+
+// apply op unless it's a duplicate. caller must hold kv.mu.
+func (kv *KVServer) applyOp(op Op) {
+	if s, ok := kv.sessions[op.ClientId]; ok && op.Seq <= s.Seq {
+		// Clerk重试的Op在Logs里出现了不止一次
+		return
+	}
+	switch op.Type {
+	case OpPut:
+		kv.data[op.Key] = op.Value
+	case OpAppend:
+		kv.data[op.Key] += op.Value
+	}
+	kv.sessions[op.ClientId] = session{Seq: op.Seq, Err: OK}
+}
+
+// caller must hold kv.mu.
+func (kv *KVServer) encodeSnapshot() []byte {
+	w := new(bytes.Buffer)
+	e := gob.NewEncoder(w)
+	e.Encode(kv.lastApplied)
+	e.Encode(kv.data)
+	e.Encode(kv.sessions)
+	return w.Bytes()
+}
+
+//
+// the index of the last Op a KVServer's snapshot covers, which Raft
+// keeps as LastIncludedIndex, for tools like cmd/raftdump.
+//
+func SnapshotIndex(snapshot []byte) (int, error) {
+	var lastApplied int
+	if err := gob.NewDecoder(bytes.NewBuffer(snapshot)).Decode(&lastApplied); err != nil {
+		return 0, err
+	}
+	return lastApplied, nil
+}
+
+// caller must hold kv.mu.
+func (kv *KVServer) readSnapshot(snapshot []byte) {
+	if len(snapshot) == 0 {
+		return
+	}
+	var lastApplied int
+	data := make(map[string]string)
+	sessions := make(map[int64]session)
+	d := gob.NewDecoder(bytes.NewBuffer(snapshot))
+	if err := d.Decode(&lastApplied); err != nil {
+		log.Fatalf("KVServer(%v) readSnapshot: %v", kv.me, err)
+	}
+	if err := d.Decode(&data); err != nil {
+		log.Fatalf("KVServer(%v) readSnapshot: %v", kv.me, err)
+	}
+	if err := d.Decode(&sessions); err != nil {
+		log.Fatalf("KVServer(%v) readSnapshot: %v", kv.me, err)
+	}
+	kv.lastApplied = lastApplied
+	kv.data = data
+	kv.sessions = sessions
+}
+
+//
+// the tester calls Kill() when a KVServer instance won't
+// be needed again. it returns once Raft and the applier have stopped.
+//
+func (kv *KVServer) Kill() {
+	atomic.StoreInt32(&kv.dead, 1)
+	kv.rf.Kill()
+	<-kv.done
+}
+
+//
+// snapshot everything applied so far right away, e.g. because an
+// operator asked for it, instead of waiting for maxraftstate.
+// returns the index the snapshot covers.
+//
+func (kv *KVServer) Snapshot() int {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	kv.rf.Snapshot(kv.lastApplied, kv.encodeSnapshot())
+	return kv.lastApplied
+}
+
+// the Raft the server replicates its Ops with. a server in its own
+// process serves it next to the KVServer, so the peers can reach it.
+func (kv *KVServer) Raft() *raft.Raft {
+	return kv.rf
+}
+
+func (kv *KVServer) killed() bool {
+	return atomic.LoadInt32(&kv.dead) == 1
+}
+
+//
+// servers[] contains the ports of the set of
+// servers that will cooperate via Raft to
+// form the fault-tolerant key/value service.
+// me is the index of the current server in servers[].
+// Raft saves its state and the snapshot in persister. the server asks
+// Raft for a snapshot once persister.RaftStateSize() reaches
+// maxraftstate, -1 means never.
+//
+func StartKVServer(servers []raft.Transport, me int, persister raft.Persister, maxraftstate int) (*KVServer, error) {
+	return StartKVServerWithConfig(servers, me, persister, maxraftstate, raft.DefaultConfig())
+}
+
+//
+// like StartKVServer(), with Raft made by raft.MakeWithConfig(conf).
+// the server always turns conf.NoOp on.
+//
+func StartKVServerWithConfig(servers []raft.Transport, me int, persister raft.Persister, maxraftstate int, conf raft.Config) (*KVServer, error) {
+	return startKVServer(servers, me, persister, maxraftstate, conf, false)
+}
+
+//
+// like StartKVServer(), for a server that joins a running cluster
+// through AddServer(), see raft.MakeJoining().
+//
+func StartJoiningKVServer(servers []raft.Transport, me int, persister raft.Persister, maxraftstate int) (*KVServer, error) {
+	return StartJoiningKVServerWithConfig(servers, me, persister, maxraftstate, raft.DefaultConfig())
+}
+
+//
+// like StartJoiningKVServer(), with Raft made by
+// raft.MakeJoiningWithConfig(conf).
+//
+func StartJoiningKVServerWithConfig(servers []raft.Transport, me int, persister raft.Persister, maxraftstate int, conf raft.Config) (*KVServer, error) {
+	return startKVServer(servers, me, persister, maxraftstate, conf, true)
+}
+
+func startKVServer(servers []raft.Transport, me int, persister raft.Persister, maxraftstate int, conf raft.Config, joining bool) (*KVServer, error) {
+	kv := &KVServer{}
+	kv.me = me
+	kv.maxraftstate = maxraftstate
+	kv.persister = persister
+	kv.data = make(map[string]string)
+	kv.sessions = make(map[int64]session)
+	kv.done = make(chan struct{})
+
+	kv.mu.Lock()
+	kv.readSnapshot(persister.ReadSnapshot())
+	kv.mu.Unlock()
+
+	kv.applyCh = make(chan raft.ApplyMsg)
+	// 新leader的no-op让ReadIndex不用等client写入
+	conf.NoOp = true
+	var rf *raft.Raft
+	var err error
+	if joining {
+		rf, err = raft.MakeJoiningWithConfig(servers, me, persister, kv.applyCh, conf)
+	} else {
+		rf, err = raft.MakeWithConfig(servers, me, persister, kv.applyCh, conf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	kv.rf = rf
+
+	go kv.applier()
+	return kv, nil
+}
@@ -9,19 +9,40 @@ package raft
 // test with the original before submitting.
 //
 
-import "sync"
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
 
-type Persister struct {
+//
+// where a Raft server saves its persistent state and the service's
+// snapshot. Make() accepts any implementation: MemoryPersister for
+// tests, FilePersister for servers that must survive a restart.
+//
+type Persister interface {
+	SaveRaftState(data []byte)
+	ReadRaftState() []byte
+	RaftStateSize() int
+	SaveSnapshot(snapshot []byte)
+	ReadSnapshot() []byte
+	SnapshotSize() int
+	Copy() Persister
+}
+
+type MemoryPersister struct {
 	mu        sync.Mutex
 	raftState []byte
 	snapshot  []byte
 }
 
-func MakePersister() *Persister {
-	return &Persister{}
+func MakePersister() *MemoryPersister {
+	return &MemoryPersister{}
 }
 
-func (ps *Persister) Copy() *Persister {
+func (ps *MemoryPersister) Copy() Persister {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	np := MakePersister()
@@ -30,38 +51,198 @@ func (ps *Persister) Copy() *Persister {
 	return np
 }
 
-func (ps *Persister) SaveRaftState(data []byte) {
+func (ps *MemoryPersister) SaveRaftState(data []byte) {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	ps.raftState = data
 }
 
-func (ps *Persister) ReadRaftState() []byte {
+func (ps *MemoryPersister) ReadRaftState() []byte {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	return ps.raftState
 }
 
-func (ps *Persister) RaftStateSize() int {
+func (ps *MemoryPersister) RaftStateSize() int {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	return len(ps.raftState)
 }
 
-func (ps *Persister) SaveSnapshot(snapshot []byte) {
+func (ps *MemoryPersister) SaveSnapshot(snapshot []byte) {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	ps.snapshot = snapshot
 }
 
-func (ps *Persister) ReadSnapshot() []byte {
+func (ps *MemoryPersister) ReadSnapshot() []byte {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	return ps.snapshot
 }
 
-func (ps *Persister) SnapshotSize() int {
+func (ps *MemoryPersister) SnapshotSize() int {
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	return len(ps.snapshot)
-}
\ No newline at end of file
+}
+
+const (
+	raftStateFile = "raftstate"
+	snapshotFile  = "snapshot"
+)
+
+//
+// a Persister that keeps Raft state and the snapshot in two files in
+// dir. every Save writes a temp file, fsyncs it, renames it over the
+// old file and fsyncs dir, so after a crash each file holds either
+// the old or the new contents, never a mix. reads are served from
+// memory. Raft can't go on if its state isn't durable, so a failed
+// Save is fatal. Raft's Kill() calls Close(), after which saves are
+// dropped, so a killed instance can't overwrite the files of the
+// instance that replaces it.
+//
+type FilePersister struct {
+	mu        sync.Mutex
+	dir       string
+	closed    bool
+	raftState []byte
+	snapshot  []byte
+	logger    Logger
+}
+
+//
+// open the persister in dir, creating dir if needed, and load
+// whatever state an earlier FilePersister saved there.
+//
+func MakeFilePersister(dir string) (*FilePersister, error) {
+	return MakeFilePersisterWithLogger(dir, logrusLogger{})
+}
+
+// like MakeFilePersister(), logging to logger, nil for no logging.
+func MakeFilePersisterWithLogger(dir string, logger Logger) (*FilePersister, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	ps := &FilePersister{dir: dir, logger: orNop(logger)}
+	var err error
+	if ps.raftState, err = readFileIfExists(filepath.Join(dir, raftStateFile)); err != nil {
+		return nil, err
+	}
+	if ps.snapshot, err = readFileIfExists(filepath.Join(dir, snapshotFile)); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+func readFileIfExists(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+//
+// Copy returns an in-memory copy of the saved state, the files
+// in dir keep belonging to ps.
+//
+func (ps *FilePersister) Copy() Persister {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	np := MakePersister()
+	np.raftState = ps.raftState
+	np.snapshot = ps.snapshot
+	return np
+}
+
+func (ps *FilePersister) SaveRaftState(data []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.closed {
+		return
+	}
+	if err := ps.writeFile(raftStateFile, data); err != nil {
+		fatalf(ps.logger, "FilePersister SaveRaftState: %v", err)
+	}
+	ps.raftState = data
+}
+
+func (ps *FilePersister) ReadRaftState() []byte {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.raftState
+}
+
+func (ps *FilePersister) RaftStateSize() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.raftState)
+}
+
+func (ps *FilePersister) SaveSnapshot(snapshot []byte) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.closed {
+		return
+	}
+	if err := ps.writeFile(snapshotFile, snapshot); err != nil {
+		fatalf(ps.logger, "FilePersister SaveSnapshot: %v", err)
+	}
+	ps.snapshot = snapshot
+}
+
+func (ps *FilePersister) ReadSnapshot() []byte {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.snapshot
+}
+
+func (ps *FilePersister) SnapshotSize() int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return len(ps.snapshot)
+}
+
+//
+// drop all later saves. waits for a save in progress to finish.
+//
+func (ps *FilePersister) Close() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.closed = true
+	return nil
+}
+
+// write-temp-then-rename, caller must hold ps.mu.
+func (ps *FilePersister) writeFile(name string, data []byte) error {
+	f, err := ioutil.TempFile(ps.dir, name+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(ps.dir, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// rename只有在目录fsync之后才是durable的
+	d, err := os.Open(ps.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("sync %v: %v", ps.dir, err)
+	}
+	return nil
+}
@@ -5,12 +5,22 @@ package raft
 // the service (or tester). see comments below for
 // each of these functions for more details.
 //
-// rf = Make(...)
+// rf, err = Make(...)
 //   create a new Raft server.
+// rf, err = MakeWithConfig(..., conf)
+//   create a new Raft server with the timing and settings in conf, see Config
 // rf.Start(command interface{}) (index, term, isleader)
 //   start agreement on a new Logs entry
 // rf.GetState() (term, isLeader)
 //   ask a Raft for its current term, and whether it thinks it is leader
+// rf.ReadIndex(ctx) (index, err)
+//   wait until it's safe to serve a linearizable read without a Logs entry
+// rf.TransferLeadership(target) err
+//   hand leadership over to another server
+// rf.AddServer(server)/rf.RemoveServer(server) (index, term, err)
+//   start a change of the cluster configuration, one server at a time
+// rf.ChangeServers(servers) (index, term, err)
+//   start a change to an arbitrary new configuration through joint consensus
 // ApplyMsg
 //   each time a new entry is committed to the Logs, each Raft peer
 //   should send an ApplyMsg to the service (or tester)
@@ -19,11 +29,11 @@ package raft
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
-	log "github.com/sirupsen/logrus"
-	"math/rand"
-	"raft/rpc_mock"
+	"io"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -38,19 +48,35 @@ import (
 type ApplyMsg struct {
 	Index       int
 	Command     interface{}
-	UseSnapshot bool   // ignore for lab2; only used in lab3
-	Snapshot    []byte // ignore for lab2; only used in lab3
+	UseSnapshot bool   // true if this msg carries a snapshot installed by the leader
+	Snapshot    []byte // service state up to and including Index, only valid if UseSnapshot
+	NoOp        bool   // true if this entry is a leader's no-op, Command is nil, see SetNoOp()
 }
 
+var (
+	ErrNotLeader          = errors.New("raft: not leader")
+	ErrNotMember          = errors.New("raft: server is not in the configuration")
+	ErrTransferInProgress = errors.New("raft: leadership transfer in progress")
+	ErrTransferFailed     = errors.New("raft: leadership transfer failed")
+	ErrShutdown           = errors.New("raft: server is shut down")
+	ErrBadCommand         = errors.New("raft: the Codec can't encode the command")
+	ErrBadServers         = errors.New("raft: invalid set of servers")
+	ErrChangePending      = errors.New("raft: the previous configuration change hasn't committed")
+	ErrNotReady           = errors.New("raft: the leader hasn't committed an entry of its term")
+)
+
 type Role uint32
 
 const (
 	Follower Role = iota
+	PreCandidate
 	Candidate
 	Leader
 	Shutdown
 
+	// milliseconds, the defaults of Config
 	HeartbeatInterval = 50
+	MinElectionTimeout = 300
 	VoteNull = -1
 )
 
@@ -60,6 +86,8 @@ func (s Role) debugString() string {
 	switch s {
 	case Follower:
 		return "follower"
+	case PreCandidate:
+		return "precandidate"
 	case Candidate:
 		return "candidate"
 	case Leader:
@@ -88,9 +116,13 @@ func intMax(a int, b int) int {
 type LogEntry struct {
 	Term    int
 	Index   int
-	Command interface{}
+	Command interface{} // ConfigChange, NoOp, or a command from Start() encoded by the Codec as []byte
 }
 
+// Command of the entry a new leader appends when no-op entries are
+// turned on, the service never sees it as a command.
+type NoOp struct{}
+
 type AppendEntries struct {
 	Term     int
 	LeaderId int
@@ -116,37 +148,220 @@ type AppendEntriesReply struct {
 	ConflictIndex int
 }
 
+//
+// a cluster configuration change, Servers is the complete new configuration.
+// it is replicated as a normal Logs entry, and also delivered to the service
+// through applyCh once committed.
+// OldServers is non-nil only for the joint configuration C_old,new, during
+// which elections and commitment need a majority of both Servers and OldServers.
+//
+type ConfigChange struct {
+	Servers    []int
+	OldServers []int
+}
+
+func (c ConfigChange) isJoint() bool {
+	return c.OldServers != nil
+}
+
+func (c ConfigChange) contains(server int) bool {
+	return containsServer(c.Servers, server) || containsServer(c.OldServers, server)
+}
+
+// every server in either configuration, without duplicates
+func (c ConfigChange) allServers() []int {
+	servers := make([]int, 0, len(c.Servers)+len(c.OldServers))
+	servers = append(servers, c.Servers...)
+	for _, s := range c.OldServers {
+		if !containsServer(c.Servers, s) {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+// granted中的server是否构成majority，joint configuration需要两边都是majority
+func (c ConfigChange) isQuorum(granted map[int]bool) bool {
+	if c.isJoint() && !isMajority(c.OldServers, granted) {
+		return false
+	}
+	return isMajority(c.Servers, granted)
+}
+
+// an error wrapping ErrBadServers unless servers can be a configuration:
+// at least one server, each one once, and each one in rf.peers.
+func (rf *Raft) validateServers(servers []int) error {
+	if len(servers) == 0 {
+		return fmt.Errorf("%w: no servers", ErrBadServers)
+	}
+	for i, s := range servers {
+		if s < 0 || s >= len(rf.peers) {
+			return fmt.Errorf("%w: no end point for server %v", ErrBadServers, s)
+		}
+		if containsServer(servers[:i], s) {
+			return fmt.Errorf("%w: server %v appears twice in %v", ErrBadServers, s, servers)
+		}
+	}
+	return nil
+}
+
+func containsServer(servers []int, server int) bool {
+	for _, s := range servers {
+		if s == server {
+			return true
+		}
+	}
+	return false
+}
+
+func isMajority(servers []int, granted map[int]bool) bool {
+	count := 0
+	for _, s := range servers {
+		if granted[s] {
+			count++
+		}
+	}
+	return count > len(servers) / 2
+}
+
+func init() {
+	// LogEntry.Command是interface{}，gob需要知道具体类型
+	gob.Register(ConfigChange{})
+	gob.Register(NoOp{})
+}
+
+type TimeoutNowArgs struct {
+	Term     int
+	LeaderId int
+}
+
+type TimeoutNowReply struct {
+	Term int
+}
+
+type InstallSnapshotArgs struct {
+	Term               int
+	LeaderId           int
+	LastIncludedIndex  int
+	LastIncludedTerm   int
+	LastIncludedConfig ConfigChange
+	Data               []byte
+}
+
+type InstallSnapshotReply struct {
+	Term int
+}
+
 //
 // A Go object implementing a single Raft peer.
 //
 type Raft struct {
-	mutex     sync.Mutex            // Lock to protect shared access to this peer's state
-	peers     []*rpc_mock.ClientEnd // RPC end points of all peers
-	persister *Persister            // Object to hold this peer's persisted state
-	me        int                   // this peer's index into peers[]
+	mutex     sync.Mutex  // Lock to protect shared access to this peer's state
+	peers     []Transport // RPC end points of all peers, indexed by server id
+	persister Persister   // Object to hold this peer's persisted state
+	storage   LogStorage  // persister, if it can save the Logs incrementally, else nil
+	me        int         // this peer's index into peers[]
 
 	// Your data here (2A, 2B, 2C).
 	// Look at the paper's Figure 2 for a description of what
 	// state a Raft server must maintain.
-	state             Role
-	heartbeatInterval time.Duration
-	electionTimeout   time.Duration
+	state              Role
+	heartbeatInterval  time.Duration
+	electionTimeoutMin time.Duration // see Config
+	electionTimeoutMax time.Duration
+	logger             Logger
+
+	// PreVote, see Ongaro's thesis 9.6
+	// 开启之后，follower election timeout时先进行不改变term的pre-vote，拿到majority才真正开始选举
+	preVote       bool
+	lastHeartbeat time.Time // last time this server heard from a current leader
+
+	// CheckQuorum, see Ongaro's thesis 6.2
+	// 开启之后，leader在election timeout内没有收到majority的回复就退位
+	checkQuorum bool
+	leaderSince time.Time
+	// send time of the latest RPC in this term that each peer replied to, only on leaders
+	// 用发送时间而不是收到回复的时间，lease才是安全的
+	lastContact map[int]time.Time
+
+	// lease read, see Ongaro's thesis 6.4.1
+	// 开启之后，follower在election timeout内收到过leader的消息就不会投票给别人，
+	// 所以leader在 election timeout - leaseDrift 内收到过majority的回复，就一定还是leader
+	leaseRead  bool
+	leaseDrift time.Duration // bound on clock drift between servers
+
+	// leadership transfer, see Ongaro's thesis 3.10
+	transferTarget     int       // server leadership is being handed to, VoteNull if none, only on leaders
+	transferStart      time.Time // only on leaders
+	leadershipTransfer bool      // the next election was started by TimeoutNow
+	// TimeoutNow发出去之后，target的选举不受follower的lease约束，
+	// 所以这个term里lease不再有效，only on leaders
+	leaseRevoked bool
+
+	// 开启之后，新leader立刻append一条当前term的no-op entry，
+	// 之前term的entries随它一起commit，不用等client调用Start()
+	noOp bool
+
+	codec Codec // see SetCodec()
+
+	futures map[int][]*Future // index => Propose()s waiting for it
+
+	// replication of the Logs, only on leaders, see replicator.go
+	replicators     map[int]*replicator
+	maxInflight     int
+	maxBatchEntries int
+	maxBatchBytes   int
 
 	CurrentTerm int // all servers persistent
 	VotedFor    int // all servers persistent
 	Logs        []LogEntry // all servers persistent
 
-	commitIndex int // all servers volatile
-	lastApplied int // all servers volatile
+	// log compaction, Logs[0]是snapshot中最后一条entry的哨兵
+	// 逻辑index i 对应 Logs[i - LastIncludedIndex]
+	LastIncludedIndex int // all servers persistent
+	LastIncludedTerm  int // all servers persistent
 
-	nextIndex  []int //only on leaders volatile
-	matchIndex []int //only on leaders volatile
+	// cluster membership, see extended paper 6
+	// 当前configuration是Logs中最后一条ConfigChange，不管它有没有commit
+	// Logs中没有ConfigChange的话，就是snapshot时的configuration LastIncludedConfig
+	// 所以configuration和Logs一起persist，不需要单独保存
+	LastIncludedConfig ConfigChange // all servers persistent
+	config             ConfigChange // all servers volatile
+	configIndex        int          // index of the entry config comes from, all servers volatile
 
-	applyCh        chan ApplyMsg
-	appendEntryCh  chan bool
-	grantVoteCh    chan bool
-	becomeLeaderCh chan bool
-	exitCh         chan bool
+	commitIndex int // all servers volatile
+	lastApplied int // all servers volatile, the applier sets it before sending on applyCh
+
+	// applier() sends committed entries on applyCh without holding rf.mutex
+	applyCond       *sync.Cond
+	pendingSnapshot *InstallSnapshotArgs // installed from the leader, not sent on applyCh yet
+
+	nextIndex  map[int]int //only on leaders volatile
+	matchIndex map[int]int //only on leaders volatile
+
+	applyCh           chan ApplyMsg
+	appendEntryCh     chan bool
+	grantVoteCh       chan bool
+	becomeCandidateCh chan bool
+	becomeLeaderCh    chan bool
+	dead              int32 // set by Kill()
+
+	// lifecycle, Kill() cancels ctx and waits for wg
+	// goroutines只能通过goFunc()启动，Kill()之后就不会再有新的
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	lifeMu   sync.Mutex
+	stopped  bool // set by Kill(), goFunc() refuses to start anything
+	done     chan struct{}
+	doneOnce sync.Once
+
+	// what storage holds, persist() only writes what changed since the last call
+	stableTerm          int
+	stableVotedFor      int
+	stableIncludedIndex int
+	stableLastIndex     int // last index in storage
+	stableIndex         int // storage and Logs agree up to here
 }
 
 func (entry LogEntry) debugString() string {
@@ -184,19 +399,59 @@ func (rf *Raft) persist() {
 	// rf.persister.SaveRaftState(data)
 	//DPrintf("persist:%v, %v, %v", rf.CurrentTerm, rf.VotedFor, rf.Logs)
 	// FIXME: need mutex ?
-	w := new(bytes.Buffer)
-	e := gob.NewEncoder(w)
-	e.Encode(rf.CurrentTerm)
-	e.Encode(rf.VotedFor)
-	e.Encode(rf.Logs)
-	data := w.Bytes()
+	// killed之后goroutine可能还在运行，不能再覆盖新instance的persisted state
+	if rf.killed() {
+		return
+	}
+	if rf.storage != nil {
+		rf.persistStorage()
+		return
+	}
+	data := encodeRaftState(raftState{
+		CurrentTerm:        rf.CurrentTerm,
+		VotedFor:           rf.VotedFor,
+		Logs:               rf.Logs,
+		LastIncludedIndex:  rf.LastIncludedIndex,
+		LastIncludedTerm:   rf.LastIncludedTerm,
+		LastIncludedConfig: rf.LastIncludedConfig,
+	})
 	rf.persister.SaveRaftState(data)
 }
 
+func (rf *Raft) persistStorage() {
+	if rf.LastIncludedIndex != rf.stableIncludedIndex {
+		rf.storage.CompactLogs(rf.LastIncludedIndex, rf.LastIncludedTerm, rf.LastIncludedConfig)
+		rf.stableIncludedIndex = rf.LastIncludedIndex
+	}
+	if rf.stableIndex < rf.stableLastIndex {
+		rf.storage.TruncateLogs(rf.stableIndex)
+		rf.stableLastIndex = rf.stableIndex
+	}
+	from := intMax(rf.stableLastIndex, rf.LastIncludedIndex) + 1
+	if from <= rf.getLastLogIndex() {
+		rf.storage.AppendLogs(rf.Logs[from-rf.LastIncludedIndex:])
+	}
+	rf.stableLastIndex = rf.getLastLogIndex()
+	rf.stableIndex = rf.stableLastIndex
+	// entries和vote都durable之后才能回复RPC，顺序无所谓
+	if rf.CurrentTerm != rf.stableTerm || rf.VotedFor != rf.stableVotedFor {
+		rf.storage.SaveHardState(rf.CurrentTerm, rf.VotedFor)
+		rf.stableTerm = rf.CurrentTerm
+		rf.stableVotedFor = rf.VotedFor
+	}
+}
+
+// 删掉index之后的entries，下一次persist()时写truncate record
+func (rf *Raft) truncateLogs(index int) {
+	rf.Logs = rf.Logs[0 : index-rf.LastIncludedIndex+1]
+	rf.stableIndex = intMin(rf.stableIndex, index)
+}
+
 //
-// restore previously persisted state.
+// restore previously persisted state. returns an error wrapping
+// ErrCorrupt if data isn't something persist() wrote.
 //
-func (rf *Raft) readPersist(data []byte) {
+func (rf *Raft) readPersist(data []byte) error {
 	// Your code here (2C).
 	// Example:
 	// r := bytes.NewBuffer(data)
@@ -206,16 +461,102 @@ func (rf *Raft) readPersist(data []byte) {
 	rf.mutex.Lock()
 	defer rf.mutex.Unlock()
 	if data == nil || len(data) < 1 { // bootstrap without any state?
-		return
+		return nil
 	}
-	r := bytes.NewBuffer(data)
-	d := gob.NewDecoder(r)
-	err := d.Decode(&rf.CurrentTerm)
-	err = d.Decode(&rf.VotedFor)
-	err = d.Decode(&rf.Logs)
+	st, err := decodeRaftState(data)
+	if err != nil {
+		return err
+	}
+	rf.CurrentTerm = st.CurrentTerm
+	rf.VotedFor = st.VotedFor
+	rf.Logs = st.Logs
+	rf.LastIncludedIndex = st.LastIncludedIndex
+	rf.LastIncludedTerm = st.LastIncludedTerm
+	// WALPersister.ReadRaftState()在没compact过的时候没有config，用Make()的
+	if len(st.LastIncludedConfig.Servers) > 0 {
+		rf.LastIncludedConfig = st.LastIncludedConfig
+	}
+	rf.updateConfig()
+	return nil
+}
+
+// the fields persist() encodes, Logs[0] is the sentinel.
+type raftState struct {
+	CurrentTerm        int
+	VotedFor           int
+	Logs               []LogEntry
+	LastIncludedIndex  int
+	LastIncludedTerm   int
+	LastIncludedConfig ConfigChange
+}
+
+// decode what persist() saved with SaveRaftState().
+func decodeRaftState(data []byte) (raftState, error) {
+	var st raftState
+	payload, err := decodeState(data)
 	if err != nil {
-		log.Fatal("gob.NewDecoder.Decode error")
+		return st, err
+	}
+	r := bytes.NewBuffer(payload)
+	d := gob.NewDecoder(r)
+	fields := []struct {
+		name string
+		ptr  interface{}
+	}{
+		{"CurrentTerm", &st.CurrentTerm},
+		{"VotedFor", &st.VotedFor},
+		{"Logs", &st.Logs},
+		{"LastIncludedIndex", &st.LastIncludedIndex},
+		{"LastIncludedTerm", &st.LastIncludedTerm},
+		{"LastIncludedConfig", &st.LastIncludedConfig},
+	}
+	for _, f := range fields {
+		if err := d.Decode(f.ptr); err != nil {
+			return st, fmt.Errorf("%w: decode %v: %v", ErrCorrupt, f.name, err)
+		}
+	}
+	if len(st.Logs) == 0 || st.Logs[0].Index != st.LastIncludedIndex {
+		return st, fmt.Errorf("%w: Logs don't start at LastIncludedIndex %v", ErrCorrupt, st.LastIncludedIndex)
+	}
+	return st, nil
+}
+
+// the inverse of decodeRaftState().
+func encodeRaftState(st raftState) []byte {
+	w := new(bytes.Buffer)
+	e := gob.NewEncoder(w)
+	e.Encode(st.CurrentTerm)
+	e.Encode(st.VotedFor)
+	e.Encode(st.Logs)
+	e.Encode(st.LastIncludedIndex)
+	e.Encode(st.LastIncludedTerm)
+	e.Encode(st.LastIncludedConfig)
+	return encodeState(w.Bytes())
+}
+
+//
+// restore the state a LogStorage recovered.
+//
+func (rf *Raft) readStorage() {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	st := rf.storage.ReadLogState()
+	rf.CurrentTerm = st.CurrentTerm
+	rf.VotedFor = st.VotedFor
+	rf.LastIncludedIndex = st.LastIncludedIndex
+	rf.LastIncludedTerm = st.LastIncludedTerm
+	if st.LastIncludedConfig != nil {
+		rf.LastIncludedConfig = *st.LastIncludedConfig
 	}
+	rf.Logs = []LogEntry{{Term: st.LastIncludedTerm, Index: st.LastIncludedIndex}}
+	rf.Logs = append(rf.Logs, st.Entries...)
+	rf.updateConfig()
+
+	rf.stableTerm = rf.CurrentTerm
+	rf.stableVotedFor = rf.VotedFor
+	rf.stableIncludedIndex = rf.LastIncludedIndex
+	rf.stableLastIndex = rf.getLastLogIndex()
+	rf.stableIndex = rf.stableLastIndex
 }
 
 //
@@ -229,6 +570,8 @@ type RequestVoteArgs struct {
 	// leader completeness check
 	LastLogIndex int
 	LastLogTerm  int
+	// election started by the leader through TimeoutNow, lease read不能拒绝投票
+	LeadershipTransfer bool
 }
 
 //
@@ -250,6 +593,14 @@ func (rf *Raft) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) {
 	defer rf.mutex.Unlock()
 	defer rf.persist()
 
+	// leader还活着的时候不能让别人当选，term也不能变(paper 6)：被移除的server收不到移除它的entry，
+	// 会一直发起选举。lease read也靠这个保证lease期间没有新leader
+	if !args.LeadershipTransfer && args.Term > rf.CurrentTerm && rf.heardFromLeader() {
+		reply.Term = rf.CurrentTerm
+		reply.VoteGranted = false
+		return
+	}
+
 	// all servers
 	if args.Term > rf.CurrentTerm {
 		rf.convertToFollower(args.Term)
@@ -262,19 +613,46 @@ func (rf *Raft) RequestVote(args RequestVoteArgs, reply *RequestVoteReply) {
 	// 所以 candidate 再次发送消息 requestVote
 	// leader选择的条件，参看 paper 5.1 5.2 5.4 slides 17
 	if args.Term >= rf.CurrentTerm && (rf.VotedFor == VoteNull || rf.VotedFor == args.CandidateId) &&
-		                           (args.LastLogTerm > rf.getLastLogTerm() ||
-		                           (args.LastLogTerm == rf.getLastLogTerm() && args.LastLogIndex >= rf.getLastLogIndex())) {
+		                           rf.isLogUpToDate(args.LastLogIndex, args.LastLogTerm) {
 		voteGranted = true
 		rf.VotedFor = args.CandidateId
 		rf.state = Follower
 		dropAndSet(rf.grantVoteCh)
-		log.Infof("%v vote %v my term:%d, vote term:%d", rf.me, args.CandidateId, rf.CurrentTerm, args.Term)
+		rf.logger.Infof("%v vote %v my term:%d, vote term:%d", rf.me, args.CandidateId, rf.CurrentTerm, args.Term)
 	}
 
 	reply.Term = rf.CurrentTerm
 	reply.VoteGranted = voteGranted
 }
 
+//
+// PreVote RPC handler, args.Term is the term the candidate would use
+// if it started a real election. a pre-vote changes neither CurrentTerm
+// nor VotedFor, so a server that can't win keeps its term and can't
+// force a healthy leader to step down when it comes back.
+//
+func (rf *Raft) RequestPreVote(args RequestVoteArgs, reply *RequestVoteReply) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	// 最近收到过leader的消息，说明leader还活着，不支持别人发起选举
+	reply.Term = rf.CurrentTerm
+	reply.VoteGranted = args.Term > rf.CurrentTerm && !rf.heardFromLeader() &&
+		rf.isLogUpToDate(args.LastLogIndex, args.LastLogTerm)
+	rf.logger.Infof("%v pre-vote %v granted:%v my term:%d, vote term:%d", rf.me, args.CandidateId, reply.VoteGranted, rf.CurrentTerm, args.Term)
+}
+
+func (rf *Raft) heardFromLeader() bool {
+	return rf.state == Leader ||
+		time.Since(rf.lastHeartbeat) < rf.electionTimeoutMin
+}
+
+// candidate的log至少和自己一样新，see paper 5.4.1
+func (rf *Raft) isLogUpToDate(lastLogIndex int, lastLogTerm int) bool {
+	return lastLogTerm > rf.getLastLogTerm() ||
+		(lastLogTerm == rf.getLastLogTerm() && lastLogIndex >= rf.getLastLogIndex())
+}
+
 func dropAndSet(ch chan bool) {
 	select {
 	case <- ch:
@@ -300,22 +678,32 @@ func (rf *Raft) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply)
 	// rf.convertToFollower(term int)是有参数的，本节点的CurrentTerm设置为args.Term了
 	if args.Term == rf.CurrentTerm {
 		rf.state = Follower
+		rf.lastHeartbeat = time.Now()
 		dropAndSet(rf.appendEntryCh)
 
+		if args.PrevLogIndex < rf.LastIncludedIndex {
+			// PrevLogIndex已经在snapshot里了，snapshot里的entry都是committed的，一定和leader一致
+			// 丢掉已经被snapshot覆盖的entries，从LastIncludedIndex开始做consistency check
+			skip := intMin(rf.LastIncludedIndex-args.PrevLogIndex, len(args.Entries))
+			args.Entries = args.Entries[skip:]
+			args.PrevLogIndex = rf.LastIncludedIndex
+			args.PrevLogTerm = rf.getLogTerm(rf.LastIncludedIndex)
+		}
+
 		if args.PrevLogIndex > rf.getLastLogIndex() {
 			// slides 22 页中 follower a的情况
 			// missing entry
-			conflictIndex = len(rf.Logs)
+			conflictIndex = rf.getLastLogIndex() + 1
 			conflictTerm = 0
 		} else {
 			// log consistency check
-			prevLogTerm := rf.Logs[args.PrevLogIndex].Term
+			prevLogTerm := rf.getLogTerm(args.PrevLogIndex)
 			if args.PrevLogTerm != prevLogTerm {
-				conflictTerm = rf.Logs[args.PrevLogIndex].Term
+				conflictTerm = prevLogTerm
 				// find first index of conflictTerm
 				// see Raft paper 5.3 最后3断
-				for i := 1; i < len(rf.Logs); i++ {
-					if rf.Logs[i].Term == conflictTerm {
+				for i := rf.LastIncludedIndex + 1; i <= rf.getLastLogIndex(); i++ {
+					if rf.getLogTerm(i) == conflictTerm {
 						conflictIndex = i
 						break
 					}
@@ -333,19 +721,22 @@ func (rf *Raft) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply)
 						break
 					}
 
-					if rf.Logs[index].Term != args.Entries[i].Term {
-						log.Infof("Term not equal, Server(%v=>%v), prevIndex=%v, index=%v", args.LeaderId, rf.me, args.PrevLogIndex, index)
-						for len(rf.Logs) > index {
-							rf.Logs = rf.Logs[0 : len(rf.Logs)-1]
-						}
+					if rf.getLogTerm(index) != args.Entries[i].Term {
+						rf.logger.Infof("Term not equal, Server(%v=>%v), prevIndex=%v, index=%v", args.LeaderId, rf.me, args.PrevLogIndex, index)
+						rf.truncateLogs(index - 1)
 						rf.Logs = append(rf.Logs, args.Entries[i])
 					}
 				}
+				if len(args.Entries) > 0 {
+					// 新的ConfigChange一append就生效，truncate掉的ConfigChange也要回退
+					rf.updateConfig()
+				}
 
-				log.Infof("Server(%v=>%v) term:%v, Handle AppendEntries Success", args.LeaderId, rf.me, rf.CurrentTerm)
+				rf.logger.Infof("Server(%v=>%v) term:%v, Handle AppendEntries Success", args.LeaderId, rf.me, rf.CurrentTerm)
 				// AppendEntries 5, 设置commitIndex为LeaderCommit和最后一个New Entry的较小值。
-				if args.LeaderCommit > rf.commitIndex {
-					rf.commitIndex = intMin(args.LeaderCommit, rf.getLastLogIndex())
+				// 不能用getLastLogIndex()，PrevLogIndex之后可能还有没被truncate的旧entries
+				if newCommit := intMin(args.LeaderCommit, args.PrevLogIndex+len(args.Entries)); newCommit > rf.commitIndex {
+					rf.commitIndex = newCommit
 				}
 			}
 		}
@@ -360,6 +751,66 @@ func (rf *Raft) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply)
 	return
 }
 
+//
+// leader把自己的snapshot发给落后太多的follower，follower需要的entries已经被leader compact掉了
+// see extended paper 7 Figure 13
+//
+func (rf *Raft) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if args.Term > rf.CurrentTerm {
+		rf.convertToFollower(args.Term)
+	}
+	reply.Term = rf.CurrentTerm
+	if args.Term < rf.CurrentTerm {
+		return
+	}
+
+	rf.state = Follower
+	rf.lastHeartbeat = time.Now()
+	dropAndSet(rf.appendEntryCh)
+
+	// 已经committed的entries不需要snapshot，过期或者重复的snapshot直接忽略
+	if args.LastIncludedIndex <= rf.commitIndex {
+		return
+	}
+
+	rf.logger.Infof("Server(%v=>%v) InstallSnapshot, lastIncludedIndex(%v => %v)", args.LeaderId, rf.me, rf.LastIncludedIndex, args.LastIncludedIndex)
+	// 如果follower有和snapshot最后一条entry一致的entry，保留其后的entries，否则丢弃整个log
+	rf.compactLogs(args.LastIncludedIndex, args.LastIncludedTerm, args.LastIncludedConfig)
+	rf.saveSnapshot(args.Data)
+	rf.persist()
+
+	// applier先发送snapshot，再发送它之后的entries
+	rf.commitIndex = args.LastIncludedIndex
+	rf.pendingSnapshot = &args
+	rf.applyCond.Signal()
+}
+
+//
+// the leader is handing leadership over to this server, and has made
+// sure its Logs are up to date. start an election right away instead
+// of waiting for the election timeout, skipping PreVote.
+//
+func (rf *Raft) TimeoutNow(args TimeoutNowArgs, reply *TimeoutNowReply) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if args.Term > rf.CurrentTerm {
+		rf.convertToFollower(args.Term)
+	}
+	reply.Term = rf.CurrentTerm
+	if args.Term < rf.CurrentTerm || rf.state == Leader || !rf.config.contains(rf.me) {
+		return
+	}
+
+	rf.logger.Infof("Server(%v=>%v) TimeoutNow, term:%v", args.LeaderId, rf.me, rf.CurrentTerm)
+	rf.leadershipTransfer = true
+	rf.convertToCandidate()
+	dropAndSet(rf.becomeCandidateCh)
+}
+
 //
 // example code to send a RequestVote RPC to a server.
 // server is the index of the target server in rf.peers[].
@@ -390,15 +841,72 @@ func (rf *Raft) AppendEntries(args AppendEntriesArgs, reply *AppendEntriesReply)
 // the struct itself.
 //
 func (rf *Raft) sendRequestVote(server int, args RequestVoteArgs, reply *RequestVoteReply) bool {
-	ok := rf.peers[server].Call("Raft.RequestVote", args, reply)
+	ok := rf.call(server, "Raft.RequestVote", args, reply)
+	return ok
+}
+
+func (rf *Raft) sendRequestPreVote(server int, args RequestVoteArgs, reply *RequestVoteReply) bool {
+	ok := rf.call(server, "Raft.RequestPreVote", args, reply)
+	return ok
+}
+
+func (rf *Raft) sendTimeoutNow(server int, args TimeoutNowArgs, reply *TimeoutNowReply) bool {
+	ok := rf.call(server, "Raft.TimeoutNow", args, reply)
 	return ok
 }
 
 func (rf *Raft) sendAppendEntries(server int, args AppendEntriesArgs, reply *AppendEntriesReply) bool {
-	ok := rf.peers[server].Call("Raft.AppendEntries", args, reply)
+	ok := rf.call(server, "Raft.AppendEntries", args, reply)
+	return ok
+}
+
+func (rf *Raft) sendInstallSnapshot(server int, args InstallSnapshotArgs, reply *InstallSnapshotReply) bool {
+	ok := rf.call(server, "Raft.InstallSnapshot", args, reply)
 	return ok
 }
 
+// 调用时不能持有rf.mutex，ConnectPeer()可能会修改rf.peers
+func (rf *Raft) call(server int, svcMeth string, args interface{}, reply interface{}) bool {
+	rf.mutex.Lock()
+	var end Transport
+	if server >= 0 && server < len(rf.peers) {
+		end = rf.peers[server]
+	}
+	rf.mutex.Unlock()
+	if end == nil {
+		return false
+	}
+	// Kill()不能等RPC返回，labrpc和TCP都可能很久才超时
+	// 已经发出的RPC在后台完成，它的reply不会再被读取
+	result := make(chan bool, 1)
+	go callEnd(end, svcMeth, args, reply, result)
+	select {
+	case ok := <-result:
+		return ok
+	case <-rf.ctx.Done():
+		return false
+	}
+}
+
+// doesn't touch rf, so it may outlive a killed Raft. the only goroutine
+// not started through goFunc(), see Done().
+func callEnd(end Transport, svcMeth string, args interface{}, reply interface{}, result chan bool) {
+	result <- end.Call(svcMeth, args, reply)
+}
+
+//
+// give this server an RPC end point for a server that was not in
+// peers[] when it was created, e.g. before adding it with AddServer().
+//
+func (rf *Raft) ConnectPeer(server int, end Transport) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	for len(rf.peers) <= server {
+		rf.peers = append(rf.peers, nil)
+	}
+	rf.peers[server] = end
+}
+
 //
 // the service using Raft (e.g. a k/v server) wants to start
 // agreement on the next command to be appended to Raft's Logs. if this
@@ -410,170 +918,870 @@ func (rf *Raft) sendAppendEntries(server int, args AppendEntriesArgs, reply *App
 // the first return value is the index that the command will appear at
 // if it's ever committed. the second return value is the current
 // term. the third return value is true if this server believes it is
-// the leader.
+// the leader, and isn't handing leadership over to another server.
+//
+// if the Codec can't encode command, Start() logs it and returns
+// false as well. Propose() returns the error instead.
 //
 func (rf *Raft) Start(command interface{}) (int, int, bool) {
 	// Your code here (2B).
 	rf.mutex.Lock()
 	defer rf.mutex.Unlock()
+	index, term, err := rf.appendCommand(command)
+	if errors.Is(err, ErrBadCommand) {
+		rf.logger.Infof("Server(%v) Start: %v", rf.me, err)
+	}
+	return index, term, err == nil
+}
 
+// Start() with rf.mutex held. returns ErrNotLeader, or an error
+// wrapping ErrBadCommand if the Codec can't encode command.
+func (rf *Raft) appendCommand(command interface{}) (int, int, error) {
 	term := rf.CurrentTerm
-	index := -1
-	isLeader := rf.state == Leader
-
-	if isLeader {
-		index = rf.getLastLogIndex() + 1
-		entry := LogEntry{
-			Term:    term,
-			Index:   index,
-			Command: command,
-		}
-
-		//注意append entry必须与index设置在一个加锁位置，如果推迟append，会导致concurrent start失败。
-		rf.Logs = append(rf.Logs, entry)
-		rf.persist()
+	// leadership transfer期间不接受新的command，否则target可能永远追不上
+	if rf.state != Leader || rf.transferTarget != VoteNull {
+		return -1, term, ErrNotLeader
+	}
+	data, err := rf.codec.Marshal(command)
+	if err != nil {
+		return -1, term, fmt.Errorf("%w: %v: %v", ErrBadCommand, command, err)
+	}
+	index := rf.getLastLogIndex() + 1
+	entry := LogEntry{
+		Term:    term,
+		Index:   index,
+		Command: data,
 	}
 
-	return index, term, isLeader
+	//注意append entry必须与index设置在一个加锁位置，如果推迟append，会导致concurrent start失败。
+	rf.Logs = append(rf.Logs, entry)
+	rf.persist()
+	rf.triggerReplicators()
+	return index, term, nil
 }
 
-/**
-If there exists an N such that N > commitIndex, a majority
-of matchIndex[i] ≥ N, and Logs[N].term == CurrentTerm:
-set commitIndex = N
-*/
-
-/*
- entry commitment rule
-1. the entry must be stored on a majority of servers
-2. At least one new entry from the leader's term must also be stored on majority of servers(this need a sentinel value)
-*/
-
-func (rf *Raft) advanceCommitIndex() {
-	matchIndexes := make([]int, len(rf.matchIndex))
-	copy(matchIndexes, rf.matchIndex)
-	matchIndexes[rf.me] = len(rf.Logs) - 1
-	sort.Ints(matchIndexes)
+//
+// the service wants to do a linearizable read without appending to the
+// Logs (ReadIndex, see Ongaro's thesis 6.4). ReadIndex records commitIndex,
+// confirms with a heartbeat round (or a valid lease, see LeaseValid())
+// that this server is still the leader, and returns once the applier
+// has taken everything up to that index to send on applyCh.
+// the service can then serve the read from its state machine once it
+// has applied the returned index.
+// returns ErrNotLeader if this server isn't (or stops being) the leader,
+// ErrShutdown if it's killed, or ctx.Err() if ctx is done first.
+// a new leader can't serve reads until an entry of its term commits. with
+// no-op entries on (see SetNoOp()) ReadIndex waits for that; with them off
+// it might wait until the next Start(), so it returns ErrNotReady instead,
+// and the service can write the read through the Logs.
+//
+func (rf *Raft) ReadIndex(ctx context.Context) (int, error) {
+	// 新leader在commit一条自己term的entry之前，不知道哪些entries已经commit了
+	var term, readIndex int
+	for {
+		rf.mutex.Lock()
+		if rf.killed() {
+			rf.mutex.Unlock()
+			return -1, ErrShutdown
+		}
+		if rf.state != Leader {
+			rf.mutex.Unlock()
+			return -1, ErrNotLeader
+		}
+		term = rf.CurrentTerm
+		readIndex = rf.commitIndex
+		ready := rf.getLogTerm(readIndex) == term
+		noOp := rf.noOp
+		rf.mutex.Unlock()
+		if ready {
+			break
+		}
+		// 没有no-op的话不知道什么时候才有Start()
+		if !noOp {
+			return -1, ErrNotReady
+		}
+		if err := rf.sleepContext(ctx, rf.heartbeatInterval); err != nil {
+			return -1, err
+		}
+	}
 
-	N := matchIndexes[len(rf.peers) / 2]
-	log.Infof("matchIndexes:%v, N:%v", matchIndexes, N)
+	rf.mutex.Lock()
+	leaseValid := rf.checkState(Leader, term) && rf.leaseValid()
+	rf.mutex.Unlock()
+	if !leaseValid {
+		if err := rf.confirmLeadership(ctx, term); err != nil {
+			return -1, err
+		}
+	}
 
-	if rf.state == Leader && N > rf.commitIndex && rf.Logs[N].Term == rf.CurrentTerm {
-		log.Infof("Server(%v) advanceCommitIndex (%v => %v)", rf.me, rf.commitIndex, N)
-		rf.commitIndex = N
-		rf.applyLogs()
+	for {
+		rf.mutex.Lock()
+		applied := rf.lastApplied >= readIndex
+		rf.mutex.Unlock()
+		if applied {
+			return readIndex, nil
+		}
+		if err := rf.sleepContext(ctx, 10 * time.Millisecond); err != nil {
+			return -1, err
+		}
 	}
 }
 
-func (rf *Raft) startAppendEntries() {
-	for i := 0; i < len(rf.peers); i++ {
-		if i == rf.me {
+// 发一轮heartbeat，majority回复了同一个term，说明在term中自己仍然是leader
+func (rf *Raft) confirmLeadership(ctx context.Context, term int) error {
+	rf.mutex.Lock()
+	if !rf.checkState(Leader, term) {
+		rf.mutex.Unlock()
+		return ErrNotLeader
+	}
+	config := rf.config
+	ackCh := make(chan int, len(config.allServers()))
+	for _, server := range config.allServers() {
+		if server == rf.me {
 			continue
 		}
-
-		go func(serverIndex int) {
-			for {
+		// 只是heartbeat，PrevLogIndex不能落在snapshot之前
+		prevLogIndex := intMax(rf.getPrevLogIndex(server), rf.LastIncludedIndex)
+		args := AppendEntriesArgs{
+			Term:         term,
+			LeaderId:     rf.me,
+			PrevLogIndex: prevLogIndex,
+			PrevLogTerm:  rf.getLogTerm(prevLogIndex),
+			Entries:      []LogEntry{},
+			LeaderCommit: rf.commitIndex,
+		}
+		server := server
+		started := rf.goFunc(func() {
+			reply := &AppendEntriesReply{}
+			sendTime := time.Now()
+			// 不管log是否一致，follower回复同一个term就说明它承认这个leader
+			if rf.sendAppendEntries(server, args, reply) && reply.Term == term {
 				rf.mutex.Lock()
-				if rf.state != Leader {
-					rf.mutex.Unlock()
-					return
-				}
-
-				nextIndex := rf.nextIndex[serverIndex]
-				entries := make([]LogEntry, 0)
-				entries = append(entries, rf.Logs[nextIndex:]...)
-				args := AppendEntriesArgs {
-					Term:         rf.CurrentTerm,
-					LeaderId:     rf.me,
-					PrevLogIndex: rf.getPrevLogIndex(serverIndex),
-					PrevLogTerm:  rf.getPrevLogTerm(serverIndex),
-					Entries:      entries,
-					LeaderCommit: rf.commitIndex,
+				if rf.checkState(Leader, term) {
+					rf.updateLastContact(server, sendTime)
 				}
 				rf.mutex.Unlock()
-				reply := &AppendEntriesReply{}
-				ok := rf.sendAppendEntries(serverIndex, args, reply)
-				log.Infof("SendAppendEntries (%v=>%v), args:%v", rf.me, serverIndex, args)
-				if !ok {
-					return
-				}
-				rf.mutex.Lock()
-				if reply.Term > rf.CurrentTerm {
-					rf.convertToFollower(reply.Term)
-					rf.mutex.Unlock()
-					return
-				}
-				if !rf.checkState(Leader, args.Term) {
-					rf.mutex.Unlock()
-					return
-				}
-				if reply.Success {
-					// AppendEntries成功，更新对应raft实例的nextIndex和matchIndex值, Leader 5.3
-					rf.matchIndex[serverIndex] = args.PrevLogIndex + len(args.Entries)
-					rf.nextIndex[serverIndex] = rf.matchIndex[serverIndex] + 1
-					log.Infof("SendAppendEntries Success(%v => %v), nextIndex:%v, matchIndex:%v", rf.me, serverIndex, rf.nextIndex, rf.matchIndex)
-					rf.advanceCommitIndex()
-					rf.mutex.Unlock()
-					return
-				} else {
-					// AppendEntries失败，减小对应raft实例的nextIndex的值重试 paper 5.3
-					// 这里要注意理解conflictIndex,conflictTerm在减少重试次数方面起的作用
-					newIndex := reply.ConflictIndex
-					for i := 1; i < len(rf.Logs); i++ {
-						entry := rf.Logs[i]
-						if entry.Term == reply.ConflictTerm {
-							newIndex = i + 1
-						}
-					}
-					rf.nextIndex[serverIndex] = intMax(1, newIndex)
-					log.Infof("SendAppendEntries failed(%v => %v), decrease nextIndex(%v):%v", rf.me, serverIndex, serverIndex, rf.nextIndex)
-					rf.mutex.Unlock()
-				}
+				ackCh <- server
+			} else {
+				ackCh <- VoteNull
 			}
-		} (i)
+		})
+		if !started {
+			ackCh <- VoteNull
+		}
 	}
-}
+	rf.mutex.Unlock()
 
-// 将msg放入applyCh即是将command 给state machine执行
-func (rf *Raft) applyLogs() {
-	//注意这里的for循环，如果写成if那就错了，会无法通过lab-2B的测试。
-	for rf.commitIndex > rf.lastApplied {
-		log.Infof("Server(%v) applyLogs, commitIndex:%v, lastApplied:%v, command:%v", rf.me, rf.commitIndex, rf.lastApplied, rf.Logs[rf.lastApplied].Command)
-		rf.lastApplied++
-		entry := rf.Logs[rf.lastApplied]
-		msg := ApplyMsg{
-			Index:   entry.Index,
-			Command: entry.Command,
+	acks := map[int]bool{rf.me: true}
+	for pending := len(config.allServers()) - 1; !config.isQuorum(acks); pending-- {
+		if pending == 0 {
+			return ErrNotLeader
+		}
+		select {
+		case server := <-ackCh:
+			if server != VoteNull {
+				acks[server] = true
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-rf.ctx.Done():
+			return ErrShutdown
 		}
-		rf.applyCh <- msg //applyCh在test_test.go中要用到
 	}
-}
-
-//
-// the tester calls Kill() when a Raft instance won't
-// be needed again. you are not required to do anything
-// in Kill(), but it might be convenient to (for example)
-// turn off debug output from this instance.
-//
-func (rf *Raft) Kill() {
-	// Your code here, if desired.
-	log.Infof("Kill Server(%v)", rf.me)
-	dropAndSet(rf.exitCh)
-}
 
-func getRandomElectionTimeout() time.Duration {
-	randomTimeout := 300 + rand.Intn(100)
-	electionTimeout := time.Duration(randomTimeout) * time.Millisecond
-	return electionTimeout
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if !rf.checkState(Leader, term) {
+		return ErrNotLeader
+	}
+	return nil
 }
 
-func (rf *Raft) convertToCandidate() {
-	defer rf.persist()
-	log.Infof("Convert server(%v) state(%v=>candidate) term(%v)", rf.me,
-		rf.state.debugString(), rf.CurrentTerm+1)
-	rf.state = Candidate
-	rf.CurrentTerm++
-	rf.VotedFor = rf.me
+func (rf *Raft) sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-rf.ctx.Done():
+		return ErrShutdown
+	}
+}
+
+//
+// the service wants this leader to hand leadership over to target, e.g.
+// before restarting it. the leader stops accepting Start(), waits until
+// target's Logs match its own, then tells target to start an election
+// right away with a TimeoutNow RPC. returns nil once target got the
+// TimeoutNow, the election itself happens shortly after. if target
+// hasn't taken over within an election timeout, this leader goes
+// back to accepting Start().
+//
+func (rf *Raft) TransferLeadership(target int) error {
+	rf.mutex.Lock()
+	if rf.state != Leader {
+		rf.mutex.Unlock()
+		return ErrNotLeader
+	}
+	if target == rf.me {
+		rf.mutex.Unlock()
+		return nil
+	}
+	if !containsServer(rf.config.Servers, target) {
+		rf.mutex.Unlock()
+		return ErrNotMember
+	}
+	if rf.transferTarget != VoteNull {
+		rf.mutex.Unlock()
+		return ErrTransferInProgress
+	}
+	rf.logger.Infof("Server(%v) TransferLeadership to %v, term:%v", rf.me, target, rf.CurrentTerm)
+	term := rf.CurrentTerm
+	rf.transferTarget = target
+	rf.transferStart = time.Now()
+	rf.mutex.Unlock()
+
+	// 等heartbeat把target的log补齐
+	for {
+		rf.mutex.Lock()
+		if !rf.checkState(Leader, term) {
+			rf.mutex.Unlock()
+			return ErrNotLeader
+		}
+		if rf.transferTarget != target {
+			rf.mutex.Unlock()
+			return ErrTransferFailed
+		}
+		upToDate := rf.matchIndex[target] == rf.getLastLogIndex()
+		if upToDate {
+			rf.leaseRevoked = true
+		}
+		rf.mutex.Unlock()
+		if upToDate {
+			break
+		}
+		if err := rf.sleepContext(context.Background(), 10 * time.Millisecond); err != nil {
+			return err
+		}
+	}
+
+	args := TimeoutNowArgs{
+		Term:     term,
+		LeaderId: rf.me,
+	}
+	reply := &TimeoutNowReply{}
+	ok := rf.sendTimeoutNow(target, args, reply)
+
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if !ok {
+		if rf.transferTarget == target {
+			rf.transferTarget = VoteNull
+		}
+		return ErrTransferFailed
+	}
+	if reply.Term > rf.CurrentTerm {
+		rf.convertToFollower(reply.Term)
+	}
+	return nil
+}
+
+// target在election timeout内没有当选，放弃leadership transfer，继续接受Start()
+func (rf *Raft) abortTransferIfTimeout() {
+	timeout := rf.electionTimeoutMin
+	if rf.transferTarget != VoteNull && time.Since(rf.transferStart) > timeout {
+		rf.logger.Infof("Server(%v) TransferLeadership to %v timeout", rf.me, rf.transferTarget)
+		rf.transferTarget = VoteNull
+	}
+}
+
+//
+// the service wants to add server to the cluster. like Start(), this only
+// works on the leader and returns immediately, the returned index is where
+// the ConfigChange entry will appear if it's ever committed.
+// the error is ErrNotLeader, one wrapping ErrBadServers if server is
+// already a member or has no end point in peers[] (see ConnectPeer()),
+// ErrChangePending if the previous change (or an
+// entry of the leader's term) hasn't committed yet, or
+// ErrTransferInProgress.
+//
+func (rf *Raft) AddServer(server int) (int, int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if rf.state != Leader {
+		return -1, rf.CurrentTerm, ErrNotLeader
+	}
+	if rf.config.contains(server) {
+		return -1, rf.CurrentTerm, fmt.Errorf("%w: server %v is already a member", ErrBadServers, server)
+	}
+	servers := make([]int, 0, len(rf.config.Servers)+1)
+	servers = append(servers, rf.config.Servers...)
+	servers = append(servers, server)
+	if err := rf.validateServers(servers); err != nil {
+		return -1, rf.CurrentTerm, err
+	}
+	return rf.startConfigChange(ConfigChange{Servers: servers})
+}
+
+//
+// the service wants to remove server from the cluster, see AddServer().
+// a leader that removes itself keeps managing the cluster until the
+// change commits, then steps down. the error is ErrNotMember if server
+// isn't a member, and wraps ErrBadServers if it's the only one.
+//
+func (rf *Raft) RemoveServer(server int) (int, int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if rf.state != Leader {
+		return -1, rf.CurrentTerm, ErrNotLeader
+	}
+	if !containsServer(rf.config.Servers, server) {
+		return -1, rf.CurrentTerm, ErrNotMember
+	}
+	servers := make([]int, 0, len(rf.config.Servers)-1)
+	for _, s := range rf.config.Servers {
+		if s != server {
+			servers = append(servers, s)
+		}
+	}
+	if err := rf.validateServers(servers); err != nil {
+		return -1, rf.CurrentTerm, err
+	}
+	return rf.startConfigChange(ConfigChange{Servers: servers})
+}
+
+//
+// the service wants to replace the whole configuration with servers,
+// e.g. to move several replicas at once. the leader first appends the
+// joint configuration C_old,new, and once that commits, appends C_new
+// by itself (extended paper 6). the returned index is that of C_old,new,
+// see AddServer(). the error wraps ErrBadServers if servers is empty
+// or holds a server twice.
+//
+func (rf *Raft) ChangeServers(servers []int) (int, int, error) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	if err := rf.validateServers(servers); err != nil {
+		return -1, rf.CurrentTerm, err
+	}
+	newServers := make([]int, len(servers))
+	copy(newServers, servers)
+	return rf.startConfigChange(ConfigChange{Servers: newServers, OldServers: rf.config.Servers})
+}
+
+func (rf *Raft) startConfigChange(config ConfigChange) (int, int, error) {
+	term := rf.CurrentTerm
+	if rf.state != Leader {
+		return -1, term, ErrNotLeader
+	}
+	// 一次只能有一个configuration change，上一个ConfigChange必须已经commit了，C_old,new之后的C_new也不例外
+	// 另外leader必须已经commit过一条自己term的entry，否则和上一任leader未commit的change可能形成两个不相交的majority
+	if rf.config.isJoint() || rf.configIndex > rf.commitIndex || rf.getLogTerm(rf.commitIndex) != term {
+		return -1, term, ErrChangePending
+	}
+	if rf.transferTarget != VoteNull {
+		return -1, term, ErrTransferInProgress
+	}
+	return rf.appendConfigChange(config), term, nil
+}
+
+func (rf *Raft) appendConfigChange(config ConfigChange) int {
+	index := rf.getLastLogIndex() + 1
+	entry := LogEntry{
+		Term:    rf.CurrentTerm,
+		Index:   index,
+		Command: config,
+	}
+	rf.logger.Infof("Server(%v) appendConfigChange, config(%v => %v) index:%v", rf.me, rf.config, config, index)
+	rf.Logs = append(rf.Logs, entry)
+	// 新configuration在append之后立刻生效
+	rf.config = config
+	rf.configIndex = index
+	for _, s := range config.allServers() {
+		if _, ok := rf.nextIndex[s]; !ok {
+			rf.nextIndex[s] = index
+			rf.matchIndex[s] = 0
+		}
+	}
+	rf.persist()
+	// 新加入的server也需要replicator
+	rf.startReplicators()
+	rf.triggerReplicators()
+	return index
+}
+
+/**
+If there exists an N such that N > commitIndex, a majority
+of matchIndex[i] ≥ N, and Logs[N].term == CurrentTerm:
+set commitIndex = N
+*/
+
+/*
+ entry commitment rule
+1. the entry must be stored on a majority of servers
+2. At least one new entry from the leader's term must also be stored on majority of servers(this need a sentinel value)
+*/
+
+func (rf *Raft) advanceCommitIndex() {
+	// joint configuration要求新旧两个configuration都是majority
+	N := rf.majorityMatchIndex(rf.config.Servers)
+	if rf.config.isJoint() {
+		N = intMin(N, rf.majorityMatchIndex(rf.config.OldServers))
+	}
+	rf.logger.Infof("matchIndex:%v, N:%v", rf.matchIndex, N)
+
+	if rf.state == Leader && N > rf.commitIndex && rf.getLogTerm(N) == rf.CurrentTerm {
+		rf.logger.Infof("Server(%v) advanceCommitIndex (%v => %v)", rf.me, rf.commitIndex, N)
+		rf.commitIndex = N
+		rf.applyLogs()
+
+		if rf.configIndex <= rf.commitIndex && rf.config.isJoint() {
+			// C_old,new已经commit了，接着append C_new
+			rf.appendConfigChange(ConfigChange{Servers: rf.config.Servers})
+		} else if rf.configIndex <= rf.commitIndex && !rf.config.contains(rf.me) {
+			// 把自己移除的configuration已经commit了，leader退位
+			// 这里不能用convertToFollower，同一个term里VotedFor不能清空
+			rf.logger.Infof("Server(%v) removed from cluster, step down", rf.me)
+			rf.state = Follower
+		}
+	}
+}
+
+// servers中至少有majority个server的matchIndex >= N，返回最大的N
+// 正在移除自己的leader不在servers里，不算在majority里
+func (rf *Raft) majorityMatchIndex(servers []int) int {
+	matchIndexes := make([]int, 0, len(servers))
+	for _, server := range servers {
+		if server == rf.me {
+			matchIndexes = append(matchIndexes, rf.getLastLogIndex())
+		} else {
+			matchIndexes = append(matchIndexes, rf.matchIndex[server])
+		}
+	}
+	sort.Ints(matchIndexes)
+	return matchIndexes[(len(matchIndexes) - 1) / 2]
+}
+
+// commitIndex前进了，唤醒applier把新commit的entries放入applyCh
+func (rf *Raft) applyLogs() {
+	rf.applyCond.Signal()
+}
+
+//
+// sends the committed entries, and snapshots installed from the
+// leader, on applyCh in order. it doesn't hold rf.mutex while sending,
+// so a slow service doesn't hold up RPCs, elections and heartbeats.
+//
+func (rf *Raft) applier() {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	for !rf.killed() {
+		if args := rf.pendingSnapshot; args != nil {
+			rf.pendingSnapshot = nil
+			rf.lastApplied = args.LastIncludedIndex
+			msg := ApplyMsg{
+				Index:       args.LastIncludedIndex,
+				UseSnapshot: true,
+				Snapshot:    args.Data,
+			}
+			rf.mutex.Unlock()
+			if !rf.sendApplyMsg(msg) {
+				rf.mutex.Lock()
+				return
+			}
+			rf.mutex.Lock()
+			rf.resolveCompacted(args.LastIncludedIndex, args.LastIncludedTerm)
+			continue
+		}
+		if rf.commitIndex <= rf.lastApplied {
+			rf.applyCond.Wait()
+			continue
+		}
+
+		// 先更新lastApplied，service收到entry后就可以调用Snapshot()
+		msgs, terms := rf.committedMsgs()
+		rf.lastApplied = rf.commitIndex
+		rf.mutex.Unlock()
+		for _, msg := range msgs {
+			//applyCh在test_test.go中要用到
+			if !rf.sendApplyMsg(msg) {
+				rf.mutex.Lock()
+				return
+			}
+		}
+		rf.mutex.Lock()
+		for i, msg := range msgs {
+			rf.resolveFutures(msg, terms[i])
+		}
+	}
+}
+
+// false if the Raft was killed before the service took msg.
+func (rf *Raft) sendApplyMsg(msg ApplyMsg) bool {
+	select {
+	case rf.applyCh <- msg:
+		return true
+	case <-rf.ctx.Done():
+		return false
+	}
+}
+
+// ApplyMsgs and terms of the entries after lastApplied up to commitIndex.
+// caller must hold rf.mutex.
+func (rf *Raft) committedMsgs() ([]ApplyMsg, []int) {
+	msgs := make([]ApplyMsg, 0, rf.commitIndex-rf.lastApplied)
+	terms := make([]int, 0, rf.commitIndex-rf.lastApplied)
+	for index := rf.lastApplied + 1; index <= rf.commitIndex; index++ {
+		rf.logger.Infof("Server(%v) apply index:%v, commitIndex:%v", rf.me, index, rf.commitIndex)
+		entry := rf.getLogEntry(index)
+		msg := ApplyMsg{
+			Index:   entry.Index,
+			Command: entry.Command,
+		}
+		switch data := entry.Command.(type) {
+		case NoOp:
+			msg.Command = nil
+			msg.NoOp = true
+		case []byte:
+			command, err := rf.codec.Unmarshal(data)
+			if err != nil {
+				// 跳过这条entry会让state machine和其他server不一致
+				fatalf(rf.logger, "Server(%v) applyLogs: decode index %v: %v", rf.me, entry.Index, err)
+			}
+			msg.Command = command
+		}
+		msgs = append(msgs, msg)
+		terms = append(terms, entry.Term)
+	}
+	return msgs, terms
+}
+
+//
+// the service says it has created a snapshot that has
+// all info up to and including index. this means the
+// service no longer needs the Logs through (and including)
+// that index. Raft should now trim its Logs as much as possible.
+//
+// index must have come out of applyCh already. the goroutine that
+// reads applyCh may call Snapshot() itself, Raft doesn't hold
+// rf.mutex while sending on applyCh.
+//
+func (rf *Raft) Snapshot(index int, snapshot []byte) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	// 只能compact已经apply过的entries，重复或者过期的snapshot直接忽略
+	if index <= rf.LastIncludedIndex || index > rf.lastApplied {
+		return
+	}
+
+	rf.logger.Infof("Server(%v) Snapshot, lastIncludedIndex(%v => %v)", rf.me, rf.LastIncludedIndex, index)
+	config, _ := rf.getConfigAt(index)
+	rf.compactLogs(index, rf.getLogTerm(index), config)
+	rf.saveSnapshot(snapshot)
+	rf.persist()
+}
+
+func (rf *Raft) saveSnapshot(snapshot []byte) {
+	if rf.killed() {
+		return
+	}
+	rf.persister.SaveSnapshot(snapshot)
+}
+
+// 丢弃index(包含)之前的entries，Logs[0]变为新的哨兵
+// config是index处生效的configuration
+func (rf *Raft) compactLogs(index int, term int, config ConfigChange) {
+	logs := make([]LogEntry, 0)
+	logs = append(logs, LogEntry{Term: term, Index: index})
+	if index < rf.getLastLogIndex() && rf.getLogTerm(index) == term {
+		logs = append(logs, rf.Logs[index-rf.LastIncludedIndex+1:]...)
+	} else {
+		rf.stableIndex = intMin(rf.stableIndex, index)
+	}
+	rf.Logs = logs
+	rf.LastIncludedIndex = index
+	rf.LastIncludedTerm = term
+	rf.LastIncludedConfig = config
+	rf.updateConfig()
+}
+
+//
+// the tester calls Kill() when a Raft instance won't
+// be needed again. Kill() cancels the Raft's context and returns
+// once every goroutine it started has exited: nothing is sent on
+// applyCh or written to the persister afterwards, and pending
+// Futures resolve with ErrShutdown. RPCs already on the network
+// finish in the background, their replies are ignored.
+// calling Kill() more than once is fine.
+//
+func (rf *Raft) Kill() {
+	rf.logger.Infof("Kill Server(%v)", rf.me)
+	atomic.StoreInt32(&rf.dead, 1)
+	rf.lifeMu.Lock()
+	rf.stopped = true
+	rf.lifeMu.Unlock()
+	rf.cancel()
+	// 等正在进行的persist()完成，之后的都丢掉
+	if c, ok := rf.persister.(io.Closer); ok {
+		c.Close()
+	}
+	rf.mutex.Lock()
+	rf.applyCond.Broadcast()
+	rf.mutex.Unlock()
+
+	rf.wg.Wait()
+
+	rf.mutex.Lock()
+	for index, futures := range rf.futures {
+		delete(rf.futures, index)
+		for _, f := range futures {
+			f.resolve(ApplyMsg{}, ErrShutdown)
+		}
+	}
+	rf.mutex.Unlock()
+	rf.doneOnce.Do(func() {
+		rf.logger.Infof("Exit Server(%v)", rf.me)
+		close(rf.done)
+	})
+}
+
+// Kill() for services that shut down through io.Closer. always returns nil.
+func (rf *Raft) Close() error {
+	rf.Kill()
+	return nil
+}
+
+// closed once Kill() has stopped every goroutine of this Raft, except
+// for the RPCs in flight: Kill() doesn't wait for Transport.Call(), so
+// each of those returns in a goroutine of its own (callEnd) that no
+// longer touches the Raft. it's gone once the Transport times out.
+func (rf *Raft) Done() <-chan struct{} {
+	return rf.done
+}
+
+// start f in a goroutine that Kill() waits for. returns false, and
+// doesn't run f, once the Raft has been killed.
+func (rf *Raft) goFunc(f func()) bool {
+	rf.lifeMu.Lock()
+	defer rf.lifeMu.Unlock()
+	if rf.stopped {
+		return false
+	}
+	rf.wg.Add(1)
+	go func() {
+		defer rf.wg.Done()
+		f()
+	}()
+	return true
+}
+
+func (rf *Raft) killed() bool {
+	return atomic.LoadInt32(&rf.dead) == 1
+}
+
+func (rf *Raft) convertToCandidate() {
+	defer rf.persist()
+	rf.logger.Infof("Convert server(%v) state(%v=>candidate) term(%v)", rf.me,
+		rf.state.debugString(), rf.CurrentTerm+1)
+	rf.state = Candidate
+	rf.CurrentTerm++
+	rf.VotedFor = rf.me
+}
+
+func (rf *Raft) tryConvertToCandidate() {
+	// 不在configuration中的server(已经被移除，或者还没有加入)不能发起选举
+	if !rf.config.contains(rf.me) {
+		rf.state = Follower
+		return
+	}
+	if rf.preVote {
+		rf.convertToPreCandidate()
+		return
+	}
+	rf.convertToCandidate()
+}
+
+//
+// turn CheckQuorum on or off, it's off by default. with CheckQuorum
+// a leader that can't reach a majority steps down by itself, so that
+// Start() and GetState() stop claiming leadership promptly.
+//
+func (rf *Raft) SetCheckQuorum(enabled bool) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	rf.checkQuorum = enabled
+}
+
+// leader在election timeout内没有收到majority的回复，说明自己很可能在minority的partition中
+func (rf *Raft) stepDownIfNoQuorum() {
+	if !rf.checkQuorum || rf.state != Leader {
+		return
+	}
+
+	// 刚当选的leader给所有peer一个election timeout的时间来回复
+	timeout := rf.electionTimeoutMin
+	if time.Since(rf.leaderSince) < timeout {
+		return
+	}
+	if !rf.hasRecentQuorum(timeout) {
+		// 这里不能用convertToFollower，同一个term里VotedFor不能清空
+		rf.logger.Infof("Server(%v) lost contact with majority, step down, lastContact:%v", rf.me, rf.lastContact)
+		rf.state = Follower
+	}
+}
+
+// 在timeout之内，有majority回复过leader
+func (rf *Raft) hasRecentQuorum(timeout time.Duration) bool {
+	active := map[int]bool{rf.me: true}
+	for server, t := range rf.lastContact {
+		if time.Since(t) < timeout {
+			active[server] = true
+		}
+	}
+	return rf.config.isQuorum(active)
+}
+
+func (rf *Raft) updateLastContact(server int, sendTime time.Time) {
+	if sendTime.After(rf.lastContact[server]) {
+		rf.lastContact[server] = sendTime
+	}
+}
+
+//
+// turn lease reads on or off, it's off by default. it must be turned
+// on for every server of the cluster, since followers then refuse to
+// vote while they still hear from the leader. drift bounds how much
+// the servers' clocks may drift apart during an election timeout.
+//
+func (rf *Raft) SetLeaseRead(enabled bool, drift time.Duration) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	rf.leaseRead = enabled
+	rf.leaseDrift = drift
+}
+
+//
+// whether this server is the leader and holds a valid lease, i.e. a
+// majority replied to heartbeats sent within the last election timeout
+// minus the drift bound. while the lease is valid no other leader can
+// be elected, so reads can be served locally. ReadIndex() uses the lease
+// to skip its heartbeat round. a leader has no lease while it transfers
+// leadership, nor for the rest of its term once it sent TimeoutNow.
+//
+func (rf *Raft) LeaseValid() bool {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	return rf.leaseValid()
+}
+
+func (rf *Raft) leaseValid() bool {
+	// transfer过程中target随时可能当选
+	if !rf.leaseRead || rf.state != Leader || rf.transferTarget != VoteNull || rf.leaseRevoked {
+		return false
+	}
+	lease := rf.electionTimeoutMin - rf.leaseDrift
+	return lease > 0 && rf.hasRecentQuorum(lease)
+}
+
+// pre-candidate不增加term，也不给自己投票，所以不需要persist
+func (rf *Raft) convertToPreCandidate() {
+	rf.logger.Infof("Convert server(%v) state(%v=>precandidate) term(%v)", rf.me,
+		rf.state.debugString(), rf.CurrentTerm)
+	rf.state = PreCandidate
+}
+
+//
+// turn leader no-op entries on or off, it's off by default. with it on,
+// every new leader appends an entry of its term right away, so entries
+// of earlier terms commit without waiting for the next Start(). the
+// service gets an ApplyMsg with NoOp set for it, and must skip it.
+//
+func (rf *Raft) SetNoOp(enabled bool) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	rf.noOp = enabled
+}
+
+//
+// set the Codec for commands, GobCodec{} by default. call it right
+// after Make(), before anything is applied, and use the same Codec on
+// every server and across restarts.
+//
+func (rf *Raft) SetCodec(codec Codec) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	rf.codec = codec
+}
+
+//
+// turn the PreVote phase on or off, it's off by default.
+//
+func (rf *Raft) SetPreVote(enabled bool) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	rf.preVote = enabled
+}
+
+// 和leaderElection一样，只是发送RequestPreVote，拿到majority之后才convertToCandidate
+func (rf *Raft) preElection() {
+	rf.mutex.Lock()
+	if rf.state != PreCandidate {
+		rf.mutex.Unlock()
+		return
+	}
+
+	term := rf.CurrentTerm
+	args := RequestVoteArgs{
+		term + 1,
+		rf.me,
+		rf.getLastLogIndex(),
+		rf.getLastLogTerm(),
+		false,
+	}
+	config := rf.config
+	rf.mutex.Unlock()
+
+	// 只在rf.mutex保护下访问
+	votes := map[int]bool{rf.me: true}
+
+	for _, i := range config.allServers() {
+		if i == rf.me {
+			continue
+		}
+
+		idx := i
+		rf.goFunc(func() {
+			reply := &RequestVoteReply{}
+			rf.logger.Infof("sendRequestPreVote(%v=>%v) args:%v", rf.me, idx, args)
+			ret := rf.sendRequestPreVote(idx, args, reply)
+			if ret {
+				rf.mutex.Lock()
+				defer rf.mutex.Unlock()
+				if reply.Term > rf.CurrentTerm {
+					rf.convertToFollower(reply.Term)
+					return
+				}
+
+				if !rf.checkState(PreCandidate, term) {
+					return
+				}
+
+				if reply.VoteGranted {
+					votes[idx] = true
+				}
+
+				if config.isQuorum(votes) {
+					rf.logger.Infof("Server(%d) win pre-vote", rf.me)
+					rf.convertToCandidate()
+					dropAndSet(rf.becomeCandidateCh)
+				}
+			}
+		})
+	}
 }
 
 func (rf *Raft) leaderElection() {
@@ -588,20 +1796,25 @@ func (rf *Raft) leaderElection() {
 		rf.me,
 		rf.getLastLogIndex(),
 		rf.getLastLogTerm(),
+		rf.leadershipTransfer,
 	}
+	rf.leadershipTransfer = false
+	config := rf.config
 	rf.mutex.Unlock()
 
-	var voteReceived int32 = 1
+	// 只在rf.mutex保护下访问
+	votes := map[int]bool{rf.me: true}
 
 	// broadcast voteRequestRPC
-	for i := 0; i < len(rf.peers); i++ {
+	for _, i := range config.allServers() {
 		if i == rf.me {
 			continue
 		}
 
-		go func(idx int, args RequestVoteArgs) {
+		idx := i
+		rf.goFunc(func() {
 			reply := &RequestVoteReply{}
-			log.Infof("sendRequestVote(%v=>%v) args:%v", rf.me, idx, args)
+			rf.logger.Infof("sendRequestVote(%v=>%v) args:%v", rf.me, idx, args)
 			ret := rf.sendRequestVote(idx, args, reply)
 			if ret {
 				rf.mutex.Lock()
@@ -616,17 +1829,18 @@ func (rf *Raft) leaderElection() {
 				}
 
 				if reply.VoteGranted {
-					atomic.AddInt32(&voteReceived, 1)
+					votes[idx] = true
 				}
 
-				if atomic.LoadInt32(&voteReceived) > int32(len(rf.peers) / 2) {
-					log.Infof("Server(%d) win vote", rf.me)
+				// joint configuration需要新旧两个configuration的majority都投票
+				if config.isQuorum(votes) {
+					rf.logger.Infof("Server(%d) win vote", rf.me)
 					// 这两句调用顺序很重要
 					rf.convertToLeader()
 					dropAndSet(rf.becomeLeaderCh)
 				}
 			}
-		}(i, args)
+		})
 	}
 }
 
@@ -636,37 +1850,57 @@ func (rf *Raft) checkState(state Role, term int) bool {
 
 func (rf *Raft) convertToFollower(term int) {
 	defer rf.persist()
-	log.Infof("Convert server(%v) state(%v=>follower) term(%v => %v)", rf.me,
+	rf.logger.Infof("Convert server(%v) state(%v=>follower) term(%v => %v)", rf.me,
 		rf.state.debugString(), rf.CurrentTerm, term)
 	rf.state = Follower
 	rf.CurrentTerm = term
 	rf.VotedFor = VoteNull
 }
 
+// configuration in effect at index, and the index of the entry it comes from.
+func (rf *Raft) getConfigAt(index int) (ConfigChange, int) {
+	for i := index; i > rf.LastIncludedIndex; i-- {
+		if config, ok := rf.getLogEntry(i).Command.(ConfigChange); ok {
+			return config, i
+		}
+	}
+	return rf.LastIncludedConfig, rf.LastIncludedIndex
+}
+
+// Logs变化之后要重新计算当前的configuration
+func (rf *Raft) updateConfig() {
+	rf.config, rf.configIndex = rf.getConfigAt(rf.getLastLogIndex())
+}
+
 func (rf *Raft) getPrevLogIndex(serverIdx int) int {
 	return rf.nextIndex[serverIdx] - 1
 }
 
 func (rf *Raft) getPrevLogTerm(serverIdx int) int {
-	prevLogIndex := rf.getPrevLogIndex(serverIdx)
-	if prevLogIndex == 0 {
-		return -1
-	} else {
-		return rf.Logs[prevLogIndex].Term
-	}
+	return rf.getLogTerm(rf.getPrevLogIndex(serverIdx))
 }
 
 // logs index started from 1
 func (rf *Raft) getLastLogIndex() int {
-	return len(rf.Logs) - 1
+	return rf.LastIncludedIndex + len(rf.Logs) - 1
 }
 
 func (rf *Raft) getLastLogTerm() int {
-	lastLogIndex := rf.getLastLogIndex()
-	if lastLogIndex == 0 {
+	return rf.getLogTerm(rf.getLastLogIndex())
+}
+
+// index必须在[LastIncludedIndex, getLastLogIndex()]之间
+func (rf *Raft) getLogEntry(index int) LogEntry {
+	return rf.Logs[index-rf.LastIncludedIndex]
+}
+
+func (rf *Raft) getLogTerm(index int) int {
+	if index == 0 {
 		return -1
+	} else if index == rf.LastIncludedIndex {
+		return rf.LastIncludedTerm
 	} else {
-		return rf.Logs[lastLogIndex].Term
+		return rf.getLogEntry(index).Term
 	}
 }
 
@@ -676,34 +1910,97 @@ func (rf *Raft) convertToLeader() {
 		return
 	}
 
-	log.Infof("Convert server(%v) state(%v=>leader) term %v", rf.me,
+	rf.logger.Infof("Convert server(%v) state(%v=>leader) term %v", rf.me,
 		rf.state.debugString(), rf.CurrentTerm)
 	rf.state = Leader
 
 	// paper figure 2中描述了，这些都是volatile state on leader
 	// 必须 reinitialized after election
-	rf.nextIndex = make([]int, len(rf.peers))
-	for i := 0; i < len(rf.peers); i++ {
+	rf.nextIndex = make(map[int]int)
+	rf.matchIndex = make(map[int]int)
+	for _, i := range rf.config.allServers() {
 		rf.nextIndex[i] = rf.getLastLogIndex() + 1
+		rf.matchIndex[i] = 0
+	}
+	rf.leaderSince = time.Now()
+	rf.lastContact = make(map[int]time.Time)
+	rf.transferTarget = VoteNull
+	rf.leaseRevoked = false
+	// 之前term的replicators会自己退出
+	rf.replicators = make(map[int]*replicator)
+
+	if rf.noOp {
+		entry := LogEntry{
+			Term:    rf.CurrentTerm,
+			Index:   rf.getLastLogIndex() + 1,
+			Command: NoOp{},
+		}
+		rf.logger.Infof("Server(%v) append no-op, index:%v term:%v", rf.me, entry.Index, entry.Term)
+		rf.Logs = append(rf.Logs, entry)
 	}
-	rf.matchIndex = make([]int, len(rf.peers))
 }
 
 //
 // the service or tester wants to create a Raft server. the ports
-// of all the Raft servers (including this one) are in peers[]. this
-// server's port is peers[me]. all the servers' peers[] arrays
+// of all the Raft servers (including this one) are in peers[], see
+// Transport. this server's port is peers[me], Raft never calls it. all the servers' peers[] arrays
 // have the same order. persister is a place for this server to
 // save its persistent state, and also initially holds the most
-// recent saved state, if any. applyCh is a channel on which the
+// recent saved state, if any. if persister is a LogStorage, like a
+// WALPersister, Raft only saves what changed instead of the whole
+// state. applyCh is a channel on which the
 // tester or service expects Raft to send ApplyMsg messages.
 // Make() must return quickly, so it should start goroutines
-// for any long-running work.
+// for any long-running work. if the persisted state can't be
+// read, Make() returns an error wrapping ErrCorrupt.
+//
+// without any persisted state, the cluster configuration is all of peers[].
+//
+func Make(peers []Transport, me int, persister Persister, applyCh chan ApplyMsg) (*Raft, error) {
+	return MakeWithConfig(peers, me, persister, applyCh, DefaultConfig())
+}
+
+//
+// like Make(), with the settings in conf instead of DefaultConfig().
+// returns an error wrapping ErrBadConfig if conf doesn't Validate().
 //
-func Make(peers []*rpc_mock.ClientEnd, me int, persister *Persister, applyCh chan ApplyMsg) *Raft {
+func MakeWithConfig(peers []Transport, me int, persister Persister, applyCh chan ApplyMsg, conf Config) (*Raft, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	members := make([]int, len(peers))
+	for i := 0; i < len(peers); i++ {
+		members[i] = i
+	}
+	return makeRaft(peers, me, persister, applyCh, ConfigChange{Servers: members}, conf)
+}
+
+//
+// like Make(), but for a server that is about to join an existing
+// cluster through AddServer(). it starts with an empty configuration,
+// so it never starts an election before the leader has replicated
+// the configuration that includes it.
+//
+func MakeJoining(peers []Transport, me int, persister Persister, applyCh chan ApplyMsg) (*Raft, error) {
+	return MakeJoiningWithConfig(peers, me, persister, applyCh, DefaultConfig())
+}
+
+//
+// like MakeJoining(), with the settings in conf instead of
+// DefaultConfig(). they must match the cluster's.
+//
+func MakeJoiningWithConfig(peers []Transport, me int, persister Persister, applyCh chan ApplyMsg, conf Config) (*Raft, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	return makeRaft(peers, me, persister, applyCh, ConfigChange{Servers: []int{}}, conf)
+}
+
+func makeRaft(peers []Transport, me int, persister Persister, applyCh chan ApplyMsg, config ConfigChange, conf Config) (*Raft, error) {
 	rf := &Raft{}
 	rf.peers = peers
 	rf.persister = persister
+	rf.storage, _ = persister.(LogStorage)
 	rf.me = me
 
 	// Your initialization code here (2A, 2B, 2C).
@@ -716,66 +2013,122 @@ func Make(peers []*rpc_mock.ClientEnd, me int, persister *Persister, applyCh cha
 	rf.Logs = make([]LogEntry, 0)
 	sentinel := LogEntry{}
 	rf.Logs = append(rf.Logs, sentinel)
+	rf.LastIncludedConfig = config
+	rf.updateConfig()
 
 	rf.commitIndex = 0
 	rf.lastApplied = 0
 	rf.state = Follower
+	rf.transferTarget = VoteNull
+	rf.futures = make(map[int][]*Future)
+	rf.replicators = make(map[int]*replicator)
 	rf.applyCh = applyCh
+	rf.applyCond = sync.NewCond(&rf.mutex)
 
-	rf.exitCh = make(chan bool, 1)
+	rf.ctx, rf.cancel = context.WithCancel(context.Background())
+	rf.done = make(chan struct{})
 	rf.grantVoteCh = make(chan bool, 1)
 	rf.appendEntryCh = make(chan bool, 1)
+	rf.becomeCandidateCh = make(chan bool, 1)
 	rf.becomeLeaderCh = make(chan bool, 1)
 
-	rf.heartbeatInterval = time.Duration(HeartbeatInterval) * time.Millisecond
+	rf.heartbeatInterval = conf.HeartbeatInterval
+	rf.electionTimeoutMin = conf.ElectionTimeoutMin
+	rf.electionTimeoutMax = conf.ElectionTimeoutMax
+	rf.maxInflight = conf.MaxInflight
+	rf.maxBatchEntries = conf.MaxBatchEntries
+	rf.maxBatchBytes = conf.MaxBatchBytes
+	rf.preVote = conf.PreVote
+	rf.checkQuorum = conf.CheckQuorum
+	rf.noOp = conf.NoOp
+	rf.leaseRead = conf.LeaseRead
+	rf.leaseDrift = conf.LeaseDrift
+	rf.codec = conf.Codec
+	if rf.codec == nil {
+		rf.codec = GobCodec{}
+	}
+	rf.logger = orNop(conf.Logger)
 
 	// initialize from state persisted before a crash
-	rf.readPersist(persister.ReadRaftState())
-	log.Infof("Make Server(%v)", rf.me)
+	if rf.storage != nil {
+		rf.readStorage()
+	} else if err := rf.readPersist(persister.ReadRaftState()); err != nil {
+		return nil, fmt.Errorf("server %v: %w", me, err)
+	}
+	// snapshot里的entries都已经committed并且applied了
+	rf.commitIndex = rf.LastIncludedIndex
+	rf.lastApplied = rf.LastIncludedIndex
+	rf.logger.Infof("Make Server(%v)", rf.me)
 
-	go func() {
-	Loop:
-		for {
+	rf.goFunc(rf.applier)
+	rf.goFunc(rf.run)
+
+	return rf, nil
+}
+
+//
+// the main loop: waits for the election timeout as a follower or
+// candidate, and keeps the replicators running as a leader.
+//
+func (rf *Raft) run() {
+	for rf.ctx.Err() == nil {
+		electionTimeout := rf.randomElectionTimeout()
+		rf.mutex.Lock()
+		state := rf.state
+		rf.mutex.Unlock()
+		rf.logger.Infof("Server(%d) state:%v, electionTimeout:%v", rf.me, state, electionTimeout)
+
+		switch state {
+		case Follower:
 			select {
-			case <- rf.exitCh:
-				log.Infof("Exit Server(%v)", rf.me)
-				break Loop
-			default:
+			case <-rf.appendEntryCh:
+			case <-rf.grantVoteCh:
+			case <-rf.becomeCandidateCh:
+			case <-rf.ctx.Done():
+			case <-time.After(electionTimeout):
+				rf.mutex.Lock()
+				rf.tryConvertToCandidate()
+				rf.mutex.Unlock()
 			}
-
-			electionTimeout := getRandomElectionTimeout()
+		case PreCandidate:
+			rf.goFunc(rf.preElection)
+			select {
+			case <-rf.appendEntryCh:
+			case <-rf.grantVoteCh:
+			case <-rf.becomeCandidateCh:
+			case <-rf.ctx.Done():
+			case <-time.After(electionTimeout):
+				rf.mutex.Lock()
+				rf.tryConvertToCandidate()
+				rf.mutex.Unlock()
+			}
+		case Candidate:
+			rf.goFunc(rf.leaderElection)
+			select {
+			case <-rf.appendEntryCh:
+			case <-rf.grantVoteCh:
+			case <-rf.becomeLeaderCh:
+			case <-rf.ctx.Done():
+			case <-time.After(electionTimeout):
+				rf.mutex.Lock()
+				rf.tryConvertToCandidate()
+				rf.mutex.Unlock()
+			}
+		case Leader:
 			rf.mutex.Lock()
-			state := rf.state
+			if rf.state == Leader {
+				rf.startReplicators()
+			}
 			rf.mutex.Unlock()
-			log.Infof("Server(%d) state:%v, electionTimeout:%v", rf.me, state, electionTimeout)
-
-			switch state {
-			case Follower:
-				select {
-				case <-rf.appendEntryCh:
-				case <-rf.grantVoteCh:
-				case <-time.After(electionTimeout):
-					rf.mutex.Lock()
-					rf.convertToCandidate()
-					rf.mutex.Unlock()
-				}
-			case Candidate:
-				go rf.leaderElection()
-				select {
-				case <-rf.appendEntryCh:
-				case <-rf.grantVoteCh:
-				case <-rf.becomeLeaderCh:
-				case <-time.After(electionTimeout):
-					rf.mutex.Lock()
-					rf.convertToCandidate()
-					rf.mutex.Unlock()
-				}
-			case Leader:
-				rf.startAppendEntries()
-				time.Sleep(rf.heartbeatInterval)
+			select {
+			case <-rf.ctx.Done():
+				return
+			case <-time.After(rf.heartbeatInterval):
 			}
+			rf.mutex.Lock()
+			rf.stepDownIfNoQuorum()
+			rf.abortTransferIfTimeout()
+			rf.mutex.Unlock()
 		}
-	} ()
-
-	return rf
-}
\ No newline at end of file
+	}
+}
@@ -14,6 +14,17 @@ import "time"
 import "math/rand"
 import "sync/atomic"
 import "sync"
+import "context"
+import "errors"
+import "bytes"
+import "encoding/binary"
+import "encoding/gob"
+import "os"
+import "io/ioutil"
+import "path/filepath"
+import "runtime"
+import "strings"
+import "raft/rpc_mock"
 
 // The tester generously allows solutions to complete elections in one second
 // (much more than the paper's range of timeouts).
@@ -197,6 +208,64 @@ func TestFailNoAgree2B(t *testing.T) {
 	fmt.Printf("  ... Passed\n")
 }
 
+func TestCommitNewEntriesOnly2B(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (2B): followers don't commit entries the leader didn't send ...\n")
+
+	index := cfg.one(rand.Int(), servers)
+	leader := cfg.checkOneLeader()
+	f := (leader + 1) % servers
+	cfg.disconnect(f)
+	rf := cfg.rafts[f]
+	rf.mutex.Lock()
+	term := rf.CurrentTerm
+	prevTerm := rf.getLogTerm(index)
+	rf.mutex.Unlock()
+
+	// a leader of term+1 leaves three entries on f that never commit.
+	entries := make([]LogEntry, 3)
+	for i := range entries {
+		data, _ := GobCodec{}.Marshal(rand.Int())
+		entries[i] = LogEntry{Term: term + 1, Index: index + 1 + i, Command: data}
+	}
+	args := AppendEntriesArgs{
+		Term:         term + 1,
+		LeaderId:     leader,
+		PrevLogIndex: index,
+		PrevLogTerm:  prevTerm,
+		Entries:      entries,
+		LeaderCommit: index,
+	}
+	reply := AppendEntriesReply{}
+	rf.AppendEntries(args, &reply)
+	if !reply.Success {
+		t.Fatalf("f rejected the entries of term %v", term+1)
+	}
+
+	// the leader of term+2 has only the first of them, and committed
+	// others after it. a heartbeat must not commit f's other two.
+	args = AppendEntriesArgs{
+		Term:         term + 2,
+		LeaderId:     leader,
+		PrevLogIndex: index + 1,
+		PrevLogTerm:  term + 1,
+		LeaderCommit: index + 3,
+	}
+	reply = AppendEntriesReply{}
+	rf.AppendEntries(args, &reply)
+	rf.mutex.Lock()
+	commitIndex := rf.commitIndex
+	rf.mutex.Unlock()
+	if !reply.Success || commitIndex != index+1 {
+		t.Fatalf("commitIndex %v after the heartbeat, expected %v", commitIndex, index+1)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
 func TestConcurrentStarts2B(t *testing.T) {
 	servers := 3
 	cfg := makeConfig(t, servers, false)
@@ -956,4 +1025,2046 @@ func TestReliableChurn2C(t *testing.T) {
 
 func TestUnreliableChurn2C(t *testing.T) {
 	internalChurn(t, true)
-}
\ No newline at end of file
+}
+
+// upper bound on the size of the persisted Raft state once the
+// service is taking snapshots regularly.
+const MaxLogSize = 2000
+
+func TestSnapshotBasic2D(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+	cfg.setSnapshotInterval(10)
+
+	fmt.Printf("Test (2D): snapshots basic ...\n")
+
+	cfg.one(rand.Int(), servers)
+	for i := 0; i < 50; i++ {
+		cfg.one(rand.Int(), servers)
+	}
+
+	// give the Snapshot() goroutines a moment to finish.
+	time.Sleep(RaftElectionTimeout / 2)
+
+	for i := 0; i < servers; i++ {
+		if cfg.saved[i].SnapshotSize() == 0 {
+			t.Fatalf("server %v never saved a snapshot", i)
+		}
+		if size := cfg.saved[i].RaftStateSize(); size > MaxLogSize {
+			t.Fatalf("server %v Logs size %v too big, expected <= %v", i, size, MaxLogSize)
+		}
+	}
+
+	// crash and re-start all, state must come back from the snapshot.
+	for i := 0; i < servers; i++ {
+		cfg.start1(i)
+	}
+	for i := 0; i < servers; i++ {
+		cfg.connect(i)
+	}
+
+	for i := 0; i < 10; i++ {
+		cfg.one(rand.Int(), servers)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// a follower that falls behind the leader's snapshot
+// must be brought up to date with InstallSnapshot.
+func internalSnapshotInstall(t *testing.T, unreliable bool, crash bool) {
+	servers := 3
+	cfg := makeConfig(t, servers, unreliable)
+	defer cfg.cleanup()
+	cfg.setSnapshotInterval(10)
+
+	cfg.one(rand.Int(), servers)
+	leader := cfg.checkOneLeader()
+
+	for iters := 0; iters < 5; iters++ {
+		victim := (leader + 1) % servers
+		if crash {
+			cfg.crash1(victim)
+		} else {
+			cfg.disconnect(victim)
+		}
+
+		// enough entries that the leader compacts past the victim's log.
+		for i := 0; i < 30; i++ {
+			cfg.one(rand.Int(), servers-1)
+		}
+
+		if crash {
+			cfg.start1(victim)
+		}
+		cfg.connect(victim)
+
+		cfg.one(rand.Int(), servers)
+		if cfg.saved[victim].SnapshotSize() == 0 {
+			t.Fatalf("server %v caught up without a snapshot", victim)
+		}
+		leader = cfg.checkOneLeader()
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestSnapshotInstall2D(t *testing.T) {
+	fmt.Printf("Test (2D): install snapshots (disconnect) ...\n")
+	internalSnapshotInstall(t, false, false)
+}
+
+func TestSnapshotInstallUnreliable2D(t *testing.T) {
+	fmt.Printf("Test (2D): install snapshots (disconnect+unreliable) ...\n")
+	internalSnapshotInstall(t, true, false)
+}
+
+func TestSnapshotInstallCrash2D(t *testing.T) {
+	fmt.Printf("Test (2D): install snapshots (crash) ...\n")
+	internalSnapshotInstall(t, false, true)
+}
+
+func TestAddServer2E(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+	cfg.setSnapshotInterval(10)
+
+	fmt.Printf("Test (2E): add servers ...\n")
+
+	// enough entries that new servers catch up through InstallSnapshot.
+	for i := 0; i < 30; i++ {
+		cfg.one(rand.Int(), servers)
+	}
+
+	for i := 0; i < 2; i++ {
+		s := cfg.addServer()
+		cfg.addMember(s)
+		cfg.one(rand.Int(), cfg.n)
+	}
+
+	// with 5 members, the cluster can lose any two of them.
+	leader := cfg.checkOneLeader()
+	cfg.disconnect((leader + 1) % cfg.n)
+	cfg.disconnect((leader + 2) % cfg.n)
+	cfg.one(rand.Int(), cfg.n-2)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestRemoveServer2E(t *testing.T) {
+	servers := 5
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (2E): remove servers ...\n")
+
+	cfg.one(rand.Int(), servers)
+
+	members := servers
+	for i := 0; i < 2; i++ {
+		leader := cfg.checkOneLeader()
+		victim := -1
+		for s := 0; s < servers; s++ {
+			if s != leader && cfg.connected[s] {
+				victim = s
+				break
+			}
+		}
+		cfg.removeMember(victim)
+		cfg.crash1(victim)
+		members--
+		cfg.one(rand.Int(), members)
+	}
+
+	// 3 members left, a majority is 2. with the original
+	// 5 members, 2 servers could not commit anything.
+	leader := cfg.checkOneLeader()
+	for s := 0; s < servers; s++ {
+		if s != leader && cfg.connected[s] {
+			cfg.disconnect(s)
+			break
+		}
+	}
+	cfg.one(rand.Int(), members-1)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// a removed server that keeps running never learns it was removed and
+// keeps starting elections. they must not depose the leader.
+func TestRemovedServerRunning2E(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (2E): removed servers that keep running ...\n")
+
+	cfg.one(rand.Int(), servers)
+
+	stable := func() {
+		leader := cfg.checkOneLeader()
+		term, _ := cfg.rafts[leader].GetState()
+		time.Sleep(3 * RaftElectionTimeout)
+		if term2, isLeader := cfg.rafts[leader].GetState(); !isLeader || term2 != term {
+			t.Fatalf("leader %v of term %v lost leadership to a removed server, term now %v", leader, term, term2)
+		}
+	}
+
+	leader := cfg.checkOneLeader()
+	removed := (leader + 1) % servers
+	cfg.removeMember(removed)
+	cfg.one(rand.Int(), servers-1)
+	stable()
+
+	// the same for a server C_new leaves out.
+	left := (leader + 2) % servers
+	newServers := []int{leader, cfg.addServer(), cfg.addServer()}
+	cfg.changeServers(newServers)
+	cfg.one(rand.Int(), len(newServers))
+	stable()
+	if _, isLeader := cfg.rafts[left].GetState(); isLeader {
+		t.Fatalf("removed server %v is leader", left)
+	}
+	cfg.one(rand.Int(), len(newServers))
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestRemoveLeader2E(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (2E): remove leader ...\n")
+
+	cfg.one(rand.Int(), servers)
+
+	leader := cfg.checkOneLeader()
+	cfg.removeMember(leader)
+
+	// once the change commits the old leader steps down for good.
+	time.Sleep(RaftElectionTimeout)
+	if _, isLeader := cfg.rafts[leader].GetState(); isLeader {
+		t.Fatalf("removed server %v is still leader", leader)
+	}
+
+	cfg.crash1(leader)
+	newLeader := cfg.checkOneLeader()
+	if newLeader == leader {
+		t.Fatalf("removed server %v elected leader", leader)
+	}
+	cfg.one(rand.Int(), servers-1)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestJointReplaceAll2E(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (2E): replace every server with joint consensus ...\n")
+
+	for i := 0; i < 10; i++ {
+		cfg.one(rand.Int(), servers)
+	}
+
+	newServers := make([]int, servers)
+	for i := 0; i < servers; i++ {
+		newServers[i] = cfg.addServer()
+	}
+	cfg.changeServers(newServers)
+
+	// the old servers are no longer needed.
+	for i := 0; i < servers; i++ {
+		cfg.crash1(i)
+	}
+
+	leader := cfg.checkOneLeader()
+	if leader < servers {
+		t.Fatalf("old server %v is leader after the change", leader)
+	}
+	for i := 0; i < 10; i++ {
+		cfg.one(rand.Int(), servers)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestJointQuorum2E(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (2E): joint consensus needs both majorities ...\n")
+
+	cfg.one(rand.Int(), servers)
+
+	newServers := make([]int, servers)
+	for i := 0; i < servers; i++ {
+		newServers[i] = cfg.addServer()
+	}
+	// only one of C_new is reachable, so C_old,new can't commit
+	// even though all of C_old is.
+	cfg.disconnect(newServers[1])
+	cfg.disconnect(newServers[2])
+
+	leader := cfg.checkOneLeader()
+	dup := []int{newServers[0], newServers[1], newServers[0]}
+	if _, _, err := cfg.rafts[leader].ChangeServers(dup); !errors.Is(err, ErrBadServers) {
+		t.Fatalf("ChangeServers(%v) returned %v, expected ErrBadServers", dup, err)
+	}
+	if _, _, err := cfg.rafts[leader].ChangeServers(nil); !errors.Is(err, ErrBadServers) {
+		t.Fatalf("ChangeServers(nil) returned %v, expected ErrBadServers", err)
+	}
+	for _, bad := range []int{-1, cfg.n} {
+		if _, _, err := cfg.rafts[leader].ChangeServers([]int{newServers[0], bad}); !errors.Is(err, ErrBadServers) {
+			t.Fatalf("ChangeServers() with server %v returned %v, expected ErrBadServers", bad, err)
+		}
+		if _, _, err := cfg.rafts[leader].AddServer(bad); !errors.Is(err, ErrBadServers) {
+			t.Fatalf("AddServer(%v) returned %v, expected ErrBadServers", bad, err)
+		}
+	}
+	if _, _, err := cfg.rafts[(leader+1)%servers].ChangeServers(newServers); err != ErrNotLeader {
+		t.Fatalf("ChangeServers() on a follower returned %v, expected ErrNotLeader", err)
+	}
+	index, _, err := cfg.rafts[leader].ChangeServers(newServers)
+	if err != nil {
+		t.Fatalf("leader rejected ChangeServers: %v", err)
+	}
+	if _, _, err := cfg.rafts[leader].ChangeServers(newServers); err != ErrChangePending {
+		t.Fatalf("second ChangeServers() returned %v, expected ErrChangePending", err)
+	}
+	cfg.rafts[leader].Start(rand.Int())
+
+	time.Sleep(2 * RaftElectionTimeout)
+	if nd, _ := cfg.nCommitted(index); nd > 0 {
+		t.Fatalf("C_old,new committed without a majority of C_new")
+	}
+
+	cfg.connect(newServers[1])
+	cfg.connect(newServers[2])
+	cfg.one(rand.Int(), servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPreVoteReElection2A(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+	cfg.setPreVote(true)
+
+	fmt.Printf("Test (2A): election after network failure with PreVote ...\n")
+
+	leader1 := cfg.checkOneLeader()
+
+	// if the LEADER disconnects, a new one should be elected.
+	cfg.disconnect(leader1)
+	cfg.checkOneLeader()
+
+	// if there's no quorum, no LEADER should be elected.
+	cfg.connect(leader1)
+	leader2 := cfg.checkOneLeader()
+	cfg.disconnect(leader2)
+	cfg.disconnect((leader2 + 1) % servers)
+	time.Sleep(2 * RaftElectionTimeout)
+	cfg.checkNoLeader()
+
+	// if a quorum arises, it should elect a LEADER.
+	cfg.connect((leader2 + 1) % servers)
+	cfg.checkOneLeader()
+
+	cfg.connect(leader2)
+	cfg.checkOneLeader()
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPreVoteRejoin2A(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+	cfg.setPreVote(true)
+
+	fmt.Printf("Test (2A): partitioned follower doesn't disrupt leader with PreVote ...\n")
+
+	cfg.one(rand.Int(), servers)
+	leader := cfg.checkOneLeader()
+	term, _ := cfg.rafts[leader].GetState()
+
+	// an isolated follower never wins a pre-vote,
+	// so it never bumps its term.
+	follower := (leader + 1) % servers
+	cfg.disconnect(follower)
+	time.Sleep(2 * RaftElectionTimeout)
+	if fterm, _ := cfg.rafts[follower].GetState(); fterm != term {
+		t.Fatalf("isolated follower changed term %v => %v", term, fterm)
+	}
+
+	// when it comes back, the leader keeps its job.
+	cfg.connect(follower)
+	cfg.one(rand.Int(), servers)
+	if newLeader := cfg.checkOneLeader(); newLeader != leader {
+		t.Fatalf("leader changed %v => %v after follower rejoined", leader, newLeader)
+	}
+	if term2, _ := cfg.rafts[leader].GetState(); term2 != term {
+		t.Fatalf("term changed %v => %v after follower rejoined", term, term2)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestCheckQuorum2A(t *testing.T) {
+	servers := 5
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+	cfg.setCheckQuorum(true)
+
+	fmt.Printf("Test (2A): leader in minority steps down with CheckQuorum ...\n")
+
+	cfg.one(rand.Int(), servers)
+	leader := cfg.checkOneLeader()
+
+	// leave the leader with one follower, a minority of 5.
+	for i := 2; i < servers; i++ {
+		cfg.disconnect((leader + i) % servers)
+	}
+	time.Sleep(RaftElectionTimeout)
+	if _, isLeader := cfg.rafts[leader].GetState(); isLeader {
+		t.Fatalf("leader %v in minority did not step down", leader)
+	}
+	if _, _, ok := cfg.rafts[leader].Start(rand.Int()); ok {
+		t.Fatalf("leader %v in minority accepted Start()", leader)
+	}
+
+	// the majority side elects a leader of its own.
+	cfg.disconnect(leader)
+	cfg.disconnect((leader + 1) % servers)
+	for i := 2; i < servers; i++ {
+		cfg.connect((leader + i) % servers)
+	}
+	cfg.one(rand.Int(), servers-2)
+
+	cfg.connect(leader)
+	cfg.connect((leader + 1) % servers)
+	cfg.one(rand.Int(), servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestReadIndex2B(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (2B): linearizable reads with ReadIndex ...\n")
+
+	index := cfg.one(rand.Int(), servers)
+	leader := cfg.checkOneLeader()
+
+	ctx, cancel := context.WithTimeout(context.Background(), RaftElectionTimeout)
+	readIndex, err := cfg.rafts[leader].ReadIndex(ctx)
+	cancel()
+	if err != nil {
+		t.Fatalf("ReadIndex on leader failed: %v", err)
+	}
+	if readIndex < index {
+		t.Fatalf("ReadIndex %v is behind committed index %v", readIndex, index)
+	}
+
+	// reads don't add anything to the Logs.
+	for i := 0; i < 5; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), RaftElectionTimeout)
+		readIndex2, err := cfg.rafts[leader].ReadIndex(ctx)
+		cancel()
+		if err != nil || readIndex2 != readIndex {
+			t.Fatalf("ReadIndex returned %v %v, expected %v", readIndex2, err, readIndex)
+		}
+	}
+
+	if _, err := cfg.rafts[(leader+1)%servers].ReadIndex(context.Background()); err != ErrNotLeader {
+		t.Fatalf("ReadIndex on follower returned %v, expected ErrNotLeader", err)
+	}
+
+	// a leader cut off from the majority can't confirm leadership.
+	cfg.disconnect(leader)
+	ctx, cancel = context.WithTimeout(context.Background(), RaftElectionTimeout)
+	if _, err := cfg.rafts[leader].ReadIndex(ctx); err == nil {
+		t.Fatalf("ReadIndex succeeded on a partitioned leader")
+	}
+	cancel()
+
+	// the new leader serves reads once it has committed an entry of its term.
+	cfg.one(rand.Int(), servers-1)
+	leader2 := cfg.checkOneLeader()
+	ctx, cancel = context.WithTimeout(context.Background(), RaftElectionTimeout)
+	if _, err := cfg.rafts[leader2].ReadIndex(ctx); err != nil {
+		t.Fatalf("ReadIndex on new leader failed: %v", err)
+	}
+	cancel()
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestLeaseReadDelays2B(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, true)
+	defer cfg.cleanup()
+	cfg.setLeaseRead(true, 30 * time.Millisecond)
+	// heartbeat的回复可能晚到两秒，lease只能从发送的时候算起
+	cfg.setLongReordering(true)
+
+	fmt.Printf("Test (2B): stale leader refuses lease reads with delayed replies ...\n")
+
+	for iters := 0; iters < 2; iters++ {
+		cfg.one(rand.Int(), servers-1)
+		leader := cfg.checkOneLeader()
+		term, _ := cfg.rafts[leader].GetState()
+
+		// replies to the heartbeats the leader sent before this are
+		// still on their way to it.
+		cfg.disconnect(leader)
+		t0 := time.Now()
+		newLeader := -1
+		// 投票的回复也会晚到，选举要多试几次
+		for newLeader == -1 && time.Since(t0) < 10 * RaftElectionTimeout {
+			for i := 0; i < servers; i++ {
+				if term2, isLeader := cfg.rafts[i].GetState(); i != leader && isLeader && term2 > term {
+					newLeader = i
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		if newLeader == -1 {
+			t.Fatalf("majority did not elect a new leader")
+		}
+
+		// the old leader still thinks it's leader, but its lease is over.
+		for t1 := time.Now(); time.Since(t1) < 3 * time.Second; {
+			if cfg.rafts[leader].LeaseValid() {
+				t.Fatalf("old leader %v holds a lease after %v was elected", leader, newLeader)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 20 * time.Millisecond)
+			_, err := cfg.rafts[leader].ReadIndex(ctx)
+			cancel()
+			if err == nil {
+				t.Fatalf("old leader %v served a read after %v was elected", leader, newLeader)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		cfg.connect(leader)
+	}
+	cfg.one(rand.Int(), servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestReadIndexNotReady2B(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (2B): ReadIndex on a new leader, no-op off and on ...\n")
+
+	cfg.one(rand.Int(), servers)
+	leader := cfg.checkOneLeader()
+
+	// without no-op entries nothing of the new term commits until Start().
+	cfg.disconnect(leader)
+	leader2 := cfg.checkOneLeader()
+	ctx, cancel := context.WithTimeout(context.Background(), RaftElectionTimeout)
+	if _, err := cfg.rafts[leader2].ReadIndex(ctx); err != ErrNotReady {
+		t.Fatalf("ReadIndex on a new leader returned %v, expected ErrNotReady", err)
+	}
+	cancel()
+	cfg.one(rand.Int(), servers-1)
+	ctx, cancel = context.WithTimeout(context.Background(), RaftElectionTimeout)
+	if _, err := cfg.rafts[leader2].ReadIndex(ctx); err != nil {
+		t.Fatalf("ReadIndex after a commit in the term failed: %v", err)
+	}
+	cancel()
+
+	// with them on, ReadIndex waits for the new leader's no-op.
+	cfg.setNoOp(true)
+	cfg.connect(leader)
+	cfg.disconnect(leader2)
+	leader3 := cfg.checkOneLeader()
+	ctx, cancel = context.WithTimeout(context.Background(), RaftElectionTimeout)
+	if _, err := cfg.rafts[leader3].ReadIndex(ctx); err != nil {
+		t.Fatalf("ReadIndex on a new leader with no-op failed: %v", err)
+	}
+	cancel()
+
+	cfg.connect(leader2)
+	cfg.one(rand.Int(), servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestLeaseRead2B(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+	drift := 30 * time.Millisecond
+	cfg.setLeaseRead(true, drift)
+
+	fmt.Printf("Test (2B): leader lease expires under partition ...\n")
+
+	cfg.one(rand.Int(), servers)
+	leader := cfg.checkOneLeader()
+	if !cfg.rafts[leader].LeaseValid() {
+		t.Fatalf("leader %v has no lease", leader)
+	}
+	for i := 0; i < servers; i++ {
+		if i != leader && cfg.rafts[i].LeaseValid() {
+			t.Fatalf("follower %v claims a lease", i)
+		}
+	}
+
+	// cut the leader off, its lease must run out on time,
+	// and nobody else may become leader before that.
+	cfg.disconnect(leader)
+	t0 := time.Now()
+	lease := time.Duration(MinElectionTimeout) * time.Millisecond - drift
+	expired := time.Time{}
+	newLeader := -1
+	for newLeader == -1 && time.Since(t0) < 2 * RaftElectionTimeout {
+		valid := cfg.rafts[leader].LeaseValid()
+		if !valid && expired.IsZero() {
+			expired = time.Now()
+		}
+		for i := 0; i < servers; i++ {
+			if _, isLeader := cfg.rafts[i].GetState(); i != leader && isLeader {
+				if valid {
+					t.Fatalf("server %v elected while old leader %v holds a lease", i, leader)
+				}
+				newLeader = i
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if expired.IsZero() || expired.Sub(t0) > lease + 50 * time.Millisecond {
+		t.Fatalf("lease of partitioned leader did not expire in time")
+	}
+	if newLeader == -1 {
+		t.Fatalf("majority did not elect a new leader")
+	}
+
+	// the new leader gets a lease of its own, and ReadIndex works.
+	cfg.one(rand.Int(), servers-1)
+	time.Sleep(RaftElectionTimeout / 5)
+	newLeader = cfg.checkOneLeader()
+	if !cfg.rafts[newLeader].LeaseValid() {
+		t.Fatalf("new leader %v has no lease", newLeader)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), RaftElectionTimeout)
+	if _, err := cfg.rafts[newLeader].ReadIndex(ctx); err != nil {
+		t.Fatalf("ReadIndex on new leader failed: %v", err)
+	}
+	cancel()
+
+	cfg.connect(leader)
+	cfg.one(rand.Int(), servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTransferLeadership2A(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+	// a reconnected follower mustn't disrupt the leader before the transfer.
+	cfg.setPreVote(true)
+
+	fmt.Printf("Test (2A): leadership transfer ...\n")
+
+	cfg.one(rand.Int(), servers)
+	leader := cfg.checkOneLeader()
+	target := (leader + 1) % servers
+
+	t0 := time.Now()
+	if err := cfg.rafts[leader].TransferLeadership(target); err != nil {
+		t.Fatalf("TransferLeadership(%v) failed: %v", target, err)
+	}
+	// the target doesn't wait for an election timeout.
+	for {
+		if _, isLeader := cfg.rafts[target].GetState(); isLeader {
+			break
+		}
+		if time.Since(t0) > time.Duration(MinElectionTimeout)*time.Millisecond {
+			t.Fatalf("target %v did not become leader in time", target)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if l := cfg.checkOneLeader(); l != target {
+		t.Fatalf("expected leader %v, got %v", target, l)
+	}
+	cfg.one(rand.Int(), servers)
+
+	// errors on a follower and on an unknown target.
+	if err := cfg.rafts[leader].TransferLeadership(target); err != ErrNotLeader {
+		t.Fatalf("TransferLeadership on follower returned %v", err)
+	}
+	if err := cfg.rafts[target].TransferLeadership(servers + 1); err != ErrNotMember {
+		t.Fatalf("TransferLeadership to non-member returned %v", err)
+	}
+
+	// a lagging target is caught up before it takes over.
+	leader = target
+	lagging := (leader + 1) % servers
+	cfg.disconnect(lagging)
+	for i := 0; i < 5; i++ {
+		cfg.one(rand.Int(), servers-1)
+	}
+	cfg.connect(lagging)
+	if err := cfg.rafts[leader].TransferLeadership(lagging); err != nil {
+		t.Fatalf("TransferLeadership(%v) failed: %v", lagging, err)
+	}
+	time.Sleep(RaftElectionTimeout / 5)
+	if l := cfg.checkOneLeader(); l != lagging {
+		t.Fatalf("expected leader %v, got %v", lagging, l)
+	}
+	cfg.one(rand.Int(), servers)
+
+	// a transfer to an unreachable target is given up,
+	// and the leader accepts Start() again.
+	leader = lagging
+	target = (leader + 1) % servers
+	cfg.disconnect(target)
+	if err := cfg.rafts[leader].TransferLeadership(target); err == nil {
+		t.Fatalf("TransferLeadership to disconnected %v succeeded", target)
+	}
+	time.Sleep(RaftElectionTimeout / 2)
+	if _, _, ok := cfg.rafts[leader].Start(rand.Int()); !ok {
+		t.Fatalf("leader %v still refuses Start() after failed transfer", leader)
+	}
+	cfg.connect(target)
+	cfg.one(rand.Int(), servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTransferLeadershipLease2A(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+	cfg.setLeaseRead(true, 30*time.Millisecond)
+
+	fmt.Printf("Test (2A): leadership transfer with leader lease ...\n")
+
+	cfg.one(rand.Int(), servers)
+	leader := cfg.checkOneLeader()
+	target := (leader + 2) % servers
+	if err := cfg.rafts[leader].TransferLeadership(target); err != nil {
+		t.Fatalf("TransferLeadership(%v) failed: %v", target, err)
+	}
+	time.Sleep(RaftElectionTimeout / 5)
+	if l := cfg.checkOneLeader(); l != target {
+		t.Fatalf("expected leader %v, got %v", target, l)
+	}
+	cfg.one(rand.Int(), servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTransferLeadershipLeaseRead2A(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+	cfg.setLeaseRead(true, 30*time.Millisecond)
+
+	fmt.Printf("Test (2A): no lease reads on the old leader of a transfer ...\n")
+
+	cfg.one(rand.Int(), servers)
+	leader := cfg.checkOneLeader()
+	target := (leader + 1) % servers
+	if !cfg.rafts[leader].LeaseValid() {
+		t.Fatalf("leader %v has no lease", leader)
+	}
+
+	// a lagging target keeps the transfer going until it times out,
+	// there is no lease meanwhile.
+	cfg.disconnect(target)
+	cfg.one(rand.Int(), servers-1)
+	errCh := make(chan error)
+	go func() { errCh <- cfg.rafts[leader].TransferLeadership(target) }()
+	time.Sleep(50 * time.Millisecond)
+	if cfg.rafts[leader].LeaseValid() {
+		t.Fatalf("leader %v holds a lease during a transfer", leader)
+	}
+	if err := <-errCh; err != ErrTransferFailed {
+		t.Fatalf("transfer to a disconnected target returned %v, expected ErrTransferFailed", err)
+	}
+	// the target comes back with a higher term, maybe somebody else leads now.
+	cfg.connect(target)
+	cfg.one(rand.Int(), servers)
+	time.Sleep(RaftElectionTimeout / 5)
+	leader = cfg.checkOneLeader()
+	target = (leader + 1) % servers
+	if !cfg.rafts[leader].LeaseValid() {
+		t.Fatalf("leader %v has no lease after the transfer failed", leader)
+	}
+
+	// once TimeoutNow is out, the target can win while the old leader
+	// still thinks it leads. it must not serve reads then.
+	if err := cfg.rafts[leader].TransferLeadership(target); err != nil {
+		t.Fatalf("TransferLeadership(%v) failed: %v", target, err)
+	}
+	cfg.disconnect(leader)
+	t0 := time.Now()
+	for time.Since(t0) < RaftElectionTimeout {
+		if cfg.rafts[leader].LeaseValid() {
+			t.Fatalf("old leader %v holds a lease after TimeoutNow", leader)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, isLeader := cfg.rafts[target].GetState(); !isLeader {
+		t.Fatalf("target %v didn't take over", target)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), RaftElectionTimeout/2)
+	if _, err := cfg.rafts[leader].ReadIndex(ctx); err == nil {
+		t.Fatalf("ReadIndex on the old leader succeeded after the transfer")
+	}
+	cancel()
+
+	cfg.connect(leader)
+	cfg.one(rand.Int(), servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestNoOpCommit2B(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+	cfg.setNoOp(true)
+
+	fmt.Printf("Test (2B): leader no-op commits earlier terms ...\n")
+
+	cfg.checkOneLeader()
+	// the first leader's no-op is index 1.
+	if nd, cmd := cfg.nCommitted(1); nd != servers || cmd != noOpCmd {
+		t.Fatalf("index 1 is %v on %v servers, expected no-op", cmd, nd)
+	}
+	var index int
+	for i := 0; i < 3; i++ {
+		index = cfg.one(rand.Int(), servers)
+	}
+
+	// restart everyone, commitIndex is volatile, so nothing is
+	// known committed. forget what was applied, then check that
+	// the new leader's no-op commits the old entries without
+	// any Start().
+	for i := 0; i < servers; i++ {
+		cfg.crash1(i)
+		cfg.mu.Lock()
+		cfg.logs[i] = map[int]int{}
+		cfg.mu.Unlock()
+	}
+	for i := 0; i < servers; i++ {
+		cfg.start1(i)
+		cfg.connect(i)
+	}
+	cfg.checkOneLeader()
+	cfg.wait(index+1, servers, -1)
+	for j := 2; j <= index; j++ {
+		if nd, cmd := cfg.nCommitted(j); nd != servers || cmd.(int) < 0 {
+			t.Fatalf("index %v is %v on %v servers after restart", j, cmd, nd)
+		}
+	}
+	if _, cmd := cfg.nCommitted(index + 1); cmd != noOpCmd {
+		t.Fatalf("index %v is %v, expected the new leader's no-op", index+1, cmd)
+	}
+	cfg.one(rand.Int(), servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestFilePersister2C(t *testing.T) {
+	fmt.Printf("Test (2C): file persister ...\n")
+
+	dir := t.TempDir()
+	ps, err := MakeFilePersister(dir)
+	if err != nil {
+		t.Fatalf("MakeFilePersister: %v", err)
+	}
+	if ps.ReadRaftState() != nil || ps.ReadSnapshot() != nil {
+		t.Fatalf("fresh FilePersister is not empty")
+	}
+	ps.SaveRaftState([]byte("state-1"))
+	ps.SaveRaftState([]byte("state-2"))
+	ps.SaveSnapshot([]byte("snapshot"))
+
+	cp := ps.Copy()
+	ps.SaveRaftState([]byte("state-3"))
+	if !bytes.Equal(cp.ReadRaftState(), []byte("state-2")) {
+		t.Fatalf("Copy() follows later saves: %q", cp.ReadRaftState())
+	}
+
+	// what a restarted process sees.
+	ps2, err := MakeFilePersister(dir)
+	if err != nil {
+		t.Fatalf("MakeFilePersister: %v", err)
+	}
+	if !bytes.Equal(ps2.ReadRaftState(), []byte("state-3")) || ps2.RaftStateSize() != len("state-3") {
+		t.Fatalf("raft state not restored: %q", ps2.ReadRaftState())
+	}
+	if !bytes.Equal(ps2.ReadSnapshot(), []byte("snapshot")) || ps2.SnapshotSize() != len("snapshot") {
+		t.Fatalf("snapshot not restored: %q", ps2.ReadSnapshot())
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestFilePersisterRestart2C(t *testing.T) {
+	servers := 3
+	cfg := makeFileConfig(t, servers, false, t.TempDir())
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (2C): restart from files ...\n")
+
+	cfg.one(rand.Int(), servers)
+	leader := cfg.checkOneLeader()
+	term1, _ := cfg.rafts[leader].GetState()
+
+	// crash everyone and forget what they applied, the
+	// restarted servers only have what's on disk.
+	for i := 0; i < servers; i++ {
+		cfg.crash1(i)
+		cfg.mu.Lock()
+		cfg.saved[i] = nil
+		cfg.logs[i] = map[int]int{}
+		cfg.mu.Unlock()
+	}
+	for i := 0; i < servers; i++ {
+		cfg.start1(i)
+		cfg.connect(i)
+	}
+	leader = cfg.checkOneLeader()
+	if term2, _ := cfg.rafts[leader].GetState(); term2 <= term1 {
+		t.Fatalf("term went back from %v to %v after restart", term1, term2)
+	}
+	index := cfg.one(rand.Int(), servers)
+	if index != 2 {
+		t.Fatalf("expected index 2, got %v", index)
+	}
+	if nd, _ := cfg.nCommitted(1); nd != servers {
+		t.Fatalf("index 1 applied on %v servers after restart", nd)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestWALPersister2C(t *testing.T) {
+	fmt.Printf("Test (2C): WAL persister ...\n")
+
+	dir := t.TempDir()
+	open := func() *WALPersister {
+		wp, err := MakeWALPersister(dir)
+		if err != nil {
+			t.Fatalf("MakeWALPersister: %v", err)
+		}
+		wp.SetSegmentSize(256)
+		return wp
+	}
+	entries := func(from int, to int, term int) []LogEntry {
+		var es []LogEntry
+		for i := from; i <= to; i++ {
+			es = append(es, LogEntry{Term: term, Index: i, Command: i * 100})
+		}
+		return es
+	}
+	check := func(st LogState, included int, last int) {
+		if st.LastIncludedIndex != included {
+			t.Fatalf("LastIncludedIndex %v, expected %v", st.LastIncludedIndex, included)
+		}
+		if len(st.Entries) != last-included {
+			t.Fatalf("recovered %v entries, expected %v", len(st.Entries), last-included)
+		}
+		for i, e := range st.Entries {
+			if e.Index != included+i+1 || e.Command != e.Index*100 {
+				t.Fatalf("bad entry %v", e.debugString())
+			}
+		}
+	}
+
+	wp := open()
+	if st := wp.ReadLogState(); st.CurrentTerm != 0 || st.VotedFor != VoteNull || len(st.Entries) != 0 {
+		t.Fatalf("fresh WAL is not empty: %v", st)
+	}
+	wp.SaveHardState(3, 1)
+	wp.AppendLogs(entries(1, 5, 1))
+	// a conflict with a new leader replaces 4 and 5.
+	wp.TruncateLogs(3)
+	wp.AppendLogs(entries(4, 6, 2))
+	wp.SaveHardState(4, VoteNull)
+
+	st := open().ReadLogState()
+	if st.CurrentTerm != 4 || st.VotedFor != VoteNull {
+		t.Fatalf("hard state (%v, %v), expected (4, -1)", st.CurrentTerm, st.VotedFor)
+	}
+	check(st, 0, 6)
+	if st.Entries[2].Term != 1 || st.Entries[3].Term != 2 {
+		t.Fatalf("truncate was not replayed: %v", st.Entries)
+	}
+
+	// enough entries for several segments, then compact most of them away.
+	wp = open()
+	for i := 7; i <= 60; i++ {
+		wp.AppendLogs(entries(i, i, 2))
+	}
+	nsegments := len(wp.segments)
+	if nsegments < 3 {
+		t.Fatalf("expected several segments, got %v", nsegments)
+	}
+	size := wp.RaftStateSize()
+	config := ConfigChange{Servers: []int{0, 1, 2}}
+	wp.CompactLogs(50, 2, config)
+	if len(wp.segments) >= nsegments || wp.RaftStateSize() >= size {
+		t.Fatalf("compaction removed no segments")
+	}
+	st = open().ReadLogState()
+	check(st, 50, 60)
+	if st.LastIncludedTerm != 2 || st.LastIncludedConfig == nil || len(st.LastIncludedConfig.Servers) != 3 {
+		t.Fatalf("compaction was not replayed: %v", st)
+	}
+
+	// a record torn by a crash is dropped, the WAL stays usable.
+	names, _ := filepath.Glob(filepath.Join(dir, walSegmentPrefix+"*"))
+	f, err := os.OpenFile(names[len(names)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("open segment: %v", err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 42, 42})
+	f.Close()
+	wp = open()
+	check(wp.ReadLogState(), 50, 60)
+	wp.AppendLogs(entries(61, 62, 3))
+	check(open().ReadLogState(), 50, 62)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// a service snapshots once RaftStateSize() reaches its limit, like
+// kvraft's maxraftstate. the size must drop below the limit again,
+// although the segment with the compacted entries is still there.
+func TestWALStateSize2D(t *testing.T) {
+	servers := 3
+	cfg := makeWALConfig(t, servers, false, t.TempDir())
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (2D): WAL state size drops after Snapshot() ...\n")
+
+	limit := 4096
+	snapshots := 0
+	for cmd := 0; cmd < 200; cmd++ {
+		index := cfg.one(rand.Int(), servers)
+		for i := 0; i < servers; i++ {
+			cfg.mu.Lock()
+			wp := cfg.saved[i].(*WALPersister)
+			rf := cfg.rafts[i]
+			cfg.mu.Unlock()
+			if wp.RaftStateSize() < limit {
+				continue
+			}
+			rf.Snapshot(index, cfg.makeSnapshot(i, index))
+			snapshots++
+			if size := wp.RaftStateSize(); size >= limit {
+				t.Fatalf("server %v: RaftStateSize() is %v after Snapshot(%v), limit %v", i, size, index, limit)
+			}
+			wp.mu.Lock()
+			nsegments := len(wp.segments)
+			wp.mu.Unlock()
+			if nsegments != 1 {
+				t.Fatalf("server %v: expected everything in one segment, got %v", i, nsegments)
+			}
+		}
+	}
+	if snapshots < servers*3 {
+		t.Fatalf("only %v snapshots", snapshots)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestWALRestart2C(t *testing.T) {
+	servers := 3
+	cfg := makeWALConfig(t, servers, false, t.TempDir())
+	defer cfg.cleanup()
+	cfg.setSnapshotInterval(5)
+
+	fmt.Printf("Test (2C): restart from WAL ...\n")
+
+	cfg.one(rand.Int(), servers)
+	for iters := 0; iters < 6; iters++ {
+		for i := 0; i < 4; i++ {
+			cfg.one(rand.Int(), servers)
+		}
+		// a follower misses some entries, then catches up after a restart.
+		leader := cfg.checkOneLeader()
+		victim := (leader + 1 + iters%2) % servers
+		cfg.crash1(victim)
+		for i := 0; i < 3; i++ {
+			cfg.one(rand.Int(), servers-1)
+		}
+		cfg.start1(victim)
+		cfg.connect(victim)
+	}
+	index := cfg.one(rand.Int(), servers)
+
+	// crash everyone and forget what they applied, the
+	// restarted servers only have what's in their WALs.
+	for i := 0; i < servers; i++ {
+		cfg.crash1(i)
+		cfg.mu.Lock()
+		cfg.saved[i] = nil
+		cfg.logs[i] = map[int]int{}
+		cfg.mu.Unlock()
+	}
+	for i := 0; i < servers; i++ {
+		cfg.start1(i)
+		cfg.connect(i)
+	}
+	if index2 := cfg.one(rand.Int(), servers); index2 != index+1 {
+		t.Fatalf("expected index %v after restart, got %v", index+1, index2)
+	}
+	if nd, _ := cfg.nCommitted(index); nd != servers {
+		t.Fatalf("index %v applied on %v servers after restart", index, nd)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// kvraft's tester restarts servers from Copy() of their persisters.
+func TestWALCopy2C(t *testing.T) {
+	servers := 3
+	cfg := makeWALConfig(t, servers, false, t.TempDir())
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (2C): restart from a copy of a WAL ...\n")
+
+	restart := func(i int) {
+		cfg.mu.Lock()
+		wp := cfg.saved[i].(*WALPersister)
+		// crash1() copies the persister from now on.
+		cfg.persistDir = ""
+		cfg.mu.Unlock()
+		cfg.crash1(i)
+		st := wp.ReadLogState()
+		cfg.start1(i)
+		rf := cfg.rafts[i]
+		rf.mutex.Lock()
+		term, lastIndex, included, members := rf.CurrentTerm, rf.getLastLogIndex(), rf.LastIncludedIndex, len(rf.config.Servers)
+		rf.mutex.Unlock()
+		if term < st.CurrentTerm || included != st.LastIncludedIndex ||
+			lastIndex != st.LastIncludedIndex+len(st.Entries) || members != servers {
+			t.Fatalf("server %v restarted with term %v, Logs %v to %v, %v members, the WAL has term %v, Logs %v to %v",
+				i, term, included, lastIndex, members, st.CurrentTerm, st.LastIncludedIndex, st.LastIncludedIndex+len(st.Entries))
+		}
+		cfg.connect(i)
+	}
+
+	for i := 0; i < 3; i++ {
+		cfg.one(rand.Int(), servers)
+	}
+	// nothing compacted yet.
+	restart(0)
+	cfg.one(rand.Int(), servers)
+
+	cfg.setSnapshotInterval(5)
+	for i := 0; i < 15; i++ {
+		cfg.one(rand.Int(), servers)
+	}
+	restart(1)
+	index := cfg.one(rand.Int(), servers)
+	if nd, _ := cfg.nCommitted(index); nd != servers {
+		t.Fatalf("index %v applied on %v servers after restart", index, nd)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestCorruptState2C(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (2C): corrupt state is detected ...\n")
+
+	for i := 0; i < 3; i++ {
+		cfg.one(rand.Int(), servers)
+	}
+	cfg.crash1(0)
+	cfg.mu.Lock()
+	good := cfg.saved[0].ReadRaftState()
+	cfg.mu.Unlock()
+
+	corrupt := func(what string, f func(data []byte) []byte) {
+		data := f(append([]byte(nil), good...))
+		ps := MakePersister()
+		ps.SaveRaftState(data)
+		rf, err := Make(nil, 0, ps, make(chan ApplyMsg))
+		if rf != nil || !errors.Is(err, ErrCorrupt) {
+			t.Fatalf("%v: Make returned %v, expected ErrCorrupt", what, err)
+		}
+	}
+	corrupt("bad magic", func(data []byte) []byte { data[0] ^= 1; return data })
+	corrupt("bad version", func(data []byte) []byte { data[7]++; return data })
+	corrupt("bit rot", func(data []byte) []byte { data[len(data)/2] ^= 0x10; return data })
+	corrupt("cut short", func(data []byte) []byte { return data[:len(data)-5] })
+
+	// the intact state still works.
+	cfg.start1(0)
+	cfg.connect(0)
+	cfg.one(rand.Int(), servers)
+
+	// WAL: a bad record before the tail isn't a torn write.
+	dir := t.TempDir()
+	wp, err := MakeWALPersister(dir)
+	if err != nil {
+		t.Fatalf("MakeWALPersister: %v", err)
+	}
+	wp.SaveHardState(2, 1)
+	for i := 1; i <= 3; i++ {
+		wp.AppendLogs([]LogEntry{{Term: 2, Index: i, Command: i}})
+	}
+	wp.Close()
+	segment := wp.segmentPath(0)
+	data, _ := ioutil.ReadFile(segment)
+
+	// a final record that fails its checksum was torn by a crash, drop it.
+	torn := append([]byte(nil), data...)
+	torn[len(torn)-1] ^= 1
+	ioutil.WriteFile(segment, torn, 0644)
+	logger := &testLogger{}
+	wp, err = MakeWALPersisterWithLogger(dir, logger)
+	if err != nil {
+		t.Fatalf("torn tail: MakeWALPersister: %v", err)
+	}
+	if st := wp.ReadLogState(); len(st.Entries) != 2 {
+		t.Fatalf("torn tail: recovered %v entries, expected 2", len(st.Entries))
+	}
+	if !logger.logged("dropping torn record") {
+		t.Fatalf("torn tail: not logged to the WAL's logger: %v", logger.lines)
+	}
+	wp.Close()
+
+	rotten := append([]byte(nil), data...)
+	rotten[headerSize+recordHeader+2] ^= 1
+	ioutil.WriteFile(segment, rotten, 0644)
+	if _, err := MakeWALPersister(dir); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("bit rot in segment: MakeWALPersister returned %v, expected ErrCorrupt", err)
+	}
+
+	ioutil.WriteFile(segment, data, 0644)
+	hs := filepath.Join(dir, hardStateFile)
+	hsData, _ := ioutil.ReadFile(hs)
+	hsData[len(hsData)-1] ^= 1
+	ioutil.WriteFile(hs, hsData, 0644)
+	if _, err := MakeWALPersister(dir); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("bit rot in hard state: MakeWALPersister returned %v, expected ErrCorrupt", err)
+	}
+
+	// a save that fails is fatal, and logged to the persister's logger.
+	logger = &testLogger{}
+	fp, err := MakeFilePersisterWithLogger(filepath.Join(dir, "file"), logger)
+	if err != nil {
+		t.Fatalf("MakeFilePersister: %v", err)
+	}
+	os.RemoveAll(fp.dir)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatalf("SaveRaftState() into a removed directory didn't fail")
+			}
+		}()
+		fp.SaveRaftState([]byte("state"))
+	}()
+	if !logger.logged("FilePersister SaveRaftState") {
+		t.Fatalf("failed save not logged to the persister's logger: %v", logger.lines)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// state written before the format had a header is read as version 0.
+func TestLegacyState2C(t *testing.T) {
+	fmt.Printf("Test (2C): state without a header is read as version 0 ...\n")
+
+	gobs := func(values ...interface{}) []byte {
+		w := new(bytes.Buffer)
+		e := gob.NewEncoder(w)
+		for _, v := range values {
+			e.Encode(v)
+		}
+		return w.Bytes()
+	}
+
+	logs := []LogEntry{{Term: 0, Index: 0}, {Term: 3, Index: 1, Command: 7}}
+	config := ConfigChange{Servers: []int{0, 1, 2}}
+	st, err := decodeRaftState(gobs(3, 1, logs, 0, 0, config))
+	if err != nil {
+		t.Fatalf("decode version 0 state: %v", err)
+	}
+	if st.CurrentTerm != 3 || st.VotedFor != 1 || len(st.Logs) != 2 || len(st.LastIncludedConfig.Servers) != 3 {
+		t.Fatalf("version 0 state decoded as %+v", st)
+	}
+
+	// a version 0 WAL: hard state without a header, records without checksums.
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, hardStateFile), gobs(3, 1), 0644)
+	var segment []byte
+	for i := 1; i <= 3; i++ {
+		payload := gobs(walRecord{Kind: walAppend, Entries: []LogEntry{{Term: 3, Index: i, Command: i}}})
+		segment = binary.BigEndian.AppendUint32(segment, uint32(len(payload)))
+		segment = append(segment, payload...)
+	}
+	// and a record torn by a crash.
+	segment = append(segment, 0, 0, 1)
+	wp := &WALPersister{FilePersister: &FilePersister{dir: dir}}
+	ioutil.WriteFile(wp.segmentPath(0), segment, 0644)
+
+	wp, err = MakeWALPersister(dir)
+	if err != nil {
+		t.Fatalf("MakeWALPersister on a version 0 WAL: %v", err)
+	}
+	ls := wp.ReadLogState()
+	if ls.CurrentTerm != 3 || ls.VotedFor != 1 || len(ls.Entries) != 3 {
+		t.Fatalf("version 0 WAL recovered term %v, votedFor %v, %v entries", ls.CurrentTerm, ls.VotedFor, len(ls.Entries))
+	}
+	wp.AppendLogs([]LogEntry{{Term: 3, Index: 4, Command: 4}})
+	wp.SaveHardState(4, VoteNull)
+	wp.Close()
+
+	// new records went into a new segment, in the current version.
+	data, err := ioutil.ReadFile(wp.segmentPath(1))
+	if err != nil || checkHeader(data) != nil {
+		t.Fatalf("no segment in the current version after a version 0 one: %v", err)
+	}
+	wp, err = MakeWALPersister(dir)
+	if err != nil {
+		t.Fatalf("MakeWALPersister after writing to a version 0 WAL: %v", err)
+	}
+	ls = wp.ReadLogState()
+	if ls.CurrentTerm != 4 || len(ls.Entries) != 4 || ls.Entries[3].Command != 4 {
+		t.Fatalf("recovered term %v, %v entries, expected 4 and 4", ls.CurrentTerm, len(ls.Entries))
+	}
+	wp.Close()
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// a Logger that keeps what is logged.
+type testLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *testLogger) Infof(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func (l *testLogger) logged(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range l.lines {
+		if strings.Contains(line, s) {
+			return true
+		}
+	}
+	return false
+}
+
+type codecTestCmd struct {
+	Key   string
+	Value []int
+}
+
+func TestCodec2B(t *testing.T) {
+	fmt.Printf("Test (2B): command codecs ...\n")
+
+	roundTrip := func(codec Codec, command interface{}) interface{} {
+		data, err := codec.Marshal(command)
+		if err != nil {
+			t.Fatalf("%T Marshal(%v): %v", codec, command, err)
+		}
+		got, err := codec.Unmarshal(data)
+		if err != nil {
+			t.Fatalf("%T Unmarshal: %v", codec, err)
+		}
+		return got
+	}
+
+	// a command type nobody registered with gob.
+	cmd := codecTestCmd{"k", []int{1, 2, 3}}
+	typed := JSONCodec{New: func() interface{} { return new(codecTestCmd) }}
+	if got, ok := roundTrip(typed, cmd).(codecTestCmd); !ok || got.Key != "k" || len(got.Value) != 3 {
+		t.Fatalf("JSONCodec round trip: %v", got)
+	}
+	if got, ok := roundTrip(JSONCodec{}, cmd).(map[string]interface{}); !ok || got["Key"] != "k" {
+		t.Fatalf("generic JSONCodec round trip: %v", got)
+	}
+	if _, err := (GobCodec{}).Marshal(cmd); err == nil {
+		t.Fatalf("GobCodec encoded an unregistered type")
+	}
+	if got := roundTrip(GobCodec{}, 42); got != 42 {
+		t.Fatalf("GobCodec round trip: %v", got)
+	}
+	payload := []byte("opaque")
+	if got := roundTrip(RawCodec{}, payload).([]byte); !bytes.Equal(got, payload) {
+		t.Fatalf("RawCodec round trip: %q", got)
+	}
+	if _, err := (RawCodec{}).Marshal(5); err == nil {
+		t.Fatalf("RawCodec accepted a non-[]byte command")
+	}
+
+	// a cluster storing its int commands as JSON.
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+	cfg.setCodec(JSONCodec{New: func() interface{} { return new(int) }})
+
+	for i := 0; i < 3; i++ {
+		cfg.one(rand.Int(), servers)
+	}
+	leader := cfg.checkOneLeader()
+	cfg.crash1((leader + 1) % servers)
+	cfg.one(rand.Int(), servers-1)
+	cfg.start1((leader + 1) % servers)
+	cfg.connect((leader + 1) % servers)
+	cfg.one(rand.Int(), servers)
+
+	// a command the Codec can't encode is refused, the leader goes on.
+	leader = cfg.checkOneLeader()
+	if index, _, ok := cfg.rafts[leader].Start(make(chan int)); ok || index != -1 {
+		t.Fatalf("Start() of a command the Codec can't encode returned %v %v", index, ok)
+	}
+	if _, err := cfg.rafts[leader].Propose(context.Background(), make(chan int)); !errors.Is(err, ErrBadCommand) {
+		t.Fatalf("Propose() of a command the Codec can't encode returned %v, expected ErrBadCommand", err)
+	}
+	if _, isLeader := cfg.rafts[leader].GetState(); !isLeader {
+		t.Fatalf("leader %v stepped down after a bad command", leader)
+	}
+	cfg.one(rand.Int(), servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPropose2B(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (2B): Propose() futures ...\n")
+
+	cfg.one(101, servers)
+	leader := cfg.checkOneLeader()
+
+	// the command commits.
+	f, err := cfg.rafts[leader].Propose(context.Background(), 102)
+	if err != nil {
+		t.Fatalf("leader's Propose(): %v", err)
+	}
+	msg, err := f.Result()
+	if err != nil {
+		t.Fatalf("Future resolved with %v", err)
+	}
+	if msg.Index != f.Index() || msg.Command != 102 {
+		t.Fatalf("Future resolved with %+v, expected index %v command 102", msg, f.Index())
+	}
+
+	// a follower doesn't take commands.
+	if _, err := cfg.rafts[(leader+1)%servers].Propose(context.Background(), 103); err != ErrNotLeader {
+		t.Fatalf("follower's Propose() returned %v, expected ErrNotLeader", err)
+	}
+
+	// an isolated leader can't commit, ctx ends the wait.
+	cfg.disconnect(leader)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	f, err = cfg.rafts[leader].Propose(ctx, 104)
+	if err != nil {
+		t.Fatalf("isolated leader's Propose(): %v", err)
+	}
+	if _, err := f.Result(); err != context.DeadlineExceeded {
+		t.Fatalf("Future resolved with %v, expected context.DeadlineExceeded", err)
+	}
+
+	// another isolated proposal is overwritten by the new leader's entries.
+	f, err = cfg.rafts[leader].Propose(context.Background(), 105)
+	if err != nil {
+		t.Fatalf("isolated leader's Propose(): %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		cfg.one(106+i, servers-1)
+	}
+	cfg.connect(leader)
+	cfg.one(109, servers)
+	select {
+	case <-f.Done():
+	case <-time.After(2 * RaftElectionTimeout):
+		t.Fatalf("Future of an overwritten entry did not resolve")
+	}
+	if _, err := f.Result(); err != ErrLeadershipLost {
+		t.Fatalf("Future resolved with %v, expected ErrLeadershipLost", err)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestReplicationLimits2B(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, true)
+	defer cfg.cleanup()
+	// tiny batches, so a follower catches up in many pipelined AppendEntries
+	cfg.setReplication(4, 3, 64)
+
+	fmt.Printf("Test (2B): small batches, pipelined, unreliable ...\n")
+
+	cfg.one(rand.Int(), servers)
+
+	leader := cfg.checkOneLeader()
+	cfg.disconnect((leader + 1) % servers)
+	for i := 0; i < 50; i++ {
+		cfg.one(rand.Int(), servers-1)
+	}
+
+	// concurrent Start()s while the follower catches up.
+	cfg.connect((leader + 1) % servers)
+	var wg sync.WaitGroup
+	for c := 0; c < 5; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				cfg.one(rand.Int(), servers)
+			}
+		}()
+	}
+	wg.Wait()
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// committed commands per second with many concurrent Propose()s.
+func BenchmarkReplication(b *testing.B) {
+	cases := []struct {
+		name        string
+		maxInflight int
+		maxEntries  int
+	}{
+		{"unbatched", 1, 1},
+		{"batched", 1, DefaultMaxBatchEntries},
+		{"pipelined", DefaultMaxInflight, DefaultMaxBatchEntries},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			servers := 3
+			cfg := makeConfig(b, servers, false)
+			defer cfg.cleanup()
+			cfg.setReplication(c.maxInflight, c.maxEntries, DefaultMaxBatchBytes)
+			cfg.one(1, servers)
+			leader := cfg.checkOneLeader()
+
+			const clients = 32
+			var next int64
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for i := 0; i < clients; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for {
+						cmd := atomic.AddInt64(&next, 1)
+						if cmd > int64(b.N) {
+							return
+						}
+						f, err := cfg.rafts[leader].Propose(context.Background(), int(cmd)+1)
+						if err != nil {
+							b.Errorf("Propose(): %v", err)
+							return
+						}
+						if _, err := f.Result(); err != nil {
+							b.Errorf("Future resolved with %v", err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			b.StopTimer()
+		})
+	}
+}
+
+func TestSlowApply2B(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+	// new leaders commit the backlog right away
+	cfg.setNoOp(true)
+
+	fmt.Printf("Test (2B): elections with a slow applyCh reader ...\n")
+
+	cfg.one(rand.Int(), servers)
+	leader1 := cfg.checkOneLeader()
+	term1 := cfg.checkTerms()
+
+	// every server needs 10 seconds to apply this backlog.
+	cfg.setApplyDelay(100 * time.Millisecond)
+	for i := 0; i < 100; i++ {
+		cfg.rafts[leader1].Start(rand.Int())
+	}
+
+	// the leader keeps sending heartbeats while it sends
+	// the backlog on applyCh, nobody starts an election.
+	time.Sleep(2 * RaftElectionTimeout)
+	if term := cfg.checkTerms(); term != term1 {
+		t.Fatalf("term changed from %v to %v while applying", term1, term)
+	}
+
+	// leaders are still elected in time.
+	for iters := 0; iters < 2; iters++ {
+		leader := cfg.checkOneLeader()
+		cfg.disconnect(leader)
+		start := time.Now()
+		newLeader := cfg.checkOneLeader()
+		if newLeader == leader {
+			t.Fatalf("disconnected leader %v is still the only leader", leader)
+		}
+		if d := time.Since(start); d > 3*RaftElectionTimeout {
+			t.Fatalf("electing a new leader took %v", d)
+		}
+		cfg.connect(leader)
+	}
+
+	cfg.setApplyDelay(0)
+	cfg.one(rand.Int(), servers)
+
+	fmt.Printf("  ... Passed\n")
+}
+
+// stacks of the goroutines running a method of a Raft.
+func raftGoroutines() []string {
+	return goroutines("raft.(*Raft).")
+}
+
+// stacks of the goroutines with a function starting with prefix on their stack.
+func goroutines(prefix string) []string {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	stacks := make([]string, 0)
+	for _, stack := range strings.Split(string(buf), "\n\n") {
+		// 只看调用栈中的函数，不看"created by"
+		for _, line := range strings.Split(stack, "\n") {
+			if strings.HasPrefix(line, prefix) {
+				stacks = append(stacks, stack)
+				break
+			}
+		}
+	}
+	return stacks
+}
+
+func TestShutdown2C(t *testing.T) {
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+
+	fmt.Printf("Test (2C): Kill() stops every goroutine ...\n")
+
+	cfg.one(rand.Int(), servers)
+
+	// the appliers are blocked sending on applyCh when Kill() is called.
+	leader := cfg.checkOneLeader()
+	cfg.setApplyDelay(time.Second)
+	for i := 0; i < 10; i++ {
+		cfg.rafts[leader].Start(rand.Int())
+	}
+	time.Sleep(RaftElectionTimeout / 2)
+
+	// a Future that can't resolve before the leader is killed.
+	cfg.disconnect((leader + 1) % servers)
+	cfg.disconnect((leader + 2) % servers)
+	f, err := cfg.rafts[leader].Propose(context.Background(), rand.Int())
+	if err != nil {
+		t.Fatalf("Propose() on the leader: %v", err)
+	}
+
+	// the others keep starting elections until they are killed.
+	time.Sleep(RaftElectionTimeout / 2)
+
+	rafts := make([]*Raft, servers)
+	copy(rafts, cfg.rafts)
+	start := time.Now()
+	for i := 0; i < servers; i++ {
+		cfg.crash1(i)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Kill() took %v", d)
+	}
+	for i, rf := range rafts {
+		select {
+		case <-rf.Done():
+		default:
+			t.Fatalf("Done() of server %v not closed after Kill()", i)
+		}
+	}
+	if _, err := f.Result(); err != ErrShutdown {
+		t.Fatalf("pending Future resolved with %v, expected ErrShutdown", err)
+	}
+	if _, err := rafts[leader].Propose(context.Background(), rand.Int()); err != ErrShutdown {
+		t.Fatalf("Propose() after Kill() returned %v, expected ErrShutdown", err)
+	}
+	if _, err := rafts[leader].ReadIndex(context.Background()); err != ErrShutdown {
+		t.Fatalf("ReadIndex() after Kill() returned %v, expected ErrShutdown", err)
+	}
+	rafts[leader].Kill()
+
+	// RPC handlers the network was still delivering may take a moment.
+	var stacks []string
+	for iters := 0; iters < 10; iters++ {
+		if stacks = raftGoroutines(); len(stacks) == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(stacks) > 0 {
+		t.Fatalf("%v goroutines left after Kill():\n%v", len(stacks), strings.Join(stacks, "\n\n"))
+	}
+
+	// the RPCs Kill() didn't wait for end once the network drops them,
+	// which takes up to 7 seconds with long delays.
+	for iters := 0; iters < 100; iters++ {
+		if stacks = goroutines("raft.callEnd("); len(stacks) == 0 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(stacks) > 0 {
+		t.Fatalf("%v RPCs still in flight 10s after Kill():\n%v", len(stacks), strings.Join(stacks, "\n\n"))
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestTCPTransport2B(t *testing.T) {
+	servers := 3
+	fmt.Printf("Test (2B): agreement over TCP ...\n")
+
+	// listen first, the peers need each other's addresses.
+	srvs := make([]*rpc_mock.Server, servers)
+	listeners := make([]*rpc_mock.TCPListener, servers)
+	for i := 0; i < servers; i++ {
+		srvs[i] = rpc_mock.MakeServer()
+		l, err := rpc_mock.Listen("localhost:0", srvs[i])
+		if err != nil {
+			t.Fatalf("Listen(): %v", err)
+		}
+		defer l.Close()
+		listeners[i] = l
+	}
+
+	var mu sync.Mutex
+	applied := make([]map[int]interface{}, servers)
+	rafts := make([]*Raft, servers)
+	for i := 0; i < servers; i++ {
+		peers := make([]Transport, servers)
+		for j := 0; j < servers; j++ {
+			if j != i {
+				c := rpc_mock.MakeTCPClient(listeners[j].Addr().String())
+				defer c.Close()
+				peers[j] = c
+			}
+		}
+		applyCh := make(chan ApplyMsg)
+		rf, err := Make(peers, i, MakePersister(), applyCh)
+		if err != nil {
+			t.Fatalf("Make(): %v", err)
+		}
+		defer rf.Kill()
+		rafts[i] = rf
+		srvs[i].AddService(rpc_mock.MakeService(rf))
+
+		applied[i] = make(map[int]interface{})
+		go func(i int) {
+			for msg := range applyCh {
+				mu.Lock()
+				applied[i][msg.Index] = msg.Command
+				mu.Unlock()
+			}
+		}(i)
+	}
+
+	// propose on whoever is leader until cmd commits, and wait
+	// for the servers in alive to apply it.
+	agree := func(cmd int, alive []int) {
+		t0 := time.Now()
+		for time.Since(t0) < 10*time.Second {
+			for _, i := range alive {
+				f, err := rafts[i].Propose(context.Background(), cmd)
+				if err != nil {
+					continue
+				}
+				msg, err := f.Result()
+				if err != nil {
+					break
+				}
+				for time.Since(t0) < 10*time.Second {
+					done := true
+					mu.Lock()
+					for _, j := range alive {
+						if applied[j][msg.Index] != cmd {
+							done = false
+						}
+					}
+					mu.Unlock()
+					if done {
+						return
+					}
+					time.Sleep(20 * time.Millisecond)
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("no agreement on %v", cmd)
+	}
+
+	all := []int{0, 1, 2}
+	for cmd := 1; cmd <= 10; cmd++ {
+		agree(cmd, all)
+	}
+
+	// the leader's process goes away, the others elect a new one.
+	leader := -1
+	for i, rf := range rafts {
+		if _, isLeader := rf.GetState(); isLeader {
+			leader = i
+		}
+	}
+	if leader == -1 {
+		t.Fatalf("no leader")
+	}
+	rafts[leader].Kill()
+	listeners[leader].Close()
+	alive := make([]int, 0)
+	for _, i := range all {
+		if i != leader {
+			alive = append(alive, i)
+		}
+	}
+	for cmd := 11; cmd <= 20; cmd++ {
+		agree(cmd, alive)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestPersistedState2C(t *testing.T) {
+	fmt.Printf("Test (2C): offline read and truncate of persisted state ...\n")
+
+	if _, err := ReadPersistedState(t.TempDir()); !errors.Is(err, ErrNoState) {
+		t.Fatalf("empty dir: ReadPersistedState returned %v, expected ErrNoState", err)
+	}
+
+	entries := func(from int, to int, term int) []LogEntry {
+		var es []LogEntry
+		for i := from; i <= to; i++ {
+			es = append(es, LogEntry{Term: term, Index: i, Command: i * 100})
+		}
+		return es
+	}
+	check := func(dir string, format string, included int, last int) *PersistedState {
+		st, err := ReadPersistedState(dir)
+		if err != nil {
+			t.Fatalf("%v: ReadPersistedState: %v", format, err)
+		}
+		if st.Format != format || st.CurrentTerm != 3 || st.VotedFor != 1 {
+			t.Fatalf("%v: read format %v, hard state (%v, %v)", format, st.Format, st.CurrentTerm, st.VotedFor)
+		}
+		if st.LastIncludedIndex != included || st.LastIndex() != last || string(st.Snapshot) != "snapshot" {
+			t.Fatalf("%v: read entries %v to %v, snapshot %q", format, st.LastIncludedIndex+1, st.LastIndex(), st.Snapshot)
+		}
+		for i, e := range st.Entries {
+			if e.Index != included+i+1 || e.Command != e.Index*100 {
+				t.Fatalf("%v: bad entry %v", format, e.debugString())
+			}
+		}
+		return st
+	}
+
+	// FilePersister: what persist() saves.
+	dir := t.TempDir()
+	fp, err := MakeFilePersister(dir)
+	if err != nil {
+		t.Fatalf("MakeFilePersister: %v", err)
+	}
+	logs := append([]LogEntry{{Term: 1, Index: 4}}, entries(5, 9, 2)...)
+	fp.SaveRaftState(encodeRaftState(raftState{CurrentTerm: 3, VotedFor: 1, Logs: logs, LastIncludedIndex: 4, LastIncludedTerm: 1}))
+	fp.SaveSnapshot([]byte("snapshot"))
+	check(dir, FormatFile, 4, 9)
+	if err := TruncatePersistedState(dir, 3); err == nil {
+		t.Fatalf("truncated into the snapshot")
+	}
+	if err := TruncatePersistedState(dir, 6); err != nil {
+		t.Fatalf("TruncatePersistedState: %v", err)
+	}
+	check(dir, FormatFile, 4, 6)
+
+	// WALPersister, with a torn record at the end that reading leaves alone.
+	dir = t.TempDir()
+	wp, err := MakeWALPersister(dir)
+	if err != nil {
+		t.Fatalf("MakeWALPersister: %v", err)
+	}
+	wp.SaveHardState(3, 1)
+	wp.AppendLogs(entries(1, 9, 2))
+	wp.CompactLogs(2, 2, ConfigChange{Servers: []int{0, 1, 2}})
+	wp.SaveSnapshot([]byte("snapshot"))
+	wp.Close()
+	segment := wp.segmentPath(0)
+	f, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("open segment: %v", err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 42, 42})
+	f.Close()
+	before, _ := ioutil.ReadFile(segment)
+	st := check(dir, FormatWAL, 2, 9)
+	if st.LastIncludedConfig == nil || len(st.LastIncludedConfig.Servers) != 3 {
+		t.Fatalf("wal: compaction was not replayed: %v", st.LastIncludedConfig)
+	}
+	if after, _ := ioutil.ReadFile(segment); !bytes.Equal(before, after) {
+		t.Fatalf("wal: ReadPersistedState changed the segment")
+	}
+	if err := TruncatePersistedState(dir, 5); err != nil {
+		t.Fatalf("TruncatePersistedState: %v", err)
+	}
+	check(dir, FormatWAL, 2, 5)
+	wp, err = MakeWALPersister(dir)
+	if err != nil {
+		t.Fatalf("MakeWALPersister after truncate: %v", err)
+	}
+	if st := wp.ReadLogState(); len(st.Entries) != 3 {
+		t.Fatalf("wal: recovered %v entries after truncate, expected 3", len(st.Entries))
+	}
+	wp.Close()
+
+	fmt.Printf("  ... Passed\n")
+}
+
+func TestConfig2A(t *testing.T) {
+	fmt.Printf("Test (2A): Config is validated and used ...\n")
+
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatalf("DefaultConfig() doesn't validate: %v", err)
+	}
+	bad := map[string]func(c *Config){
+		"no election timeout":  func(c *Config) { c.ElectionTimeoutMin = 0 },
+		"empty election range": func(c *Config) { c.ElectionTimeoutMax = c.ElectionTimeoutMin - 1 },
+		"no heartbeat":         func(c *Config) { c.HeartbeatInterval = 0 },
+		"heartbeat too slow":   func(c *Config) { c.HeartbeatInterval = c.ElectionTimeoutMin / 2 },
+		"no inflight batches":  func(c *Config) { c.MaxInflight = 0 },
+		"empty batches":        func(c *Config) { c.MaxBatchEntries = 0 },
+		"negative batch bytes": func(c *Config) { c.MaxBatchBytes = -1 },
+		"drift over the lease": func(c *Config) { c.LeaseRead = true; c.LeaseDrift = c.ElectionTimeoutMin },
+	}
+	for name, f := range bad {
+		conf := DefaultConfig()
+		f(&conf)
+		if err := conf.Validate(); !errors.Is(err, ErrBadConfig) {
+			t.Fatalf("%v: Validate() returned %v, expected ErrBadConfig", name, err)
+		}
+		rf, err := MakeWithConfig(nil, 0, MakePersister(), make(chan ApplyMsg), conf)
+		if rf != nil || !errors.Is(err, ErrBadConfig) {
+			t.Fatalf("%v: MakeWithConfig() returned %v, expected ErrBadConfig", name, err)
+		}
+		rf, err = MakeJoiningWithConfig(nil, 0, MakePersister(), make(chan ApplyMsg), conf)
+		if rf != nil || !errors.Is(err, ErrBadConfig) {
+			t.Fatalf("%v: MakeJoiningWithConfig() returned %v, expected ErrBadConfig", name, err)
+		}
+	}
+
+	conf := DefaultConfig()
+	conf.ElectionTimeoutMin = 1000 * time.Millisecond
+	conf.ElectionTimeoutMax = 1500 * time.Millisecond
+	conf.HeartbeatInterval = 150 * time.Millisecond
+	conf.PreVote = true
+	conf.Logger = nil
+	rf := &Raft{electionTimeoutMin: conf.ElectionTimeoutMin, electionTimeoutMax: conf.ElectionTimeoutMax}
+	for i := 0; i < 100; i++ {
+		if d := rf.randomElectionTimeout(); d < conf.ElectionTimeoutMin || d >= conf.ElectionTimeoutMax {
+			t.Fatalf("election timeout %v out of range", d)
+		}
+	}
+
+	// a cluster with the slower timing.
+	servers := 3
+	cfg := makeConfig(t, servers, false)
+	defer cfg.cleanup()
+	cfg.setRaftConfig(conf)
+	for i := 0; i < servers; i++ {
+		cfg.crash1(i)
+		cfg.start1(i)
+		cfg.connect(i)
+	}
+	leader := cfg.checkOneLeader()
+	cfg.one(101, servers)
+	for i := 0; i < servers; i++ {
+		cfg.rafts[i].mutex.Lock()
+		preVote := cfg.rafts[i].preVote
+		cfg.rafts[i].mutex.Unlock()
+		if !preVote {
+			t.Fatalf("server %v doesn't run PreVote, the Config says it does", i)
+		}
+	}
+
+	// the others wait at least ElectionTimeoutMin after the last heartbeat.
+	term := cfg.checkTerms()
+	cfg.disconnect(leader)
+	t0 := time.Now()
+	for {
+		elected := false
+		for i := 0; i < servers; i++ {
+			if term2, isLeader := cfg.rafts[i].GetState(); i != leader && isLeader && term2 > term {
+				elected = true
+			}
+		}
+		if elected {
+			break
+		}
+		if time.Since(t0) > 5*time.Second {
+			t.Fatalf("no new leader")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if d := time.Since(t0); d < conf.ElectionTimeoutMin-conf.HeartbeatInterval {
+		t.Fatalf("new leader after %v, before the election timeout", d)
+	}
+	cfg.one(102, servers-1)
+	cfg.connect(leader)
+	cfg.one(103, servers)
+
+	// a server that joins gets the same timing.
+	s := cfg.addServer()
+	cfg.addMember(s)
+	cfg.one(104, servers+1)
+	if min := cfg.rafts[s].electionTimeoutMin; min != conf.ElectionTimeoutMin {
+		t.Fatalf("joining server has election timeout %v, expected %v", min, conf.ElectionTimeoutMin)
+	}
+
+	fmt.Printf("  ... Passed\n")
+}
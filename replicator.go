@@ -0,0 +1,325 @@
+package raft
+
+//
+// the leader replicates its Logs with one replicator goroutine per
+// follower. a replicator wakes up when entries are appended, or once
+// per heartbeatInterval, and sends the entries from nextIndex on in
+// batches of at most maxBatchEntries entries and maxBatchBytes bytes
+// of commands. once the follower has accepted a batch, the replicator
+// doesn't wait for replies before sending the next one: up to
+// maxInflight batches are on the way and nextIndex runs ahead of
+// matchIndex. a rejected or lost batch resets nextIndex, and the
+// replicator goes back to one batch at a time (probing) until the
+// follower accepts one again. see SetReplication().
+//
+
+import (
+	"time"
+)
+
+const (
+	DefaultMaxInflight     = 8
+	DefaultMaxBatchEntries = 64
+	DefaultMaxBatchBytes   = 1 << 20
+)
+
+type replicator struct {
+	server       int
+	term         int       // the term this replicator's leader was elected in
+	triggerCh    chan bool // new entries or a free slot in the window
+	probing      bool      // at most one batch in flight until the follower accepts one
+	inflight     int       // batches of generation gen without a reply
+	gen          int       // bumped by every reset, replies to older batches don't free slots
+	progress     time.Time // last reply to a batch of generation gen, or the reset
+	snapshotting bool      // an InstallSnapshot is on the way, no batches until it's done
+	lastSend     time.Time
+}
+
+//
+// limits for replicating the Logs: at most maxInflight AppendEntries
+// with entries on the way to each follower, each carrying at most
+// maxEntries entries and maxBytes bytes of commands (but at least one
+// entry). maxInflight 1 waits for every reply before sending more.
+// the defaults are DefaultMaxInflight, DefaultMaxBatchEntries and
+// DefaultMaxBatchBytes.
+//
+func (rf *Raft) SetReplication(maxInflight int, maxEntries int, maxBytes int) {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	rf.maxInflight = intMax(1, maxInflight)
+	rf.maxBatchEntries = intMax(1, maxEntries)
+	rf.maxBatchBytes = maxBytes
+}
+
+// a batch of the current generation without any reply for this long is
+// considered lost, e.g. the follower was disconnected.
+func (rf *Raft) batchTimeout() time.Duration {
+	return 4 * rf.heartbeatInterval
+}
+
+// start a replicator for each follower that has none in this term.
+// caller must hold rf.mutex, only on leaders.
+func (rf *Raft) startReplicators() {
+	for _, server := range rf.config.allServers() {
+		if server == rf.me {
+			continue
+		}
+		if r, ok := rf.replicators[server]; ok && r.term == rf.CurrentTerm {
+			continue
+		}
+		r := &replicator{
+			server:    server,
+			term:      rf.CurrentTerm,
+			triggerCh: make(chan bool, 1),
+			probing:   true,
+			progress:  time.Now(),
+		}
+		rf.replicators[server] = r
+		rf.goFunc(func() { rf.replicate(r) })
+	}
+}
+
+// wake up all replicators, e.g. entries were appended. caller must hold rf.mutex.
+func (rf *Raft) triggerReplicators() {
+	for _, r := range rf.replicators {
+		r.trigger()
+	}
+}
+
+func (r *replicator) trigger() {
+	// 已经有一个信号就够了，不能阻塞，调用者持有rf.mutex
+	select {
+	case r.triggerCh <- true:
+	default:
+	}
+}
+
+func (rf *Raft) replicate(r *replicator) {
+	for {
+		rf.mutex.Lock()
+		if rf.killed() || !rf.checkState(Leader, r.term) || rf.replicators[r.server] != r ||
+			!containsServer(rf.config.allServers(), r.server) {
+			// 不再是leader，或者server已经被移出configuration
+			if rf.replicators[r.server] == r {
+				delete(rf.replicators, r.server)
+			}
+			rf.mutex.Unlock()
+			return
+		}
+		rf.sendBatches(r)
+		wait := rf.heartbeatInterval - time.Since(r.lastSend)
+		rf.mutex.Unlock()
+
+		select {
+		case <-r.triggerCh:
+		case <-rf.ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+}
+
+// the follower needs to be resent everything from next on. caller must hold rf.mutex.
+func (rf *Raft) resetReplicator(r *replicator, next int) {
+	r.gen++
+	r.inflight = 0
+	r.probing = true
+	r.progress = time.Now()
+	rf.nextIndex[r.server] = next
+	r.trigger()
+}
+
+// send what fits into the window, and a heartbeat if one is due.
+// caller must hold rf.mutex.
+func (rf *Raft) sendBatches(r *replicator) {
+	if r.inflight > 0 && time.Since(r.progress) > rf.batchTimeout() {
+		rf.logger.Infof("Server(%v=>%v) batches timed out, nextIndex %v => %v", rf.me, r.server, rf.nextIndex[r.server], rf.matchIndex[r.server]+1)
+		rf.resetReplicator(r, rf.matchIndex[r.server]+1)
+	}
+
+	heartbeatDue := time.Since(r.lastSend) >= rf.heartbeatInterval
+	window := rf.maxInflight
+	if r.probing {
+		window = 1
+	}
+	for !r.snapshotting && r.inflight < window {
+		next := rf.nextIndex[r.server]
+		if next <= rf.LastIncludedIndex {
+			// follower需要的entries已经被compact掉了，没法通过AppendEntries追上，改发snapshot
+			r.snapshotting = true
+			r.lastSend = time.Now()
+			heartbeatDue = false
+			args := rf.installSnapshotArgs()
+			rf.goFunc(func() { rf.sendSnapshot(r, args) })
+			break
+		}
+		if next > rf.getLastLogIndex() && !heartbeatDue {
+			break
+		}
+		// 没有新的entries时就是一个heartbeat
+		entries := rf.batch(next)
+		args := AppendEntriesArgs{
+			Term:         r.term,
+			LeaderId:     rf.me,
+			PrevLogIndex: next - 1,
+			PrevLogTerm:  rf.getLogTerm(next - 1),
+			Entries:      entries,
+			LeaderCommit: rf.commitIndex,
+		}
+		r.inflight++
+		rf.nextIndex[r.server] = next + len(entries)
+		r.lastSend = time.Now()
+		heartbeatDue = false
+		gen := r.gen
+		rf.goFunc(func() { rf.sendBatch(r, gen, args) })
+	}
+
+	if heartbeatDue {
+		// window满了也要发heartbeat，否则follower会开始选举
+		// 用matchIndex做PrevLogIndex，不会因为还在路上的batches被拒绝
+		prevLogIndex := intMax(rf.matchIndex[r.server], rf.LastIncludedIndex)
+		args := AppendEntriesArgs{
+			Term:         r.term,
+			LeaderId:     rf.me,
+			PrevLogIndex: prevLogIndex,
+			PrevLogTerm:  rf.getLogTerm(prevLogIndex),
+			Entries:      []LogEntry{},
+			LeaderCommit: rf.commitIndex,
+		}
+		r.lastSend = time.Now()
+		rf.goFunc(func() { rf.sendHeartbeat(r, args) })
+	}
+}
+
+// entries from next on, within the batch limits. caller must hold rf.mutex.
+func (rf *Raft) batch(next int) []LogEntry {
+	entries := make([]LogEntry, 0)
+	size := 0
+	for i := next; i <= rf.getLastLogIndex() && len(entries) < rf.maxBatchEntries; i++ {
+		entry := rf.getLogEntry(i)
+		n := 0
+		if data, ok := entry.Command.([]byte); ok {
+			n = len(data)
+		}
+		if len(entries) > 0 && size+n > rf.maxBatchBytes {
+			break
+		}
+		size += n
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (rf *Raft) sendBatch(r *replicator, gen int, args AppendEntriesArgs) {
+	reply := &AppendEntriesReply{}
+	sendTime := time.Now()
+	ok := rf.sendAppendEntries(r.server, args, reply)
+	rf.logger.Infof("SendAppendEntries (%v=>%v), prevLogIndex:%v, entries:%v", rf.me, r.server, args.PrevLogIndex, len(args.Entries))
+
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	current := gen == r.gen
+	if current {
+		r.inflight--
+		r.progress = time.Now()
+	}
+	if !ok {
+		if current {
+			rf.resetReplicator(r, rf.matchIndex[r.server]+1)
+		}
+		return
+	}
+	if reply.Term > rf.CurrentTerm {
+		rf.convertToFollower(reply.Term)
+		return
+	}
+	if !rf.checkState(Leader, args.Term) {
+		return
+	}
+	rf.updateLastContact(r.server, sendTime)
+
+	if reply.Success {
+		// AppendEntries成功，更新对应raft实例的nextIndex和matchIndex值, Leader 5.3
+		// replies可能乱序到达，matchIndex不能变小
+		match := args.PrevLogIndex + len(args.Entries)
+		if match > rf.matchIndex[r.server] {
+			rf.matchIndex[r.server] = match
+			rf.logger.Infof("SendAppendEntries Success(%v => %v), matchIndex:%v", rf.me, r.server, match)
+			rf.advanceCommitIndex()
+		}
+		if rf.nextIndex[r.server] <= match {
+			rf.nextIndex[r.server] = match + 1
+		}
+		if current {
+			r.probing = false
+		}
+		r.trigger()
+	} else if current {
+		// AppendEntries失败，减小对应raft实例的nextIndex的值重试 paper 5.3
+		// 这里要注意理解conflictIndex,conflictTerm在减少重试次数方面起的作用
+		newIndex := reply.ConflictIndex
+		for i := rf.LastIncludedIndex + 1; i <= rf.getLastLogIndex(); i++ {
+			if rf.getLogTerm(i) == reply.ConflictTerm {
+				newIndex = i + 1
+			}
+		}
+		rf.logger.Infof("SendAppendEntries failed(%v => %v), nextIndex %v => %v", rf.me, r.server, rf.nextIndex[r.server], newIndex)
+		rf.resetReplicator(r, intMax(rf.matchIndex[r.server]+1, newIndex))
+	}
+}
+
+// a heartbeat only keeps the follower from starting an election and
+// tells it the commitIndex, a rejected one doesn't matter.
+func (rf *Raft) sendHeartbeat(r *replicator, args AppendEntriesArgs) {
+	reply := &AppendEntriesReply{}
+	sendTime := time.Now()
+	if !rf.sendAppendEntries(r.server, args, reply) {
+		return
+	}
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	if reply.Term > rf.CurrentTerm {
+		rf.convertToFollower(reply.Term)
+		return
+	}
+	if rf.checkState(Leader, args.Term) {
+		rf.updateLastContact(r.server, sendTime)
+	}
+}
+
+// caller must hold rf.mutex.
+func (rf *Raft) installSnapshotArgs() InstallSnapshotArgs {
+	return InstallSnapshotArgs{
+		Term:               rf.CurrentTerm,
+		LeaderId:           rf.me,
+		LastIncludedIndex:  rf.LastIncludedIndex,
+		LastIncludedTerm:   rf.LastIncludedTerm,
+		LastIncludedConfig: rf.LastIncludedConfig,
+		Data:               rf.persister.ReadSnapshot(),
+	}
+}
+
+func (rf *Raft) sendSnapshot(r *replicator, args InstallSnapshotArgs) {
+	reply := &InstallSnapshotReply{}
+	sendTime := time.Now()
+	ok := rf.sendInstallSnapshot(r.server, args, reply)
+	rf.logger.Infof("SendInstallSnapshot (%v=>%v), lastIncludedIndex:%v", rf.me, r.server, args.LastIncludedIndex)
+
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+	r.snapshotting = false
+	if !ok {
+		r.trigger()
+		return
+	}
+	if reply.Term > rf.CurrentTerm {
+		rf.convertToFollower(reply.Term)
+		return
+	}
+	if !rf.checkState(Leader, args.Term) {
+		return
+	}
+	rf.updateLastContact(r.server, sendTime)
+	// follower现在至少有LastIncludedIndex之前的所有entries
+	rf.matchIndex[r.server] = intMax(rf.matchIndex[r.server], args.LastIncludedIndex)
+	rf.resetReplicator(r, rf.matchIndex[r.server]+1)
+}
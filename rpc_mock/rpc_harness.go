@@ -100,7 +100,8 @@ func (e *ClientEnd) Call(svcMeth string, args interface{}, reply interface{}) bo
 	rep, ok := <-req.replyCh
 	// read from a closed channel will not panic,
 	// but get default value, use os-idiom
-	if ok {
+	// rep.ok is false if the request or reply was lost, or the server is dead
+	if ok && rep.ok {
 		rb := bytes.NewBuffer(rep.reply)
 		rd := gob.NewDecoder(rb)
 		if err := rd.Decode(reply); err != nil && err != io.EOF {
@@ -381,6 +382,40 @@ func (rs *Server) dispatch(req reqMsg) replyMsg {
 	}
 }
 
+//
+// dispatch a request that came in over TCP. unlike on the Network,
+// the caller's args type isn't known, so args are decoded as the type
+// the handler declares. an unknown service or method fails the call
+// instead of the process.
+//
+func (rs *Server) dispatchTCP(svcMeth string, args []byte) replyMsg {
+	rs.mu.Lock()
+	rs.count += 1
+	dot := strings.LastIndex(svcMeth, ".")
+	var service *Service
+	if dot >= 0 {
+		service = rs.services[svcMeth[:dot]]
+	}
+	rs.mu.Unlock()
+
+	if service == nil {
+		log.Warnf("labrpc.Server.dispatchTCP(): unknown service in %v", svcMeth)
+		return replyMsg{false, nil}
+	}
+	methodName := svcMeth[dot+1:]
+	method, ok := service.methods[methodName]
+	if !ok {
+		log.Warnf("labrpc.Server.dispatchTCP(): unknown method in %v", svcMeth)
+		return replyMsg{false, nil}
+	}
+	req := reqMsg{
+		svcMeth:  svcMeth,
+		argsType: method.Type.In(1),
+		args:     args,
+	}
+	return service.dispatch(methodName, req)
+}
+
 func (rs *Server) GetCount() int {
 	rs.mu.Lock()
 	defer rs.mu.Unlock()
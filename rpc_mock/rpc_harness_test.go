@@ -163,6 +163,44 @@ func TestDisconnect(t *testing.T) {
 	}
 }
 
+//
+// a request that the network drops, or that reaches no server, must
+// fail the Call, not return true with an empty reply.
+//
+func TestLost(t *testing.T) {
+	runtime.GOMAXPROCS(4)
+
+	rn := MakeNetwork()
+
+	e := rn.MakeEnd("end1-99")
+
+	js := &JunkServer{}
+	svc := MakeService(js)
+
+	rs := MakeServer()
+	rs.AddService(svc)
+	rn.AddServer("server99", rs)
+
+	rn.Connect("end1-99", "server99")
+
+	{
+		reply := ""
+		if ok := e.Call("JunkServer.Handler2", 111, &reply); ok {
+			t.Fatalf("Call on a disabled end succeeded")
+		}
+	}
+
+	rn.Enable("end1-99", true)
+	rn.DeleteServer("server99")
+
+	{
+		reply := ""
+		if ok := e.Call("JunkServer.Handler2", 111, &reply); ok {
+			t.Fatalf("Call to a deleted server succeeded")
+		}
+	}
+}
+
 //
 // test net.GetCount()
 //
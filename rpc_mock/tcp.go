@@ -0,0 +1,316 @@
+package rpc_mock
+
+//
+// the same RPCs over TCP, so that servers can run as separate
+// processes instead of on the simulated Network.
+//
+// l, err := Listen(addr, srv) -- serve srv's services on addr.
+// l.Close() -- stop listening and close the connections.
+// c := MakeTCPClient(addr) -- a client end-point, to talk to the server at addr.
+// c.Call("Raft.AppendEntries", args, &reply) -- like ClientEnd.Call().
+//
+// a TCPClient keeps one connection to its server and sends concurrent
+// Call()s over it, replies are matched to calls by sequence number.
+// it dials on the first Call(), and again after the connection broke.
+// Call() returns false if the server can't be reached, the connection
+// breaks, or no reply arrives within the client's timeout. so, like
+// ClientEnd.Call(), it's guaranteed to return.
+//
+// requests and replies are gob-encoded like on the Network. the server
+// decodes args as the type the handler declares, and dispatches them
+// to the same Service as the Network does.
+//
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const DefaultTCPTimeout = time.Second
+
+var errClientClosed = errors.New("rpc_mock: client closed")
+
+// how a TCPClient connects, tests replace it.
+var dialTimeout = net.DialTimeout
+
+type tcpRequest struct {
+	Seq     uint64
+	SvcMeth string // e.g. "Raft.AppendEntries"
+	Args    []byte
+}
+
+type tcpReply struct {
+	Seq   uint64
+	OK    bool // false if the server has no such service or method
+	Reply []byte
+}
+
+type TCPClient struct {
+	addr    string
+	timeout time.Duration
+
+	mu      sync.Mutex
+	conn    net.Conn // nil until dialed, or after it broke
+	enc     *gob.Encoder
+	seq     uint64
+	pending map[uint64]chan tcpReply // calls on conn waiting for a reply
+	closed  bool
+}
+
+func MakeTCPClient(addr string) *TCPClient {
+	c := &TCPClient{}
+	c.addr = addr
+	c.timeout = DefaultTCPTimeout
+	c.pending = map[uint64]chan tcpReply{}
+	return c
+}
+
+// how long Call() waits for the connection and the reply.
+func (c *TCPClient) SetTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timeout = timeout
+}
+
+// send an RPC, wait for the reply.
+// the return value indicates success; false means that
+// no reply was received from the server.
+func (c *TCPClient) Call(svcMeth string, args interface{}, reply interface{}) bool {
+	qb := new(bytes.Buffer)
+	qe := gob.NewEncoder(qb)
+	if err := qe.Encode(args); err != nil {
+		log.Warnf("TCPClient.Call(%v): encode args: %v", svcMeth, err)
+		return false
+	}
+
+	ch := make(chan tcpReply, 1)
+	seq, timeout, err := c.send(svcMeth, qb.Bytes(), ch)
+	if err != nil {
+		log.Debugf("TCPClient.Call(%v) to %v: %v", svcMeth, c.addr, err)
+		return false
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case rep, ok := <-ch:
+		// ch is closed if the connection broke
+		if !ok || !rep.OK {
+			return false
+		}
+		rb := bytes.NewBuffer(rep.Reply)
+		rd := gob.NewDecoder(rb)
+		if err := rd.Decode(reply); err != nil && err != io.EOF {
+			log.Warnf("TCPClient.Call(%v): decode reply: %v", svcMeth, err)
+			return false
+		}
+		return true
+	case <-timer.C:
+		c.mu.Lock()
+		delete(c.pending, seq)
+		c.mu.Unlock()
+		return false
+	}
+}
+
+// register ch for the reply and write the request, dialing first if
+// there's no connection.
+func (c *TCPClient) send(svcMeth string, args []byte, ch chan tcpReply) (uint64, time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, 0, errClientClosed
+	}
+	if c.conn == nil {
+		// dial的时候不能占着c.mu，否则别的Call()和Close()都要等它超时
+		timeout := c.timeout
+		c.mu.Unlock()
+		conn, err := dialTimeout("tcp", c.addr, timeout)
+		c.mu.Lock()
+		if err != nil {
+			return 0, 0, err
+		}
+		if c.closed {
+			conn.Close()
+			return 0, 0, errClientClosed
+		}
+		if c.conn == nil {
+			c.conn = conn
+			c.enc = gob.NewEncoder(conn)
+			go c.readReplies(conn)
+		} else {
+			// 另一个Call()已经连上了
+			conn.Close()
+		}
+	}
+
+	c.seq++
+	seq := c.seq
+	c.pending[seq] = ch
+	// 一个写不出去的连接不能让所有Call()一直等下去
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if err := c.enc.Encode(tcpRequest{Seq: seq, SvcMeth: svcMeth, Args: args}); err != nil {
+		// gob的encoder写失败后就不能再用了
+		c.breakConn(c.conn)
+		return 0, 0, err
+	}
+	return seq, c.timeout, nil
+}
+
+func (c *TCPClient) readReplies(conn net.Conn) {
+	dec := gob.NewDecoder(conn)
+	for {
+		var rep tcpReply
+		if err := dec.Decode(&rep); err != nil {
+			c.mu.Lock()
+			c.breakConn(conn)
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Lock()
+		if ch, ok := c.pending[rep.Seq]; ok {
+			delete(c.pending, rep.Seq)
+			ch <- rep
+		}
+		c.mu.Unlock()
+	}
+}
+
+// close conn and fail the calls waiting on it, the next Call() dials
+// again. caller must hold c.mu.
+func (c *TCPClient) breakConn(conn net.Conn) {
+	if c.conn != conn {
+		return
+	}
+	conn.Close()
+	c.conn = nil
+	c.enc = nil
+	for seq, ch := range c.pending {
+		delete(c.pending, seq)
+		close(ch)
+	}
+}
+
+// close the connection, later Call()s return false.
+func (c *TCPClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.conn != nil {
+		c.breakConn(c.conn)
+	}
+	return nil
+}
+
+type TCPListener struct {
+	rs       *Server
+	listener net.Listener
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+	wg     sync.WaitGroup // serve() and connection goroutines
+}
+
+//
+// listen on addr, e.g. "localhost:7001" or ":0" for any free port,
+// and serve the services of rs to TCPClients.
+//
+func Listen(addr string, rs *Server) (*TCPListener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	tl := &TCPListener{}
+	tl.rs = rs
+	tl.listener = listener
+	tl.conns = map[net.Conn]bool{}
+	tl.wg.Add(1)
+	go tl.serve()
+	return tl, nil
+}
+
+// the address it listens on, with the port picked for ":0".
+func (tl *TCPListener) Addr() net.Addr {
+	return tl.listener.Addr()
+}
+
+//
+// stop accepting connections and close the open ones. returns once
+// no more requests are read, handlers that are already running may
+// still finish.
+//
+func (tl *TCPListener) Close() error {
+	tl.mu.Lock()
+	tl.closed = true
+	err := tl.listener.Close()
+	for conn := range tl.conns {
+		conn.Close()
+	}
+	tl.mu.Unlock()
+	tl.wg.Wait()
+	return err
+}
+
+func (tl *TCPListener) serve() {
+	defer tl.wg.Done()
+	for {
+		conn, err := tl.listener.Accept()
+		if err != nil {
+			tl.mu.Lock()
+			closed := tl.closed
+			tl.mu.Unlock()
+			if closed {
+				return
+			}
+			log.Warnf("TCPListener.Accept(): %v", err)
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+
+		tl.mu.Lock()
+		if tl.closed {
+			tl.mu.Unlock()
+			conn.Close()
+			return
+		}
+		tl.conns[conn] = true
+		tl.wg.Add(1)
+		tl.mu.Unlock()
+		go tl.serveConn(conn)
+	}
+}
+
+func (tl *TCPListener) serveConn(conn net.Conn) {
+	defer tl.wg.Done()
+	defer func() {
+		tl.mu.Lock()
+		delete(tl.conns, conn)
+		tl.mu.Unlock()
+		conn.Close()
+	}()
+
+	var encMu sync.Mutex
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+	for {
+		var req tcpRequest
+		if err := dec.Decode(&req); err != nil {
+			return
+		}
+		// 和Network一样，每个请求在单独的goroutine中执行，handler可能会阻塞
+		go func() {
+			r := tl.rs.dispatchTCP(req.SvcMeth, req.Args)
+			encMu.Lock()
+			defer encMu.Unlock()
+			// 连接断了client会超时，不需要处理错误
+			enc.Encode(tcpReply{Seq: req.Seq, OK: r.ok, Reply: r.reply})
+		}()
+	}
+}
@@ -0,0 +1,205 @@
+package rpc_mock
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func listenJunk(t *testing.T, addr string) (*TCPListener, *JunkServer) {
+	js := &JunkServer{}
+	rs := MakeServer()
+	rs.AddService(MakeService(js))
+	l, err := Listen(addr, rs)
+	if err != nil {
+		t.Fatalf("Listen(%v): %v", addr, err)
+	}
+	return l, js
+}
+
+func TestTCPBasic(t *testing.T) {
+	l, js := listenJunk(t, "localhost:0")
+	defer l.Close()
+	c := MakeTCPClient(l.Addr().String())
+	defer c.Close()
+
+	{
+		reply := ""
+		if !c.Call("JunkServer.Handler2", 111, &reply) || reply != "handler2-111" {
+			t.Fatalf("wrong reply from Handler2: %q", reply)
+		}
+	}
+	{
+		reply := 0
+		if !c.Call("JunkServer.Handler1", "9099", &reply) || reply != 9099 {
+			t.Fatalf("wrong reply from Handler1: %v", reply)
+		}
+	}
+	{
+		reply := &JunkReply{}
+		if !c.Call("JunkServer.Handler4", &JunkArgs{4}, reply) || reply.X != "pointer" {
+			t.Fatalf("wrong reply from Handler4: %q", reply.X)
+		}
+	}
+	{
+		reply := &JunkReply{}
+		if !c.Call("JunkServer.Handler5", JunkArgs{5}, reply) || reply.X != "no pointer" {
+			t.Fatalf("wrong reply from Handler5: %q", reply.X)
+		}
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if len(js.log1) != 1 || js.log1[0] != "9099" || len(js.log2) != 1 || js.log2[0] != 111 {
+		t.Fatalf("wrong handler logs %v %v", js.log1, js.log2)
+	}
+}
+
+func TestTCPUnknownMethod(t *testing.T) {
+	l, _ := listenJunk(t, "localhost:0")
+	defer l.Close()
+	c := MakeTCPClient(l.Addr().String())
+	defer c.Close()
+
+	reply := ""
+	if c.Call("JunkServer.NoSuchHandler", 1, &reply) {
+		t.Fatalf("call to an unknown method succeeded")
+	}
+	if c.Call("NoSuchServer.Handler2", 1, &reply) {
+		t.Fatalf("call to an unknown service succeeded")
+	}
+	// the connection is still usable
+	if !c.Call("JunkServer.Handler2", 1, &reply) || reply != "handler2-1" {
+		t.Fatalf("wrong reply from Handler2: %q", reply)
+	}
+}
+
+func TestTCPConcurrent(t *testing.T) {
+	l, js := listenJunk(t, "localhost:0")
+	defer l.Close()
+	c := MakeTCPClient(l.Addr().String())
+	defer c.Close()
+
+	nclients := 20
+	nrpcs := 50
+	var wg sync.WaitGroup
+	for i := 0; i < nclients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < nrpcs; j++ {
+				arg := i*100 + j
+				reply := ""
+				if !c.Call("JunkServer.Handler2", arg, &reply) {
+					t.Errorf("Call(%v) failed", arg)
+					return
+				}
+				if reply != "handler2-"+strconv.Itoa(arg) {
+					t.Errorf("wrong reply %q for %v", reply, arg)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if len(js.log2) != nclients*nrpcs {
+		t.Fatalf("%v RPCs executed, expected %v", len(js.log2), nclients*nrpcs)
+	}
+}
+
+//
+// Call() returns false while the server is down, and works
+// again once a server listens on the address.
+//
+func TestTCPReconnect(t *testing.T) {
+	l, _ := listenJunk(t, "localhost:0")
+	addr := l.Addr().String()
+	c := MakeTCPClient(addr)
+	defer c.Close()
+
+	reply := ""
+	if !c.Call("JunkServer.Handler2", 1, &reply) {
+		t.Fatalf("Call() failed")
+	}
+	l.Close()
+	if c.Call("JunkServer.Handler2", 2, &reply) {
+		t.Fatalf("Call() succeeded with the server down")
+	}
+
+	l, _ = listenJunk(t, addr)
+	defer l.Close()
+	if !c.Call("JunkServer.Handler2", 3, &reply) || reply != "handler2-3" {
+		t.Fatalf("Call() failed after the server came back: %q", reply)
+	}
+}
+
+//
+// a stuck handler doesn't keep Call() from returning.
+//
+func TestTCPTimeout(t *testing.T) {
+	l, _ := listenJunk(t, "localhost:0")
+	defer l.Close()
+	c := MakeTCPClient(l.Addr().String())
+	defer c.Close()
+	c.SetTimeout(200 * time.Millisecond)
+
+	t0 := time.Now()
+	reply := 0
+	if c.Call("JunkServer.Handler3", 99, &reply) {
+		t.Fatalf("Handler3 returned before the timeout")
+	}
+	if d := time.Since(t0); d > time.Second {
+		t.Fatalf("Call() took %v with a 200ms timeout", d)
+	}
+
+	// other calls on the connection are not held up,
+	// Handler3 holds js.mu so use one that doesn't lock
+	jreply := &JunkReply{}
+	if !c.Call("JunkServer.Handler4", &JunkArgs{4}, jreply) || jreply.X != "pointer" {
+		t.Fatalf("wrong reply from Handler4: %q", jreply.X)
+	}
+}
+
+//
+// a slow dial doesn't hold up Close() or the other calls.
+//
+func TestTCPSlowDial(t *testing.T) {
+	l, _ := listenJunk(t, "localhost:0")
+	defer l.Close()
+	release := make(chan bool)
+	dialTimeout = func(network string, addr string, timeout time.Duration) (net.Conn, error) {
+		<-release
+		return net.DialTimeout(network, addr, timeout)
+	}
+	defer func() { dialTimeout = net.DialTimeout }()
+
+	c := MakeTCPClient(l.Addr().String())
+	done := make(chan bool)
+	go func() {
+		reply := ""
+		done <- c.Call("JunkServer.Handler2", 1, &reply)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan bool)
+	go func() {
+		c.SetTimeout(200 * time.Millisecond)
+		c.Close()
+		closed <- true
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("Close() waited for the dial")
+	}
+
+	close(release)
+	if <-done {
+		t.Fatalf("Call() succeeded on a closed client")
+	}
+}
@@ -0,0 +1,136 @@
+package raft
+
+//
+// the settings of a Raft server, passed to MakeWithConfig(). start
+// from DefaultConfig() and change what's needed:
+//
+// conf := raft.DefaultConfig()
+// conf.ElectionTimeoutMin = time.Second
+// conf.ElectionTimeoutMax = 2 * time.Second
+// conf.HeartbeatInterval = 100 * time.Millisecond
+// rf, err := raft.MakeWithConfig(peers, me, persister, applyCh, conf)
+//
+// the timing must be the same on every server of a cluster, and the
+// behavior switches too (see the Set methods they correspond to).
+//
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"time"
+)
+
+var ErrBadConfig = errors.New("raft: invalid config")
+
+//
+// where a Raft server logs to. a *logrus.Logger is one.
+//
+type Logger interface {
+	Infof(format string, args ...interface{})
+}
+
+type Config struct {
+	// a follower or candidate that hears from no leader starts an
+	// election after a random timeout in [ElectionTimeoutMin,
+	// ElectionTimeoutMax). CheckQuorum, lease reads and leadership
+	// transfer measure time in ElectionTimeoutMin.
+	ElectionTimeoutMin time.Duration
+	ElectionTimeoutMax time.Duration
+	// how often a leader sends AppendEntries to each follower when
+	// there is nothing new to send. at most a third of
+	// ElectionTimeoutMin, so a single lost heartbeat doesn't start an
+	// election.
+	HeartbeatInterval time.Duration
+
+	// see SetReplication()
+	MaxInflight     int
+	MaxBatchEntries int
+	MaxBatchBytes   int
+
+	PreVote     bool          // see SetPreVote()
+	CheckQuorum bool          // see SetCheckQuorum()
+	NoOp        bool          // see SetNoOp()
+	LeaseRead   bool          // see SetLeaseRead()
+	LeaseDrift  time.Duration // less than ElectionTimeoutMin
+	Codec       Codec         // see SetCodec(), nil for GobCodec{}
+
+	Logger Logger // nil for no logging
+}
+
+//
+// what Make() uses.
+//
+func DefaultConfig() Config {
+	return Config{
+		ElectionTimeoutMin: time.Duration(MinElectionTimeout) * time.Millisecond,
+		ElectionTimeoutMax: time.Duration(MinElectionTimeout+100) * time.Millisecond,
+		HeartbeatInterval:  time.Duration(HeartbeatInterval) * time.Millisecond,
+		MaxInflight:        DefaultMaxInflight,
+		MaxBatchEntries:    DefaultMaxBatchEntries,
+		MaxBatchBytes:      DefaultMaxBatchBytes,
+		Codec:              GobCodec{},
+		Logger:             logrusLogger{},
+	}
+}
+
+//
+// returns an error wrapping ErrBadConfig if the settings can't work.
+//
+func (c Config) Validate() error {
+	switch {
+	case c.ElectionTimeoutMin <= 0:
+		return fmt.Errorf("%w: ElectionTimeoutMin %v isn't positive", ErrBadConfig, c.ElectionTimeoutMin)
+	case c.ElectionTimeoutMax < c.ElectionTimeoutMin:
+		return fmt.Errorf("%w: ElectionTimeoutMax %v is below ElectionTimeoutMin %v", ErrBadConfig, c.ElectionTimeoutMax, c.ElectionTimeoutMin)
+	case c.HeartbeatInterval <= 0:
+		return fmt.Errorf("%w: HeartbeatInterval %v isn't positive", ErrBadConfig, c.HeartbeatInterval)
+	case 3*c.HeartbeatInterval > c.ElectionTimeoutMin:
+		return fmt.Errorf("%w: HeartbeatInterval %v is more than a third of ElectionTimeoutMin %v", ErrBadConfig, c.HeartbeatInterval, c.ElectionTimeoutMin)
+	case c.MaxInflight < 1:
+		return fmt.Errorf("%w: MaxInflight %v is below 1", ErrBadConfig, c.MaxInflight)
+	case c.MaxBatchEntries < 1:
+		return fmt.Errorf("%w: MaxBatchEntries %v is below 1", ErrBadConfig, c.MaxBatchEntries)
+	case c.MaxBatchBytes < 0:
+		return fmt.Errorf("%w: MaxBatchBytes %v is negative", ErrBadConfig, c.MaxBatchBytes)
+	case c.LeaseDrift < 0 || (c.LeaseRead && c.LeaseDrift >= c.ElectionTimeoutMin):
+		return fmt.Errorf("%w: LeaseDrift %v must be in [0, ElectionTimeoutMin)", ErrBadConfig, c.LeaseDrift)
+	}
+	return nil
+}
+
+// a random election timeout from the configured range.
+func (rf *Raft) randomElectionTimeout() time.Duration {
+	span := rf.electionTimeoutMax - rf.electionTimeoutMin
+	if span <= 0 {
+		return rf.electionTimeoutMin
+	}
+	return rf.electionTimeoutMin + time.Duration(rand.Int63n(int64(span)))
+}
+
+type logrusLogger struct{}
+
+func (logrusLogger) Infof(format string, args ...interface{}) {
+	log.Infof(format, args...)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Infof(format string, args ...interface{}) {}
+
+// a logger that is nil logs nothing.
+func orNop(logger Logger) Logger {
+	if logger == nil {
+		return nopLogger{}
+	}
+	return logger
+}
+
+// for errors a server can't go on after, e.g. a failed write of its
+// state. logs through logger, then panics: a Logger can't end the
+// process like log.Fatalf(), and a nopLogger would hide the error.
+func fatalf(logger Logger, format string, args ...interface{}) {
+	logger.Infof(format, args...)
+	panic(fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,78 @@
+package raft
+
+import "time"
+
+//
+// what a Raft server knows about itself, for operators and tools
+// like cmd/raftctl. Progress is only filled in on leaders.
+//
+type Status struct {
+	Id                int
+	Role              string // "follower", "precandidate", "candidate", "leader" or "shutdown"
+	Term              int
+	VotedFor          int
+	CommitIndex       int
+	LastApplied       int
+	LastLogIndex      int
+	LastLogTerm       int
+	LastIncludedIndex int // the Logs before this index are in the snapshot
+	LastIncludedTerm  int
+	Config            ConfigChange
+	Progress          map[int]PeerProgress // follower => replication state, only on leaders
+}
+
+// how far the leader has replicated its Logs to a follower.
+type PeerProgress struct {
+	NextIndex   int
+	MatchIndex  int
+	Inflight    int       // AppendEntries with entries waiting for a reply
+	Probing     bool      // one batch at a time until the follower accepts one
+	LastContact time.Time // send time of the latest RPC in this term it replied to
+}
+
+// a consistent snapshot of this server's state.
+func (rf *Raft) Status() Status {
+	rf.mutex.Lock()
+	defer rf.mutex.Unlock()
+
+	role := rf.state
+	if rf.killed() {
+		role = Shutdown
+	}
+	status := Status{
+		Id:                rf.me,
+		Role:              role.debugString(),
+		Term:              rf.CurrentTerm,
+		VotedFor:          rf.VotedFor,
+		CommitIndex:       rf.commitIndex,
+		LastApplied:       rf.lastApplied,
+		LastLogIndex:      rf.getLastLogIndex(),
+		LastLogTerm:       rf.getLastLogTerm(),
+		LastIncludedIndex: rf.LastIncludedIndex,
+		LastIncludedTerm:  rf.LastIncludedTerm,
+		Config: ConfigChange{
+			Servers:    append([]int(nil), rf.config.Servers...),
+			OldServers: append([]int(nil), rf.config.OldServers...),
+		},
+	}
+	if role != Leader {
+		return status
+	}
+	status.Progress = make(map[int]PeerProgress)
+	for _, server := range rf.config.allServers() {
+		if server == rf.me {
+			continue
+		}
+		progress := PeerProgress{
+			NextIndex:   rf.nextIndex[server],
+			MatchIndex:  rf.matchIndex[server],
+			LastContact: rf.lastContact[server],
+		}
+		if r, ok := rf.replicators[server]; ok {
+			progress.Inflight = r.inflight
+			progress.Probing = r.probing
+		}
+		status.Progress[server] = progress
+	}
+	return status
+}
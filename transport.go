@@ -0,0 +1,22 @@
+package raft
+
+import "raft/rpc_mock"
+
+//
+// how a Raft sends RPCs to one of its peers: *rpc_mock.ClientEnd on
+// the tester's simulated network, or *rpc_mock.TCPClient to a peer in
+// another process that serves the Raft with rpc_mock.Listen().
+//
+// Call() sends an RPC like "Raft.AppendEntries" and waits for the
+// reply. it returns true if the peer executed the request and reply
+// is valid, false if the request or reply was lost or the peer is
+// down. it must return eventually, Raft calls it concurrently.
+//
+type Transport interface {
+	Call(svcMeth string, args interface{}, reply interface{}) bool
+}
+
+var (
+	_ Transport = (*rpc_mock.ClientEnd)(nil)
+	_ Transport = (*rpc_mock.TCPClient)(nil)
+)
@@ -0,0 +1,606 @@
+package raft
+
+//
+// segmented write-ahead log storage for Raft.
+//
+// instead of rewriting the whole Logs on every persist(), Raft appends
+// what changed since the last persist() as records to the current
+// segment file:
+//   append   new entries at the end of the Logs
+//   truncate entries after an index were removed (a conflict with the leader)
+//   compact  entries up to an index are in the snapshot now
+// CurrentTerm and VotedFor are small and change rarely, they live in
+// their own file. on restart the records are replayed to rebuild Logs.
+// see format.go for how segments and records are laid out.
+//
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//
+// a Persister that Raft saves its Logs to incrementally. if the
+// persister passed to Make() implements LogStorage, Raft uses these
+// methods instead of SaveRaftState()/ReadRaftState().
+//
+type LogStorage interface {
+	Persister
+	SaveHardState(term int, votedFor int)
+	AppendLogs(entries []LogEntry)
+	TruncateLogs(index int) // remove the entries after index
+	CompactLogs(index int, term int, config ConfigChange) // remove the entries up to and including index
+	ReadLogState() LogState
+}
+
+//
+// what a LogStorage recovered.
+//
+type LogState struct {
+	CurrentTerm        int
+	VotedFor           int
+	LastIncludedIndex  int
+	LastIncludedTerm   int
+	LastIncludedConfig *ConfigChange // nil if nothing was ever compacted
+	Entries            []LogEntry    // the entries after LastIncludedIndex
+}
+
+const (
+	walAppend = iota
+	walTruncate
+	walCompact
+)
+
+type walRecord struct {
+	Kind    int
+	Entries []LogEntry   // walAppend
+	Index   int          // walTruncate, walCompact
+	Term    int          // walCompact
+	Config  ConfigChange // walCompact
+
+	segment string // the file it was read from, not written
+}
+
+type walSegment struct {
+	seq      int
+	version  int // see format.go, 0 if written before segments had a header
+	size     int64
+	maxIndex int             // largest index appended in this segment
+	appends  []walAppendInfo // the append records in this segment
+}
+
+type walAppendInfo struct {
+	maxIndex int
+	size     int64
+}
+
+const (
+	hardStateFile      = "hardstate"
+	walSegmentPrefix   = "wal-"
+	walSegmentSuffix   = ".log"
+	defaultSegmentSize = 1 << 20
+)
+
+type WALPersister struct {
+	*FilePersister
+	segmentSize int64 // start a new segment once the current one is this big
+	segments    []*walSegment
+	current     *os.File // the last segment, open for appending
+	hardState   []byte
+	compacted   int      // index of the last compact record
+	state       LogState // what the WAL holds, kept up to date by writeRecord()
+}
+
+//
+// open the WAL in dir, creating dir if needed, and replay whatever
+// an earlier WALPersister saved there.
+//
+func MakeWALPersister(dir string) (*WALPersister, error) {
+	return MakeWALPersisterWithLogger(dir, logrusLogger{})
+}
+
+// like MakeWALPersister(), logging to logger, nil for no logging.
+func MakeWALPersisterWithLogger(dir string, logger Logger) (*WALPersister, error) {
+	fp, err := MakeFilePersisterWithLogger(dir, logger)
+	if err != nil {
+		return nil, err
+	}
+	wp := &WALPersister{
+		FilePersister: fp,
+		segmentSize:   defaultSegmentSize,
+	}
+	wp.state.VotedFor = VoteNull
+	if err := wp.recover(); err != nil {
+		return nil, err
+	}
+	return wp, nil
+}
+
+//
+// start a new segment once the current one holds size bytes, 1MB by
+// default. CompactLogs() only removes whole segments, so the WAL takes
+// up to about a segment more than RaftStateSize() on disk.
+//
+func (wp *WALPersister) SetSegmentSize(size int) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	wp.segmentSize = int64(size)
+}
+
+func (wp *WALPersister) segmentPath(seq int) string {
+	return filepath.Join(wp.dir, fmt.Sprintf("%s%016d%s", walSegmentPrefix, seq, walSegmentSuffix))
+}
+
+func (wp *WALPersister) recover() error {
+	hs, err := readFileIfExists(filepath.Join(wp.dir, hardStateFile))
+	if err != nil {
+		return err
+	}
+	if hs != nil {
+		if wp.state.CurrentTerm, wp.state.VotedFor, err = decodeHardState(hs); err != nil {
+			return err
+		}
+		wp.hardState = hs
+	}
+
+	names, err := segmentNames(wp.dir)
+	if err != nil {
+		return err
+	}
+	var records []walRecord
+	for i, name := range names {
+		seq, err := segmentSeq(name)
+		if err != nil {
+			return err
+		}
+		seg := &walSegment{seq: seq}
+		last := i == len(names)-1
+		recs, size, err := readSegment(name, seg, last)
+		if err != nil {
+			return err
+		}
+		if size < seg.size {
+			// 只有最后一个segment的最后一个record可能在crash时没写完，丢掉它是安全的：
+			// persist()在它durable之前不会返回，所以没有人依赖它
+			wp.logger.Infof("WAL %v: dropping torn record at offset %v", name, size)
+			if err := os.Truncate(name, size); err != nil {
+				return err
+			}
+			seg.size = size
+		}
+		records = append(records, recs...)
+		wp.segments = append(wp.segments, seg)
+	}
+	if err := wp.replay(records, nil); err != nil {
+		return err
+	}
+	wp.compacted = wp.state.LastIncludedIndex
+
+	if len(wp.segments) == 0 {
+		return wp.openSegment(0)
+	}
+	last := wp.segments[len(wp.segments)-1]
+	wp.current, err = os.OpenFile(wp.segmentPath(last.seq), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if last.size == 0 {
+		// crash发生在写segment header的时候
+		return wp.writeSegmentHeader(last)
+	}
+	if last.version != formatVersion {
+		// 不能在旧格式的segment后面写新格式的records
+		return wp.openSegment(last.seq + 1)
+	}
+	return nil
+}
+
+func decodeHardState(hs []byte) (int, int, error) {
+	// hard state是rename上去的，不会torn，checksum不对就是坏了
+	payload, err := decodeState(hs)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%v: %w", hardStateFile, err)
+	}
+	var term, votedFor int
+	d := gob.NewDecoder(bytes.NewBuffer(payload))
+	if err := d.Decode(&term); err != nil {
+		return 0, 0, fmt.Errorf("%v: %w: %v", hardStateFile, ErrCorrupt, err)
+	}
+	if err := d.Decode(&votedFor); err != nil {
+		return 0, 0, fmt.Errorf("%v: %w: %v", hardStateFile, ErrCorrupt, err)
+	}
+	return term, votedFor, nil
+}
+
+// the segment files in dir, oldest first.
+func segmentNames(dir string) ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(dir, walSegmentPrefix+"*"+walSegmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func segmentSeq(name string) (int, error) {
+	var seq int
+	base := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), walSegmentPrefix), walSegmentSuffix)
+	if _, err := fmt.Sscanf(base, "%d", &seq); err != nil {
+		return 0, fmt.Errorf("bad segment name %v", name)
+	}
+	return seq, nil
+}
+
+//
+// returns the valid records of the segment and the number of bytes
+// they take, seg.size is set to the file size. in the last segment
+// a torn header or final record is left out, anything else that
+// doesn't check out is an error.
+//
+func readSegment(name string, seg *walSegment, last bool) ([]walRecord, int64, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	seg.size = int64(len(data))
+	if last && len(data) < headerSize {
+		return nil, 0, nil
+	}
+	off := 0
+	if hasHeader(data) {
+		if err := checkHeader(data); err != nil {
+			return nil, 0, fmt.Errorf("%v: %w", name, err)
+		}
+		seg.version = formatVersion
+		off = headerSize
+	}
+	var records []walRecord
+	for off < len(data) {
+		var payload []byte
+		var n int
+		var torn bool
+		if seg.version == formatVersion {
+			payload, n, torn, err = decodeRecord(data[off:])
+		} else {
+			// version 0没有checksum，只有cut short的record能认出来是torn
+			payload, n, err = decodeLegacyRecord(data[off:])
+			torn = err != nil
+		}
+		if err != nil {
+			if last && torn {
+				return records, int64(off), nil
+			}
+			return nil, 0, fmt.Errorf("%v at offset %v: %w", name, off, err)
+		}
+		var rec walRecord
+		if err := gob.NewDecoder(bytes.NewBuffer(payload)).Decode(&rec); err != nil {
+			return nil, 0, fmt.Errorf("%v at offset %v: %w: %v", name, off, ErrCorrupt, err)
+		}
+		rec.segment = filepath.Base(name)
+		seg.addRecord(rec, int64(n))
+		records = append(records, rec)
+		off += n
+	}
+	return records, int64(off), nil
+}
+
+//
+// rebuild wp.state from records. a gap or an index appended twice is an
+// error, unless problems is non-nil: then it's added to problems, an
+// entry appended twice is skipped, and the entries after a gap are left
+// out, so that tools like cmd/raftdump can show the rest.
+//
+func (wp *WALPersister) replay(records []walRecord, problems *[]string) error {
+	report := func(format string, args ...interface{}) error {
+		if problems == nil {
+			return fmt.Errorf(format, args...)
+		}
+		*problems = append(*problems, fmt.Sprintf(format, args...))
+		return nil
+	}
+	st := &wp.state
+	gap := false
+	// 被删掉的segment里的entries都已经compact了，所以要先找到最后一个compact record
+	for _, rec := range records {
+		if rec.Kind == walCompact && rec.Index > st.LastIncludedIndex {
+			st.LastIncludedIndex = rec.Index
+			st.LastIncludedTerm = rec.Term
+			config := rec.Config
+			st.LastIncludedConfig = &config
+		}
+	}
+	for _, rec := range records {
+		switch rec.Kind {
+		case walAppend:
+			for _, e := range rec.Entries {
+				if gap {
+					break
+				}
+				next := st.LastIncludedIndex + len(st.Entries) + 1
+				if e.Index < next && e.Index > st.LastIncludedIndex {
+					if err := report("WAL %v appends index %v twice", rec.segment, e.Index); err != nil {
+						return err
+					}
+					continue
+				}
+				if e.Index > next {
+					if err := report("WAL %v is missing entries %v to %v", rec.segment, next, e.Index-1); err != nil {
+						return err
+					}
+					gap = true
+					break
+				}
+				if e.Index == next {
+					st.Entries = append(st.Entries, e)
+				}
+			}
+		case walTruncate:
+			st.truncate(rec.Index)
+		case walCompact:
+		default:
+			return fmt.Errorf("unknown WAL record kind %v", rec.Kind)
+		}
+	}
+	return nil
+}
+
+func (wp *WALPersister) openSegment(seq int) error {
+	f, err := os.OpenFile(wp.segmentPath(seq), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if wp.current != nil {
+		wp.current.Close()
+	}
+	wp.current = f
+	seg := &walSegment{seq: seq}
+	wp.segments = append(wp.segments, seg)
+	if err := wp.writeSegmentHeader(seg); err != nil {
+		return err
+	}
+	return wp.syncDir()
+}
+
+func (wp *WALPersister) writeSegmentHeader(seg *walSegment) error {
+	header := appendHeader(nil)
+	if _, err := wp.current.Write(header); err != nil {
+		return err
+	}
+	if err := wp.current.Sync(); err != nil {
+		return err
+	}
+	seg.version = formatVersion
+	seg.size = int64(len(header))
+	return nil
+}
+
+func (wp *WALPersister) syncDir() error {
+	d, err := os.Open(wp.dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// caller must hold wp.mu.
+func (wp *WALPersister) writeRecord(rec walRecord) error {
+	if wp.closed {
+		return nil
+	}
+	seg := wp.segments[len(wp.segments)-1]
+	if seg.size >= wp.segmentSize {
+		if err := wp.openSegment(seg.seq + 1); err != nil {
+			return err
+		}
+		seg = wp.segments[len(wp.segments)-1]
+	}
+
+	w := new(bytes.Buffer)
+	if err := gob.NewEncoder(w).Encode(rec); err != nil {
+		return err
+	}
+	buf := encodeRecord(w.Bytes())
+	if _, err := wp.current.Write(buf); err != nil {
+		return err
+	}
+	if err := wp.current.Sync(); err != nil {
+		return err
+	}
+	seg.size += int64(len(buf))
+	seg.addRecord(rec, int64(len(buf)))
+	wp.state.apply(rec)
+	return nil
+}
+
+// what replay() makes of rec, for a record Raft just wrote.
+func (st *LogState) apply(rec walRecord) {
+	switch rec.Kind {
+	case walAppend:
+		for _, e := range rec.Entries {
+			if e.Index == st.LastIncludedIndex+len(st.Entries)+1 {
+				st.Entries = append(st.Entries, e)
+			}
+		}
+	case walTruncate:
+		st.truncate(rec.Index)
+	case walCompact:
+		if rec.Index <= st.LastIncludedIndex {
+			return
+		}
+		if drop := rec.Index - st.LastIncludedIndex; drop < len(st.Entries) {
+			st.Entries = append([]LogEntry(nil), st.Entries[drop:]...)
+		} else {
+			st.Entries = nil
+		}
+		st.LastIncludedIndex = rec.Index
+		st.LastIncludedTerm = rec.Term
+		config := rec.Config
+		st.LastIncludedConfig = &config
+	}
+}
+
+// remove the entries after index.
+func (st *LogState) truncate(index int) {
+	keep := intMax(index-st.LastIncludedIndex, 0)
+	if keep < len(st.Entries) {
+		st.Entries = st.Entries[:keep]
+	}
+}
+
+func (seg *walSegment) addRecord(rec walRecord, size int64) {
+	if rec.Kind != walAppend || len(rec.Entries) == 0 {
+		return
+	}
+	info := walAppendInfo{size: size}
+	for _, e := range rec.Entries {
+		info.maxIndex = intMax(info.maxIndex, e.Index)
+	}
+	seg.maxIndex = intMax(seg.maxIndex, info.maxIndex)
+	seg.appends = append(seg.appends, info)
+}
+
+func (wp *WALPersister) SaveHardState(term int, votedFor int) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if wp.closed {
+		return
+	}
+	w := new(bytes.Buffer)
+	e := gob.NewEncoder(w)
+	e.Encode(term)
+	e.Encode(votedFor)
+	data := encodeState(w.Bytes())
+	if err := wp.writeFile(hardStateFile, data); err != nil {
+		fatalf(wp.logger, "WALPersister SaveHardState: %v", err)
+	}
+	wp.hardState = data
+	wp.state.CurrentTerm = term
+	wp.state.VotedFor = votedFor
+}
+
+func (wp *WALPersister) AppendLogs(entries []LogEntry) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if err := wp.writeRecord(walRecord{Kind: walAppend, Entries: entries}); err != nil {
+		fatalf(wp.logger, "WALPersister AppendLogs: %v", err)
+	}
+}
+
+func (wp *WALPersister) TruncateLogs(index int) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if err := wp.writeRecord(walRecord{Kind: walTruncate, Index: index}); err != nil {
+		fatalf(wp.logger, "WALPersister TruncateLogs: %v", err)
+	}
+}
+
+//
+// after the compact record is durable, segments that only hold
+// entries up to index are deleted. the current segment is always
+// kept, it holds the compact record.
+//
+func (wp *WALPersister) CompactLogs(index int, term int, config ConfigChange) {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	rec := walRecord{Kind: walCompact, Index: index, Term: term, Config: config}
+	if err := wp.writeRecord(rec); err != nil {
+		fatalf(wp.logger, "WALPersister CompactLogs: %v", err)
+	}
+	wp.compacted = intMax(wp.compacted, index)
+	for !wp.closed && len(wp.segments) > 1 && wp.segments[0].maxIndex <= index {
+		if err := os.Remove(wp.segmentPath(wp.segments[0].seq)); err != nil {
+			fatalf(wp.logger, "WALPersister CompactLogs: %v", err)
+		}
+		wp.segments = wp.segments[1:]
+	}
+}
+
+//
+// drop all later saves and close the current segment.
+//
+func (wp *WALPersister) Close() error {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	if wp.closed {
+		return nil
+	}
+	wp.closed = true
+	return wp.current.Close()
+}
+
+//
+// what the WAL holds now. Raft reads it once in Make().
+//
+func (wp *WALPersister) ReadLogState() LogState {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	st := wp.state
+	st.Entries = append([]LogEntry(nil), wp.state.Entries...)
+	return st
+}
+
+//
+// the state in the format persist() passes to SaveRaftState(), for
+// a Raft made with a persister that isn't a LogStorage, e.g. Copy().
+//
+func (wp *WALPersister) ReadRaftState() []byte {
+	st := wp.ReadLogState()
+	rs := raftState{
+		CurrentTerm:       st.CurrentTerm,
+		VotedFor:          st.VotedFor,
+		Logs:              append([]LogEntry{{Term: st.LastIncludedTerm, Index: st.LastIncludedIndex}}, st.Entries...),
+		LastIncludedIndex: st.LastIncludedIndex,
+		LastIncludedTerm:  st.LastIncludedTerm,
+	}
+	if st.LastIncludedConfig != nil {
+		rs.LastIncludedConfig = *st.LastIncludedConfig
+	}
+	return encodeRaftState(rs)
+}
+
+//
+// Raft saves to a WALPersister through the LogStorage methods only. a
+// whole state can't replace the WAL atomically, so this is fatal.
+//
+func (wp *WALPersister) SaveRaftState(data []byte) {
+	fatalf(wp.logger, "WALPersister SaveRaftState: save through the LogStorage methods")
+}
+
+//
+// an in-memory copy of the state and the snapshot, see ReadRaftState().
+// the files in dir keep belonging to wp.
+//
+func (wp *WALPersister) Copy() Persister {
+	np := MakePersister()
+	np.raftState = wp.ReadRaftState()
+	np.snapshot = wp.ReadSnapshot()
+	return np
+}
+
+//
+// the bytes of Raft state a snapshot can't get rid of: the hard state
+// and the append records with entries after the last compaction. the
+// older records stay on disk until their whole segment is compacted,
+// at most a segment size more, but a service that snapshots once this
+// reaches a limit must see it drop after Snapshot().
+//
+func (wp *WALPersister) RaftStateSize() int {
+	wp.mu.Lock()
+	defer wp.mu.Unlock()
+	size := int64(len(wp.hardState))
+	for _, seg := range wp.segments {
+		for _, info := range seg.appends {
+			if info.maxIndex > wp.compacted {
+				size += info.size
+			}
+		}
+	}
+	return int(size)
+}